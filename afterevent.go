@@ -0,0 +1,192 @@
+package dataexchanger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+const (
+	MESSAGE_HEADER_ROUTE = "route" // 消息头:产生消息的 api 路由
+)
+
+// DtoAfterEvent 执行成功后发布的消息
+type DtoAfterEvent struct {
+	Source   string `json:"source"`   // 消息资源标识(rabbitmq、redis)
+	Queue    string `json:"queue"`    // 队列(路由键)或 stream 名称
+	Template string `json:"template"` // 消息体模板名称,以执行结果(storage.DiskSpace)渲染
+}
+
+func (e DtoAfterEvent) validate() (err error) {
+	if e.Source == "" || e.Queue == "" || e.Template == "" {
+		err = errors.Errorf("afterEvent source,queue,template required,got:%+v", e)
+		return err
+	}
+	return nil
+}
+
+// outboxMessage 待发布的消息及其资源标识
+type outboxMessage struct {
+	Source string
+	Message
+}
+
+// runTx 单次执行在事务资源上开启的事务
+type runTx struct {
+	sourceIdentifer string
+	tx              *sql.Tx
+	provider        *DBProvider
+}
+
+// LogInfoAfterEvent 消息发布日志
+type LogInfoAfterEvent struct {
+	Context context.Context `json:"context"`
+	Source  string          `json:"source"`
+	Message Message         `json:"message"`
+	Err     error
+	logchan.EmptyLogInfo
+	container *Container // 不在单次执行中产生时(outbox 转发)记录产生日志的容器,按其脱敏规则脱敏
+}
+
+func (l LogInfoAfterEvent) GetName() logchan.LogName {
+	return LogName(LOG_INFO_AFTER_EVENT)
+}
+
+func (l LogInfoAfterEvent) Error() error {
+	return l.Err
+}
+
+// renderAfterEvents 以执行结果渲染消息体
+func (capi *apiCompiled) renderAfterEvents(diskSpace string) (messages []outboxMessage, err error) {
+	if len(capi.afterEvents) == 0 {
+		return nil, nil
+	}
+	data := make(map[string]interface{})
+	if diskSpace != "" {
+		if err = json.Unmarshal([]byte(diskSpace), &data); err != nil {
+			return nil, err
+		}
+	}
+	for _, afterEvent := range capi.afterEvents {
+		body, _, err := capi.template.Exec(afterEvent.Template, newVolume(data))
+		if err != nil {
+			err = errors.WithMessagef(err, "afterEvent template:%s", afterEvent.Template)
+			return nil, err
+		}
+		messages = append(messages, outboxMessage{
+			Source: afterEvent.Source,
+			Message: Message{
+				ID:      newMessageID(),
+				Queue:   afterEvent.Queue,
+				Body:    strings.TrimSpace(body),
+				Headers: map[string]string{MESSAGE_HEADER_ROUTE: capi.Route},
+			},
+		})
+	}
+	return messages, nil
+}
+
+// beginTransaction 在事务资源上开启事务,读写分离资源使用主库并固定后续读操作到主库
+func (capi *apiCompiled) beginTransaction(ctx context.Context, state *runState) (err error) {
+	sourceIdentifer, provider, err := capi.getProviderBySource(ctx, capi.transaction)
+	if err != nil {
+		return err
+	}
+	var dbProvider *DBProvider
+	switch p := provider.(type) {
+	case *DBProvider:
+		dbProvider = p
+	case *ReplicaDBProvider:
+		state.pinPrimary(p)
+		dbProvider = p.Primary()
+	default:
+		err = errors.Errorf("transaction required sql source,got:%s", provider.TypeName())
+		return err
+	}
+	tx, err := dbProvider.GetDB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	state.setTx(&runTx{sourceIdentifer: sourceIdentifer, tx: tx, provider: dbProvider})
+	return nil
+}
+
+// commitTransaction 消息写入 outbox 表后提交事务,与业务数据同时生效
+func (capi *apiCompiled) commitTransaction(ctx context.Context, state *runState, messages []outboxMessage) (err error) {
+	runTx := state.getTx()
+	if runTx == nil {
+		return nil
+	}
+	now := time.Now()
+	named := fmt.Sprintf(`insert into %s (id,source,queue,body,headers,status,attempts,next_at,created_at) values (:id,:source,:queue,:body,:headers,%d,0,:nextAt,:now)`, runTx.provider.Dialect().Quote(capi.outboxTable), OUTBOX_STATUS_PENDING)
+	for _, message := range messages {
+		headers, err := json.Marshal(message.Headers)
+		if err != nil {
+			return err
+		}
+		data := map[string]interface{}{
+			"id":      message.ID,
+			"source":  message.Source,
+			"queue":   message.Queue,
+			"body":    message.Body,
+			"headers": string(headers),
+			"now":     outboxTime(now),
+			"nextAt":  outboxTime(now.Add(OUTBOX_INFLIGHT_DELAY)),
+		}
+		statement, args, err := toStatement(runTx.provider.Dialect(), named, data)
+		if err != nil {
+			return err
+		}
+		if _, err = execOrQueryContext(ctx, runTx.tx, statement, args...); err != nil {
+			return err
+		}
+	}
+	state.setTx(nil)
+	return runTx.tx.Commit()
+}
+
+// publishAfterEvents 发布消息:事务接口提交后立即发布一次,失败的消息留在 outbox 表由中继重试;
+// 非事务接口失败时重试,最终失败记录日志后继续发布其余消息(脚本的写操作已生效,不能让调用方重试整个请求),需要可靠投递时使用 outbox
+func (capi *apiCompiled) publishAfterEvents(ctx context.Context, outbox *DBProvider, messages []outboxMessage) {
+	cfg := OutboxRelayConfig{Table: capi.outboxTable}.withDefaults()
+	for _, message := range messages {
+		publisher, err := capi.getPublisher(ctx, message.Source)
+		if err == nil {
+			if outbox != nil {
+				err = publisher.PublishMessage(ctx, message.Message)
+			} else {
+				err = publishWithRetry(ctx, publisher, message.Message)
+			}
+		}
+		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.publishAfterEvents,route:%s,queue:%s", capi.Route, message.Queue)
+		}
+		logchan.SendLogInfo(&LogInfoAfterEvent{Context: ctx, Source: message.Source, Message: message.Message, Err: err})
+		if outbox == nil {
+			continue
+		}
+		if markErr := markOutboxMessage(ctx, outbox, cfg, message.ID, 0, err); markErr != nil {
+			logchan.SendLogInfo(&LogInfoAfterEvent{Context: ctx, Source: message.Source, Message: message.Message, Err: markErr})
+		}
+	}
+}
+
+// getPublisher 获取消息资源
+func (capi *apiCompiled) getPublisher(ctx context.Context, sourceIdentifer string) (publisher MessagePublisher, err error) {
+	_, provider, err := capi.getProviderBySource(ctx, sourceIdentifer)
+	if err != nil {
+		return nil, err
+	}
+	publisher, ok := provider.(MessagePublisher)
+	if !ok {
+		err = errors.Errorf("afterEvent required message source,got:%s", provider.TypeName())
+		return nil, err
+	}
+	return publisher, nil
+}
@@ -0,0 +1,300 @@
+package dataexchanger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	AUDIT_TABLE_DEFAULT = "dataexchanger_audit"
+
+	CONTEXT_KEY_TRACE_ID    = ContextKeyType("traceID")
+	CONTEXT_KEY_EXEC_RESULT = ContextKeyType("execResult")
+	HTTP_HEADER_TRACE_ID    = "X-Trace-Id"
+)
+
+// WithTraceID 将链路ID放入上下文,审计记录中使用
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, CONTEXT_KEY_TRACE_ID, traceID)
+}
+
+// GetTraceID 获取上下文中的链路ID
+func GetTraceID(ctx context.Context) (traceID string) {
+	traceID, _ = ctx.Value(CONTEXT_KEY_TRACE_ID).(string)
+	return traceID
+}
+
+// execResult 写操作的执行结果,通过上下文传入 execOrQueryContext 获取准确的影响行数
+type execResult struct {
+	captured     bool
+	AffectedRows int64
+	LastInsertID int64
+}
+
+// AuditRecord 写操作审计记录
+type AuditRecord struct {
+	ID           string        `json:"id"`
+	Route        string        `json:"route"`
+	Subject      string        `json:"subject"` // 调用方身份标识
+	TraceID      string        `json:"traceId"`
+	Template     string        `json:"template"`
+	Source       string        `json:"source"`
+	Statement    string        `json:"statement"`
+	Args         []interface{} `json:"args"`
+	Input        string        `json:"input"` // api 输入
+	Data         string        `json:"data"`  // 模板数据
+	AffectedRows int64         `json:"affectedRows"`
+	Before       string        `json:"before"` // 模板声明审计主键时,执行前的行
+	After        string        `json:"after"`  // 模板声明审计主键时,执行后的行
+	Error        string        `json:"error"`
+	CreatedAt    time.Time     `json:"createdAt"`
+}
+
+// AuditSink 审计记录存储
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record *AuditRecord) (err error)
+}
+
+// DtoAuditKey 模板审计主键声明,用于记录写操作前后的行
+type DtoAuditKey struct {
+	Table  string `json:"table"`  // 写入的表
+	Column string `json:"column"` // 主键列
+	Param  string `json:"param"`  // 模板数据中主键值的名称,默认与列名相同;插入时缺省则使用自增ID
+}
+
+func (dto DtoAuditKey) validate() (err error) {
+	if dto.Table == "" || dto.Column == "" {
+		err = errors.Errorf("audit key table,column required,got:%+v", dto)
+		return err
+	}
+	return nil
+}
+
+// SetAuditSink 设置审计存储,设置后记录所有 api 中模板的写操作
+func (c *Container) SetAuditSink(sink AuditSink) {
+	c.lockAudit.Lock()
+	defer c.lockAudit.Unlock()
+	c.auditSink = sink
+}
+
+func (capi *apiCompiled) getAuditSink() (sink AuditSink) {
+	if capi._container == nil {
+		return nil
+	}
+	capi._container.lockAudit.Lock()
+	defer capi._container.lockAudit.Unlock()
+	return capi._container.auditSink
+}
+
+//SetTemplateAuditKey 设置模板写入的表及主键,审计记录中包含执行前后的行
+func (capi *apiCompiled) SetTemplateAuditKey(templateIdentifers []string, key DtoAuditKey) (err error) {
+	if err = key.validate(); err != nil {
+		return err
+	}
+	if key.Param == "" {
+		key.Param = key.Column
+	}
+	for _, tplName := range templateIdentifers {
+		capi.auditKeys[tplName] = key
+	}
+	return nil
+}
+
+// auditImage 查询主键对应的行,在写操作相同的事务或资源(主库)上执行
+func (capi *apiCompiled) auditImage(ctx context.Context, key DtoAuditKey, dialect Dialect, sourceIdentifer string, provider tengo.Object, value interface{}) (image string, err error) {
+	named := fmt.Sprintf(`select * from %s where %s=:key`, dialect.Quote(key.Table), dialect.Quote(key.Column))
+	statement, args, err := toStatement(dialect, named, map[string]interface{}{"key": value})
+	if err != nil {
+		return "", err
+	}
+	ctx = context.WithValue(ctx, CONTEXT_KEY_DB_ROUTE, DB_ROUTE_PRIMARY)
+	return capi.execStatement(ctx, "", dialect, sourceIdentifer, provider, statement, args, nil)
+}
+
+// execAudited 执行写操作并记录审计,审计写入失败时返回错误(事务内执行时随事务回滚)
+func (capi *apiCompiled) execAudited(ctx context.Context, sink AuditSink, tplName string, dialect Dialect, sourceIdentifer string, provider tengo.Object, statement string, args []interface{}, data map[string]interface{}) (out string, err error) {
+	record := &AuditRecord{
+		ID:        newMessageID(),
+		Route:     capi.Route,
+		TraceID:   GetTraceID(ctx),
+		Template:  tplName,
+		Source:    sourceIdentifer,
+		Statement: statement,
+		Args:      args,
+		CreatedAt: time.Now().Local(),
+	}
+	if principal := GetPrincipal(ctx); principal != nil {
+		record.Subject = principal.Subject
+	}
+	state := getRunState(ctx)
+	if state != nil {
+		record.Input = state.input
+	}
+	templateData := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if k != VOLUME_KEY_DIALECT {
+			templateData[k] = v
+		}
+	}
+	if b, err := json.Marshal(templateData); err == nil {
+		record.Data = string(b)
+	}
+	key, hasKey := capi.auditKeys[tplName]
+	keyValue := data[key.Param]
+	if hasKey && keyValue != nil {
+		if record.Before, err = capi.auditImage(ctx, key, dialect, sourceIdentifer, provider, keyValue); err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.audit.Before,route:%s,template:%s", capi.Route, tplName)
+			return "", err
+		}
+	}
+	result := &execResult{}
+	out, err = capi.execStatement(context.WithValue(ctx, CONTEXT_KEY_EXEC_RESULT, result), tplName, dialect, sourceIdentifer, provider, statement, args, data)
+	if result.captured {
+		record.AffectedRows = result.AffectedRows
+	} else if err == nil {
+		record.AffectedRows, _ = strconv.ParseInt(out, 10, 64)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	} else if hasKey {
+		if keyValue == nil && result.LastInsertID > 0 {
+			keyValue = result.LastInsertID
+		}
+		if keyValue != nil {
+			if record.After, err = capi.auditImage(ctx, key, dialect, sourceIdentifer, provider, keyValue); err != nil {
+				err = errors.WithMessagef(err, "apiCompiled.audit.After,route:%s,template:%s", capi.Route, tplName)
+				return "", err
+			}
+		}
+	}
+	if state != nil && state.logMasker != nil { // 敏感字段与日志一样脱敏
+		masker := state.logMasker
+		record.Input, record.Data = masker.maskPayload(record.Input), masker.maskPayload(record.Data)
+		record.Before, record.After = masker.maskPayload(record.Before), masker.maskPayload(record.After)
+		record.Args, _ = masker.maskInterface(record.Args).([]interface{})
+	}
+	writeErr := sink.WriteAudit(ctx, record)
+	if err != nil {
+		return "", err
+	}
+	if writeErr != nil {
+		err = errors.WithMessagef(writeErr, "apiCompiled.audit,route:%s,template:%s", capi.Route, tplName)
+		return "", err
+	}
+	return out, nil
+}
+
+// SQLAuditSink 审计记录写入数据库表,执行中开启了同一资源上的事务时随事务提交
+type SQLAuditSink struct {
+	provider *DBProvider
+	table    string
+}
+
+func NewSQLAuditSink(provider *DBProvider, table string) (s *SQLAuditSink) {
+	if table == "" {
+		table = AUDIT_TABLE_DEFAULT
+	}
+	return &SQLAuditSink{provider: provider, table: table}
+}
+
+// AuditDDL 审计表建表语句,table 为空时使用默认表名
+func AuditDDL(d Dialect, table string) string {
+	if table == "" {
+		table = AUDIT_TABLE_DEFAULT
+	}
+	return fmt.Sprintf(`create table if not exists %s (
+	id varchar(64) not null primary key,
+	route varchar(255) not null,
+	subject varchar(255) not null,
+	trace_id varchar(128) not null,
+	template varchar(255) not null,
+	source varchar(128) not null,
+	statement text not null,
+	args text not null,
+	input text not null,
+	data text not null,
+	affected_rows int not null,
+	before_image text not null,
+	after_image text not null,
+	error text not null,
+	created_at varchar(32) not null
+)`, d.Quote(table))
+}
+
+// WriteAudit 实现 AuditSink
+func (s *SQLAuditSink) WriteAudit(ctx context.Context, record *AuditRecord) (err error) {
+	args, err := json.Marshal(record.Args)
+	if err != nil {
+		return err
+	}
+	d := s.provider.Dialect()
+	named := fmt.Sprintf(`insert into %s (id,route,subject,trace_id,template,source,statement,args,input,data,affected_rows,before_image,after_image,error,created_at)
+	values (:id,:route,:subject,:traceId,:template,:source,:statement,:args,:input,:data,:affectedRows,:before,:after,:error,:createdAt)`, d.Quote(s.table))
+	statement, bindArgs, err := toStatement(d, named, map[string]interface{}{
+		"id":           record.ID,
+		"route":        record.Route,
+		"subject":      record.Subject,
+		"traceId":      record.TraceID,
+		"template":     record.Template,
+		"source":       record.Source,
+		"statement":    record.Statement,
+		"args":         string(args),
+		"input":        record.Input,
+		"data":         record.Data,
+		"affectedRows": record.AffectedRows,
+		"before":       record.Before,
+		"after":        record.After,
+		"error":        record.Error,
+		"createdAt":    outboxTime(record.CreatedAt),
+	})
+	if err != nil {
+		return err
+	}
+	if tx := getRunState(ctx).getTx(); tx != nil && tx.provider == s.provider {
+		_, err = execOrQueryContext(ctx, tx.tx, statement, bindArgs...)
+		return err
+	}
+	_, err = execOrQueryContext(ctx, s.provider.GetDB(), statement, bindArgs...)
+	return err
+}
+
+// FileAuditSink 审计记录以 json 行追加写入文件
+type FileAuditSink struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+func NewFileAuditSink(filename string) (s *FileAuditSink, err error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		err = errors.WithMessagef(err, "NewFileAuditSink,file:%s", filename)
+		return nil, err
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+// WriteAudit 实现 AuditSink
+func (s *FileAuditSink) WriteAudit(ctx context.Context, record *AuditRecord) (err error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+func (s *FileAuditSink) Close() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,137 @@
+package dataexchanger_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(dir, "audit.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, ddl := range []string{
+		`create table users (id integer primary key autoincrement, name text)`,
+		`insert into users (name) values ('alice')`,
+		dataexchanger.AuditDDL(provider.Dialect(), ""),
+	} {
+		if _, err = provider.ExecOrQueryContext(ctx, ddl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/user/rename",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,required
+		fullname=name,dst=name,required`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=newId,src=newId,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		input:=storage.GetMemory()
+		execSQLTPL(ctx,"Rename",input)
+		execSQLTPL(ctx,"Get",input)
+		storage.Set("newId",execSQLTPL(ctx,"Create",{name:input.name+"-copy"}))
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Rename"}}update users set name=:name where id=:id{{end}}
+	{{define "Get"}}select name from users where id=:id{{end}}
+	{{define "Create"}}insert into users (name) values (:name){{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateAuditKey([]string{"Rename", "Create"}, dataexchanger.DtoAuditKey{Table: "users"}); err == nil {
+		t.Error("audit key without column want error")
+	}
+	if err = capi.SetTemplateAuditKey([]string{"Rename", "Create"}, dataexchanger.DtoAuditKey{Table: "users", Column: "id"}); err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx := dataexchanger.WithTraceID(dataexchanger.WithPrincipal(ctx, &dataexchanger.Principal{Subject: "admin"}), "trace-1")
+	container.SetAuditSink(dataexchanger.NewSQLAuditSink(provider, ""))
+	if _, err = capi.Run(runCtx, `{"id":"1","name":"bob"}`); err != nil {
+		t.Fatal(err)
+	}
+	records, err := provider.ExecOrQueryContext(ctx, `select * from dataexchanger_audit order by template desc`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := gjson.Get(records, "#").Int(); n != 2 {
+		t.Fatalf("want 2 audit records(select not audited),got:%s", records)
+	}
+	rename, create := gjson.Get(records, "0"), gjson.Get(records, "1")
+	if rename.Get("template").String() != "Rename" || rename.Get("route").String() != api.Route || rename.Get("subject").String() != "admin" || rename.Get("trace_id").String() != "trace-1" || rename.Get("affected_rows").String() != "1" {
+		t.Errorf("rename record got:%s", rename.Raw)
+	}
+	if !strings.Contains(rename.Get("before_image").String(), "alice") || !strings.Contains(rename.Get("after_image").String(), "bob") {
+		t.Errorf("rename images got before:%s,after:%s", rename.Get("before_image"), rename.Get("after_image"))
+	}
+	if gjson.Get(rename.Get("input").String(), "name").String() != "bob" || gjson.Get(rename.Get("data").String(), "id").String() != "1" {
+		t.Errorf("rename input/data got:%s", rename.Raw)
+	}
+	if create.Get("template").String() != "Create" || create.Get("before_image").String() != "" || !strings.Contains(create.Get("after_image").String(), "bob-copy") {
+		t.Errorf("create record got:%s", create.Raw)
+	}
+
+	auditFile := filepath.Join(dir, "audit.log")
+	fileSink, err := dataexchanger.NewFileAuditSink(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.SetAuditSink(fileSink)
+	if _, err = capi.Run(runCtx, `{"id":"100","name":"nobody"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = fileSink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fileRecords := make([]dataexchanger.AuditRecord, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record dataexchanger.AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		fileRecords = append(fileRecords, record)
+	}
+	if len(fileRecords) != 2 {
+		t.Fatalf("want 2 file audit records,got:%d", len(fileRecords))
+	}
+	if r := fileRecords[0]; r.Template != "Rename" || r.AffectedRows != 0 || r.Before != "" || r.After != "" || r.TraceID != "trace-1" {
+		t.Errorf("missing row rename record got:%+v", r)
+	}
+}
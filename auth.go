@@ -0,0 +1,141 @@
+package dataexchanger
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CONTEXT_KEY_PRINCIPAL = ContextKeyType("principal")
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// Principal 调用方身份
+type Principal struct {
+	Subject     string                 `json:"subject"`     // 调用方标识(用户ID、应用ID等)
+	Roles       []string               `json:"roles"`       // 角色
+	Permissions []string               `json:"permissions"` // 权限
+	Claims      map[string]interface{} `json:"claims"`      // 认证时附带的其它信息
+}
+
+// HasRole 是否拥有角色
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission 是否拥有权限,权限支持 * 及 order:* 形式的通配
+func (p *Principal) HasPermission(permission string) bool {
+	if p == nil {
+		return false
+	}
+	for _, granted := range p.Permissions {
+		if granted == permission || granted == "*" {
+			return true
+		}
+		if strings.HasSuffix(granted, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(granted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPrincipal 将调用方身份放入上下文
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, CONTEXT_KEY_PRINCIPAL, principal)
+}
+
+// GetPrincipal 获取上下文中的调用方身份,未认证时返回 nil
+func GetPrincipal(ctx context.Context) (principal *Principal) {
+	principal, _ = ctx.Value(CONTEXT_KEY_PRINCIPAL).(*Principal)
+	return principal
+}
+
+// Authenticator 认证请求,请求未携带该方式的凭证时返回 nil,凭证无效时返回错误
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal *Principal, err error)
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator
+type AuthenticatorFunc func(r *http.Request) (principal *Principal, err error)
+
+func (fn AuthenticatorFunc) Authenticate(r *http.Request) (principal *Principal, err error) {
+	return fn(r)
+}
+
+// RegisterAuthenticator 注册认证器,按注册顺序尝试,取第一个返回身份的认证器
+func (c *Container) RegisterAuthenticator(authenticator Authenticator) {
+	c.lockAuth.Lock()
+	defer c.lockAuth.Unlock()
+	c.authenticators = append(c.authenticators, authenticator)
+}
+
+// authenticate 认证请求,凭证无效时返回 401 错误
+func (c *Container) authenticate(r *http.Request) (principal *Principal, err error) {
+	c.lockAuth.Lock()
+	authenticators := c.authenticators
+	c.lockAuth.Unlock()
+	for _, authenticator := range authenticators {
+		principal, err = authenticator.Authenticate(r)
+		if err != nil {
+			if HTTPStatus(err) == http.StatusInternalServerError {
+				err = NewStatusError(http.StatusUnauthorized, err)
+			}
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+	return nil, nil
+}
+
+// authorize 校验调用方是否拥有 api 声明的角色(任一)和权限(全部)
+func (capi *apiCompiled) authorize(ctx context.Context) (err error) {
+	return authorizePrincipal(ctx, capi.roles, capi.permissions)
+}
+
+// authorizePrincipal 校验上下文中的调用方拥有 roles 中任一角色和 permissions 中全部权限,均未声明时不校验
+func authorizePrincipal(ctx context.Context, roles []string, permissions []string) (err error) {
+	if len(roles) == 0 && len(permissions) == 0 {
+		return nil
+	}
+	principal := GetPrincipal(ctx)
+	if principal == nil {
+		return NewStatusError(http.StatusUnauthorized, ErrUnauthenticated)
+	}
+	if len(roles) > 0 {
+		matched := false
+		for _, role := range roles {
+			if principal.HasRole(role) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			err = errors.WithMessagef(ErrForbidden, "role required any of:%s,subject:%s", strings.Join(roles, ","), principal.Subject)
+			return NewStatusError(http.StatusForbidden, err)
+		}
+	}
+	for _, permission := range permissions {
+		if !principal.HasPermission(permission) {
+			err = errors.WithMessagef(ErrForbidden, "permission required:%s,subject:%s", permission, principal.Subject)
+			return NewStatusError(http.StatusForbidden, err)
+		}
+	}
+	return nil
+}
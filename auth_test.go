@@ -0,0 +1,103 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestAuthorizeAndMask(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods:     "POST",
+		Route:       "/api/user/list",
+		Roles:       []string{"admin", "operator"},
+		Permissions: []string{"user:read"},
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=keyword,dst=keyword`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=owner,src=owner,mask=name
+		fullname=items[].phone,src=users.#.phone,mask=phone,unmask=user:phone
+		fullname=items[].email,src=users.#.email,mask=email`,
+		MainScript: `
+		storage.Set("owner","张三丰")
+		storage.Set("users",[{phone:"13812345678",email:"alice@example.com"},{phone:"13900001111",email:"bob@example.com"}])
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	container.RegisterAuthenticator(dataexchanger.AuthenticatorFunc(func(r *http.Request) (*dataexchanger.Principal, error) {
+		switch r.Header.Get("X-Test-User") {
+		case "":
+			return nil, nil
+		case "operator":
+			return &dataexchanger.Principal{Subject: "1", Roles: []string{"operator"}, Permissions: []string{"user:read"}}, nil
+		case "admin":
+			return &dataexchanger.Principal{Subject: "2", Roles: []string{"admin"}, Permissions: []string{"user:*"}}, nil
+		case "guest":
+			return &dataexchanger.Principal{Subject: "3", Roles: []string{"guest"}, Permissions: []string{"user:read"}}, nil
+		}
+		return nil, errors.New("invalid user")
+	}))
+	serve := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, api.Route, strings.NewReader(`{}`))
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		rec := httptest.NewRecorder()
+		container.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for user, status := range map[string]int{"": http.StatusUnauthorized, "unknown": http.StatusUnauthorized, "guest": http.StatusForbidden} {
+		if rec := serve(user); rec.Code != status {
+			t.Errorf("user %q want status %d,got:%d,body:%s", user, status, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := serve("operator")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status 200,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	want := `["张**",["138****5678","139****1111"],["a****@example.com","b**@example.com"]]`
+	if got := gjson.Get(rec.Body.String(), "[owner,items.#.phone,items.#.email]").Raw; got != want {
+		t.Errorf("operator want:%s\ngot: %s", want, got)
+	}
+
+	rec = serve("admin")
+	want = `[["13812345678","13900001111"],["a****@example.com","b**@example.com"]]`
+	if got := gjson.Get(rec.Body.String(), "[items.#.phone,items.#.email]").Raw; got != want {
+		t.Errorf("admin want:%s\ngot: %s", want, got)
+	}
+
+	_, err = capi.Run(context.Background(), `{}`)
+	if dataexchanger.HTTPStatus(err) != http.StatusUnauthorized {
+		t.Errorf("run without principal want 401,got:%v", err)
+	}
+	ctx := dataexchanger.WithPrincipal(context.Background(), &dataexchanger.Principal{Roles: []string{"admin"}, Permissions: []string{"*"}})
+	out, err := capi.Run(ctx, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.Get(out, "owner").String(); got != "张**" {
+		t.Errorf("owner without unmask want masked,got:%s", got)
+	}
+
+	api.OutputLineSchema = `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+	fullname=owner,src=owner,mask=unknown`
+	if _, err = dataexchanger.NewApiCompiled(api); err == nil {
+		t.Error("unknown mask strategy want error")
+	}
+}
@@ -0,0 +1,535 @@
+package dataexchanger
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+)
+
+const (
+	JWT_ALG_HS256 = "HS256"
+	JWT_ALG_RS256 = "RS256"
+
+	JWK_KTY_OCT = "oct"
+	JWK_KTY_RSA = "RSA"
+
+	JWT_ROLES_CLAIM_DEFAULT       = "roles"
+	JWT_PERMISSIONS_CLAIM_DEFAULT = "scope" // 空格分隔的字符串或数组
+
+	HMAC_HEADER_KEY_ID    = "X-Key-Id"
+	HMAC_HEADER_TIMESTAMP = "X-Timestamp" // unix 秒
+	HMAC_HEADER_NONCE     = "X-Nonce"
+	HMAC_HEADER_SIGNATURE = "X-Signature" // hex(hmac-sha256(签名串))
+	HMAC_MAX_SKEW_DEFAULT = 5 * time.Minute
+	NONCE_KEY_PREFIX      = "dataexchanger:nonce:"
+
+	API_KEY_HEADER_DEFAULT = "X-API-Key"
+)
+
+// JWTConfig jwt 认证配置
+type JWTConfig struct {
+	JWKSFile         string        // 本地 jwks 文件,支持 oct(HS256)、RSA(RS256) 密钥
+	Issuer           string        // 不为空时校验 iss
+	Audience         string        // 不为空时校验 aud
+	Leeway           time.Duration // exp、nbf 允许的时钟偏差
+	RolesClaim       string        // 角色所在的 claim,默认 roles
+	PermissionsClaim string        // 权限所在的 claim,默认 scope
+}
+
+// jwk jwks 中的单个密钥
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwtKey 解析后的验签密钥
+type jwtKey struct {
+	kid    string
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+// JWTAuthenticator 从 Authorization: Bearer 头读取并验证 jwt
+type JWTAuthenticator struct {
+	cfg  JWTConfig
+	keys []jwtKey
+	lock sync.RWMutex
+}
+
+func NewJWTAuthenticator(cfg JWTConfig) (a *JWTAuthenticator, err error) {
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = JWT_ROLES_CLAIM_DEFAULT
+	}
+	if cfg.PermissionsClaim == "" {
+		cfg.PermissionsClaim = JWT_PERMISSIONS_CLAIM_DEFAULT
+	}
+	a = &JWTAuthenticator{cfg: cfg}
+	if err = a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload 重新读取 jwks 文件,用于密钥轮换
+func (a *JWTAuthenticator) Reload() (err error) {
+	b, err := os.ReadFile(a.cfg.JWKSFile)
+	if err != nil {
+		err = errors.WithMessagef(err, "JWTAuthenticator.Reload,file:%s", a.cfg.JWKSFile)
+		return err
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &jwks); err != nil {
+		err = errors.WithMessagef(err, "JWTAuthenticator.Reload,file:%s", a.cfg.JWKSFile)
+		return err
+	}
+	keys := make([]jwtKey, 0, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		key, err := parseJWK(k)
+		if err != nil {
+			err = errors.WithMessagef(err, "JWTAuthenticator.Reload,file:%s,kid:%s", a.cfg.JWKSFile, k.Kid)
+			return err
+		}
+		keys = append(keys, key)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.keys = keys
+	return nil
+}
+
+func parseJWK(k jwk) (key jwtKey, err error) {
+	key = jwtKey{kid: k.Kid}
+	switch k.Kty {
+	case JWK_KTY_OCT:
+		key.alg = JWT_ALG_HS256
+		if key.secret, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(k.K, "=")); err != nil {
+			return key, err
+		}
+		if len(key.secret) == 0 {
+			return key, errors.New("jwk oct k required")
+		}
+	case JWK_KTY_RSA:
+		key.alg = JWT_ALG_RS256
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			return key, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil {
+			return key, err
+		}
+		key.public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.public.N.Sign() == 0 || key.public.E == 0 {
+			return key, errors.New("jwk RSA n,e required")
+		}
+	default:
+		return key, errors.Errorf("jwk kty want oct/RSA,got:%s", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != key.alg {
+		return key, errors.Errorf("jwk alg want %s,got:%s", key.alg, k.Alg)
+	}
+	return key, nil
+}
+
+// findKey 按 kid 和算法查找密钥,token 未指定 kid 时使用第一个同算法的密钥
+func (a *JWTAuthenticator) findKey(kid string, alg string) (key jwtKey, ok bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, key := range a.keys {
+		if key.alg == alg && (kid == "" || key.kid == kid) {
+			return key, true
+		}
+	}
+	return key, false
+}
+
+// Authenticate 实现 Authenticator
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (principal *Principal, err error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, nil
+	}
+	claims, err := a.Verify(strings.TrimSpace(authorization[7:]), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	principal = &Principal{
+		Claims:      claims,
+		Roles:       claimStrings(claims[a.cfg.RolesClaim]),
+		Permissions: claimStrings(claims[a.cfg.PermissionsClaim]),
+	}
+	principal.Subject, _ = claims["sub"].(string)
+	return principal, nil
+}
+
+// Verify 验证 jwt 签名及 exp、nbf、iss、aud,返回 claims
+func (a *JWTAuthenticator) Verify(token string, now time.Time) (claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.WithMessage(err, "jwt header")
+	}
+	key, ok := a.findKey(header.Kid, header.Alg)
+	if !ok {
+		return nil, errors.Errorf("jwt key not found,alg:%s,kid:%s", header.Alg, header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.WithMessage(err, "jwt signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch key.alg {
+	case JWT_ALG_HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("jwt signature invalid")
+		}
+	case JWT_ALG_RS256:
+		digest := sha256.Sum256(signed)
+		if err = rsa.VerifyPKCS1v15(key.public, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.WithMessage(err, "jwt signature invalid")
+		}
+	}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.WithMessage(err, "jwt claims")
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(a.cfg.Leeway)) {
+		return nil, errors.New("jwt expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt not valid yet")
+	}
+	if a.cfg.Issuer != "" && claims["iss"] != a.cfg.Issuer {
+		return nil, errors.Errorf("jwt issuer want %s,got:%v", a.cfg.Issuer, claims["iss"])
+	}
+	if a.cfg.Audience != "" {
+		audiences := claimStrings(claims["aud"])
+		matched := false
+		for _, audience := range audiences {
+			if audience == a.cfg.Audience {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, errors.Errorf("jwt audience want %s,got:%v", a.cfg.Audience, claims["aud"])
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) (err error) {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimStrings 将空格分隔的字符串或数组形式的 claim 转换为字符串切片
+func claimStrings(claim interface{}) (values []string) {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// NonceStore 记录已使用的 nonce,防止签名请求被重放
+type NonceStore interface {
+	// UseNonce 记录 nonce,ttl 内已使用过时 fresh 为 false
+	UseNonce(ctx context.Context, nonce string, ttl time.Duration) (fresh bool, err error)
+}
+
+type nonceExpire struct {
+	nonce    string
+	expireAt time.Time
+}
+
+// nonceQueue 按过期时间排序的小顶堆
+type nonceQueue []nonceExpire
+
+func (q nonceQueue) Len() int            { return len(q) }
+func (q nonceQueue) Less(i, j int) bool  { return q[i].expireAt.Before(q[j].expireAt) }
+func (q nonceQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nonceQueue) Push(x interface{}) { *q = append(*q, x.(nonceExpire)) }
+func (q *nonceQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// MemoryNonceStore 进程内 nonce 记录
+type MemoryNonceStore struct {
+	nonces map[string]time.Time // nonce => 过期时间
+	queue  nonceQueue           // 按过期时间排序,每次只清理堆顶已过期的记录
+	lock   sync.Mutex
+}
+
+func NewMemoryNonceStore() (s *MemoryNonceStore) {
+	return &MemoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+// UseNonce 实现 NonceStore
+func (s *MemoryNonceStore) UseNonce(ctx context.Context, nonce string, ttl time.Duration) (fresh bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for len(s.queue) > 0 && now.After(s.queue[0].expireAt) { // 清理过期记录
+		item := heap.Pop(&s.queue).(nonceExpire)
+		if expireAt, ok := s.nonces[item.nonce]; ok && !expireAt.After(item.expireAt) {
+			delete(s.nonces, item.nonce)
+		}
+	}
+	if _, ok := s.nonces[nonce]; ok {
+		return false, nil
+	}
+	expireAt := now.Add(ttl)
+	s.nonces[nonce] = expireAt
+	heap.Push(&s.queue, nonceExpire{nonce: nonce, expireAt: expireAt})
+	return true, nil
+}
+
+// Len 未清理的记录数
+func (s *MemoryNonceStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.nonces)
+}
+
+// UseNonce 实现 NonceStore,多实例共享
+func (p *RedisProvider) UseNonce(ctx context.Context, nonce string, ttl time.Duration) (fresh bool, err error) {
+	return p.client.SetNX(ctx, NONCE_KEY_PREFIX+nonce, 1, ttl).Result()
+}
+
+// HMACKey 签名密钥及其对应的身份
+type HMACKey struct {
+	Secret      string
+	Roles       []string
+	Permissions []string
+}
+
+// HMACConfig hmac 签名认证配置
+type HMACConfig struct {
+	Keys    map[string]HMACKey // 密钥ID => 密钥
+	MaxSkew time.Duration      // 请求时间与服务器时间允许的偏差,默认 5 分钟
+	Nonces  NonceStore         // 默认进程内记录
+}
+
+// HMACAuthenticator 验证 SignHMACRequest 签名的请求
+type HMACAuthenticator struct {
+	cfg HMACConfig
+}
+
+func NewHMACAuthenticator(cfg HMACConfig) (a *HMACAuthenticator) {
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = HMAC_MAX_SKEW_DEFAULT
+	}
+	if cfg.Nonces == nil {
+		cfg.Nonces = NewMemoryNonceStore()
+	}
+	return &HMACAuthenticator{cfg: cfg}
+}
+
+// hmacSignature 签名串为 方法\n路径[?查询]\n时间戳\nnonce\nhex(sha256(请求体))
+func hmacSignature(r *http.Request, body []byte, timestamp string, nonce string, secret string) string {
+	uri := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		uri += "?" + r.URL.RawQuery
+	}
+	bodyHash := sha256.Sum256(body)
+	payload := strings.Join([]string{strings.ToUpper(r.Method), uri, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readRequestBody 读取请求体并复原,供后续解码
+func readRequestBody(r *http.Request) (body []byte, err error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err = io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, bodyReadError(err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SignHMACRequest 为请求添加 hmac 签名头,供调用方使用
+func SignHMACRequest(r *http.Request, keyID string, secret string) (err error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newMessageID()
+	r.Header.Set(HMAC_HEADER_KEY_ID, keyID)
+	r.Header.Set(HMAC_HEADER_TIMESTAMP, timestamp)
+	r.Header.Set(HMAC_HEADER_NONCE, nonce)
+	r.Header.Set(HMAC_HEADER_SIGNATURE, hmacSignature(r, body, timestamp, nonce, secret))
+	return nil
+}
+
+// Authenticate 实现 Authenticator
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (principal *Principal, err error) {
+	signature := r.Header.Get(HMAC_HEADER_SIGNATURE)
+	if signature == "" {
+		return nil, nil
+	}
+	keyID, timestamp, nonce := r.Header.Get(HMAC_HEADER_KEY_ID), r.Header.Get(HMAC_HEADER_TIMESTAMP), r.Header.Get(HMAC_HEADER_NONCE)
+	if keyID == "" || timestamp == "" || nonce == "" {
+		return nil, errors.Errorf("hmac headers %s,%s,%s required", HMAC_HEADER_KEY_ID, HMAC_HEADER_TIMESTAMP, HMAC_HEADER_NONCE)
+	}
+	key, ok := a.cfg.Keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("hmac key not found:%s", keyID)
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.WithMessage(err, "hmac timestamp")
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > a.cfg.MaxSkew || skew < -a.cfg.MaxSkew {
+		return nil, errors.Errorf("hmac timestamp expired:%s", timestamp)
+	}
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(hmacSignature(r, body, timestamp, nonce, key.Secret)), []byte(strings.ToLower(signature))) {
+		return nil, errors.New("hmac signature invalid")
+	}
+	// 签名验证通过后再记录 nonce,避免伪造请求占用 nonce;超过 2 倍偏差的请求已被时间戳拒绝
+	fresh, err := a.cfg.Nonces.UseNonce(r.Context(), keyID+":"+nonce, 2*a.cfg.MaxSkew)
+	if err != nil {
+		return nil, NewStatusError(http.StatusInternalServerError, errors.WithMessage(err, "hmac nonce"))
+	}
+	if !fresh {
+		return nil, errors.Errorf("hmac nonce replayed:%s", nonce)
+	}
+	principal = &Principal{
+		Subject:     keyID,
+		Roles:       key.Roles,
+		Permissions: key.Permissions,
+		Claims:      map[string]interface{}{"sub": keyID},
+	}
+	return principal, nil
+}
+
+// APIKeyAuthenticator 静态 api key 认证
+type APIKeyAuthenticator struct {
+	header string
+	keys   map[string]Principal // sha256(key) => 身份
+}
+
+// NewAPIKeyAuthenticator header 为空时使用 X-API-Key
+func NewAPIKeyAuthenticator(header string, keys map[string]Principal) (a *APIKeyAuthenticator) {
+	if header == "" {
+		header = API_KEY_HEADER_DEFAULT
+	}
+	a = &APIKeyAuthenticator{header: header, keys: make(map[string]Principal, len(keys))}
+	for key, principal := range keys {
+		sum := sha256.Sum256([]byte(key))
+		a.keys[hex.EncodeToString(sum[:])] = principal
+	}
+	return a
+}
+
+// Authenticate 实现 Authenticator
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (principal *Principal, err error) {
+	key := r.Header.Get(a.header)
+	if key == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	digest := hex.EncodeToString(sum[:])
+	for known, p := range a.keys { // 比较摘要且遍历全部,避免按耗时推测 key
+		if subtle.ConstantTimeCompare([]byte(known), []byte(digest)) == 1 {
+			p := p
+			principal = &p
+		}
+	}
+	if principal == nil {
+		return nil, errors.New("api key invalid")
+	}
+	if principal.Claims == nil {
+		principal.Claims = map[string]interface{}{"sub": principal.Subject}
+	}
+	return principal, nil
+}
+
+// TengoPrincipal 注入到tengo脚本 principal(ctx),返回调用方身份 {subject,roles,permissions,claims},未认证时返回 undefined
+func TengoPrincipal(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 1 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctxObj, ok := args[0].(*tengocontext.TengoContext)
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "context",
+			Expected: "context.Context",
+			Found:    args[0].TypeName(),
+		}
+	}
+	principal := GetPrincipal(ctxObj.Context)
+	if principal == nil {
+		return tengo.UndefinedValue, nil
+	}
+	roles := make([]interface{}, 0, len(principal.Roles))
+	for _, role := range principal.Roles {
+		roles = append(roles, role)
+	}
+	permissions := make([]interface{}, 0, len(principal.Permissions))
+	for _, permission := range principal.Permissions {
+		permissions = append(permissions, permission)
+	}
+	return tengo.FromInterface(map[string]interface{}{
+		"subject":     principal.Subject,
+		"roles":       roles,
+		"permissions": permissions,
+		"claims":      principal.Claims,
+	})
+}
@@ -0,0 +1,238 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func signJWT(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthenticators(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "auth.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = provider.ExecOrQueryContext(ctx, `create table orders (id integer primary key, user_id text)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.ExecOrQueryContext(ctx, `insert into orders (id,user_id) values (1,'alice'),(2,'bob'),(3,'alice'),(4,'bob')`); err != nil {
+		t.Fatal(err)
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/my/orders",
+		Roles:   []string{"user"},
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=status,dst=status`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=subject,src=subject,required
+		fullname=tenant,src=tenant
+		fullname=items[].id,src=orders.#.id,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		p:=principal(ctx)
+		storage.Set("subject",p.subject)
+		storage.Set("tenant",p.claims.tenant)
+		storage.SetRaw("orders",execSQLTPL(ctx,"MyOrders",{userId:p.subject}))
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "MyOrders"}}select id from orders where user_id=:userId order by id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	hsSecret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "k": base64.RawURLEncoding.EncodeToString(hsSecret)},
+		{"kty": "RSA", "kid": "rs", "alg": "RS256", "n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(jwksFile, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	jwtAuth, err := dataexchanger.NewJWTAuthenticator(dataexchanger.JWTConfig{JWKSFile: jwksFile, Issuer: "test", Audience: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	container.RegisterAuthenticator(jwtAuth)
+	container.RegisterAuthenticator(dataexchanger.NewHMACAuthenticator(dataexchanger.HMACConfig{
+		Keys: map[string]dataexchanger.HMACKey{"bob": {Secret: "bob-secret", Roles: []string{"user"}}},
+	}))
+	container.RegisterAuthenticator(dataexchanger.NewAPIKeyAuthenticator("", map[string]dataexchanger.Principal{
+		"key-alice": {Subject: "alice", Roles: []string{"user"}},
+	}))
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, api.Route, strings.NewReader(`{"status":"paid"}`))
+		req.Header.Set("Content-Type", dataexchanger.MEDIA_TYPE_JSON)
+		return req
+	}
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		container.ServeHTTP(rec, req)
+		return rec
+	}
+	now := time.Now().Unix()
+	claims := func(sub string, exp int64) map[string]interface{} {
+		return map[string]interface{}{"sub": sub, "iss": "test", "aud": []string{"orders"}, "exp": exp, "roles": []string{"user"}, "tenant": "t1"}
+	}
+	bearer := func(token string) *http.Request {
+		req := newRequest()
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	for name, token := range map[string]string{
+		"HS256": signJWT(t, "HS256", "hs", hsSecret, claims("alice", now+60)),
+		"RS256": signJWT(t, "RS256", "rs", rsaKey, claims("alice", now+60)),
+	} {
+		rec := serve(bearer(token))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s want status 200,got:%d,body:%s", name, rec.Code, rec.Body.String())
+		}
+		if got := gjson.Get(rec.Body.String(), "[subject,tenant,items.#.id]").Raw; got != `["alice","t1",["1","3"]]` {
+			t.Errorf("%s got:%s", name, got)
+		}
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	invalid := map[string]string{
+		"expired":       signJWT(t, "HS256", "hs", hsSecret, claims("alice", now-60)),
+		"wrong secret":  signJWT(t, "HS256", "hs", []byte("wrong"), claims("alice", now+60)),
+		"wrong rsa key": signJWT(t, "RS256", "rs", otherKey, claims("alice", now+60)),
+		"alg mismatch":  signJWT(t, "HS256", "rs", hsSecret, claims("alice", now+60)),
+		"malformed":     "abc",
+	}
+	for name, token := range invalid {
+		if rec := serve(bearer(token)); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s want status 401,got:%d,body:%s", name, rec.Code, rec.Body.String())
+		}
+	}
+
+	req := newRequest()
+	if err = dataexchanger.SignHMACRequest(req, "bob", "bob-secret"); err != nil {
+		t.Fatal(err)
+	}
+	replay := req.Clone(ctx)
+	replay.Body = httptest.NewRequest(http.MethodPost, api.Route, strings.NewReader(`{"status":"paid"}`)).Body
+	rec := serve(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("hmac want status 200,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	if got := gjson.Get(rec.Body.String(), "[subject,items.#.id]").Raw; got != `["bob",["2","4"]]` {
+		t.Errorf("hmac got:%s", got)
+	}
+	if rec = serve(replay); rec.Code != http.StatusUnauthorized {
+		t.Errorf("hmac replay want status 401,got:%d", rec.Code)
+	}
+	tampered := newRequest()
+	dataexchanger.SignHMACRequest(tampered, "bob", "bob-secret")
+	tampered.Body = httptest.NewRequest(http.MethodPost, api.Route, strings.NewReader(`{"status":"refund"}`)).Body
+	if rec = serve(tampered); rec.Code != http.StatusUnauthorized {
+		t.Errorf("hmac tampered body want status 401,got:%d", rec.Code)
+	}
+	stale := newRequest()
+	dataexchanger.SignHMACRequest(stale, "bob", "bob-secret")
+	stale.Header.Set(dataexchanger.HMAC_HEADER_TIMESTAMP, fmt.Sprint(now-3600))
+	if rec = serve(stale); rec.Code != http.StatusUnauthorized {
+		t.Errorf("hmac stale timestamp want status 401,got:%d", rec.Code)
+	}
+
+	req = newRequest()
+	req.Header.Set(dataexchanger.API_KEY_HEADER_DEFAULT, "key-alice")
+	if rec = serve(req); rec.Code != http.StatusOK || gjson.Get(rec.Body.String(), "subject").String() != "alice" {
+		t.Errorf("api key want alice,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	req = newRequest()
+	req.Header.Set(dataexchanger.API_KEY_HEADER_DEFAULT, "key-unknown")
+	if rec = serve(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown api key want status 401,got:%d", rec.Code)
+	}
+	if rec = serve(newRequest()); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials want status 401,got:%d", rec.Code)
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := dataexchanger.NewMemoryNonceStore()
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if fresh, err := store.UseNonce(ctx, fmt.Sprint("old", i), 20*time.Millisecond); err != nil || !fresh {
+			t.Fatalf("nonce old%d want fresh,got:%v,%v", i, fresh, err)
+		}
+	}
+	if fresh, _ := store.UseNonce(ctx, "keep", time.Minute); !fresh {
+		t.Fatal("nonce keep want fresh")
+	}
+	if fresh, _ := store.UseNonce(ctx, "old0", time.Minute); fresh {
+		t.Error("nonce old0 replayed want not fresh")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if fresh, _ := store.UseNonce(ctx, "old0", time.Minute); !fresh {
+		t.Error("expired nonce old0 want fresh")
+	}
+	if got := store.Len(); got != 2 {
+		t.Errorf("expired nonces want evicted,len want 2,got:%d", got)
+	}
+	if fresh, _ := store.UseNonce(ctx, "keep", time.Minute); fresh {
+		t.Error("nonce keep replayed want not fresh")
+	}
+}
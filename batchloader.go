@@ -0,0 +1,223 @@
+package dataexchanger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+	"github.com/suifengpiao14/tengolib/tengotemplate"
+)
+
+const (
+	BATCH_LOADER_KEYS = "Keys" // 批量加载时,模板中获取 key 集合的变量名,如 where id in ({{in . .Keys}})
+)
+
+// batchLoader 同一 Run 内同一模板的批量加载器,收集 key 后合并为一次 IN 查询,并记忆已加载的 key
+type batchLoader struct {
+	capi      *apiCompiled
+	ctx       context.Context
+	tplName   string
+	keyColumn string
+	data      map[string]interface{}
+	keys      []interface{}     // 已登记的 key,按登记顺序
+	known     map[string]bool   // 已登记的 key
+	pending   []interface{}     // 待加载的 key
+	results   map[string]string // key => 匹配行组成的 json 数组
+	lock      sync.Mutex
+}
+
+// load 登记 key,返回延迟结果,首次取值时统一发起查询
+func (l *batchLoader) load(key interface{}) (result *batchLoadResult) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	keyStr := fmt.Sprint(key)
+	if !l.known[keyStr] {
+		l.known[keyStr] = true
+		l.keys = append(l.keys, key)
+		l.pending = append(l.pending, key)
+	}
+	return newBatchLoadResult(l, keyStr)
+}
+
+// reset 写操作后丢弃已加载的结果,已登记的 key 在下次取值时重新加载
+func (l *batchLoader) reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.results = make(map[string]string)
+	l.pending = append(l.pending[:0:0], l.keys...)
+}
+
+// get 获取 key 对应的行,存在未加载的 key 时先批量加载
+func (l *batchLoader) get(keyStr string) (rows string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rows, ok := l.results[keyStr]; ok {
+		return rows, nil
+	}
+	if err = l.dispatch(); err != nil {
+		return "", err
+	}
+	return l.results[keyStr], nil
+}
+
+// dispatch 将待加载的 key 渲染为一次查询,并按 keyColumn 拆分结果
+func (l *batchLoader) dispatch() (err error) {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	keys := l.pending
+	l.pending = nil
+	volume := &tengotemplate.VolumeMap{}
+	for k, v := range l.data {
+		volume.SetValue(k, v)
+	}
+	volume.SetValue(BATCH_LOADER_KEYS, keys)
+	out, err := l.capi.execSQLTemplate(l.ctx, l.tplName, volume)
+	if err != nil {
+		err = errors.WithMessagef(err, "batchLoader.dispatch,template:%s", l.tplName)
+		return err
+	}
+	grouped := make(map[string][]string)
+	for _, row := range jsonRows(out) {
+		keyStr := row.Get(escapePathKey(l.keyColumn)).String()
+		grouped[keyStr] = append(grouped[keyStr], row.Raw)
+	}
+	for _, key := range keys {
+		keyStr := fmt.Sprint(key)
+		l.results[keyStr] = "[" + strings.Join(grouped[keyStr], ",") + "]"
+	}
+	return nil
+}
+
+// batchLoadResult 批量加载的延迟结果,脚本中通过 value()/first() 取值
+type batchLoadResult struct {
+	tengo.ImmutableMap
+	loader *batchLoader
+	key    string
+}
+
+func newBatchLoadResult(loader *batchLoader, key string) (r *batchLoadResult) {
+	r = &batchLoadResult{
+		loader: loader,
+		key:    key,
+	}
+	r.Value = map[string]tengo.Object{
+		"value": &tengo.UserFunction{
+			Value: func(args ...tengo.Object) (ret tengo.Object, err error) {
+				rows, err := r.loader.get(r.key)
+				if err != nil {
+					return nil, err
+				}
+				return &tengo.String{Value: rows}, nil
+			},
+		},
+		"first": &tengo.UserFunction{
+			Value: func(args ...tengo.Object) (ret tengo.Object, err error) {
+				rows, err := r.loader.get(r.key)
+				if err != nil {
+					return nil, err
+				}
+				first := ""
+				if all := jsonRows(rows); len(all) > 0 {
+					first = all[0].Raw
+				}
+				return &tengo.String{Value: first}, nil
+			},
+		},
+	}
+	return r
+}
+
+func (r *batchLoadResult) TypeName() string {
+	return "batch-load-result"
+}
+func (r *batchLoadResult) String() string {
+	return r.key
+}
+
+// getBatchLoader 获取(或创建)当前 Run 内的批量加载器,模板、关联字段、附加参数相同的调用共用一个加载器
+func (capi *apiCompiled) getBatchLoader(ctx context.Context, tplName string, keyColumn string, data map[string]interface{}) (loader *batchLoader, err error) {
+	state := getRunState(ctx)
+	if state == nil {
+		err = errors.Errorf("loadSQLTPL must be called in apiCompiled.Run,template:%s", tplName)
+		return nil, err
+	}
+	dataByte, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	loaderKey := strings.Join([]string{tplName, keyColumn, string(dataByte)}, "|")
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	loader, ok := state.loaders[loaderKey]
+	if !ok {
+		loader = &batchLoader{
+			capi:      capi,
+			ctx:       ctx,
+			tplName:   tplName,
+			keyColumn: keyColumn,
+			data:      data,
+			known:     make(map[string]bool),
+			results:   make(map[string]string),
+		}
+		state.loaders[loaderKey] = loader
+	}
+	return loader, nil
+}
+
+// loadSQLTPL 注入到tengo脚本 loadSQLTPL(ctx, tplName, keyColumn, keyValue[, data]),
+// 同一 Run 内多次调用在首次取值时合并成一次 IN 查询
+func (capi *apiCompiled) loadSQLTPL(args ...tengo.Object) (ret tengo.Object, err error) {
+	argLen := len(args)
+	if argLen != 4 && argLen != 5 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctxObj, ok := args[0].(*tengocontext.TengoContext)
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "context",
+			Expected: "context.Context",
+			Found:    args[0].TypeName(),
+		}
+	}
+	tplName, ok := tengo.ToString(args[1])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "tplName",
+			Expected: "string",
+			Found:    args[1].TypeName(),
+		}
+	}
+	keyColumn, ok := tengo.ToString(args[2])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "keyColumn",
+			Expected: "string",
+			Found:    args[2].TypeName(),
+		}
+	}
+	data := make(map[string]interface{})
+	if argLen == 5 {
+		tengoMap, ok := args[4].(*tengo.Map)
+		if !ok {
+			return nil, tengo.ErrInvalidArgumentType{
+				Name:     "data",
+				Expected: "map",
+				Found:    args[4].TypeName(),
+			}
+		}
+		for k, v := range tengoMap.Value {
+			data[k] = tengo.ToInterface(v)
+		}
+	}
+	loader, err := capi.getBatchLoader(ctxObj.Context, tplName, keyColumn, data)
+	if err != nil {
+		return nil, err
+	}
+	return loader.load(tengo.ToInterface(args[3])), nil
+}
@@ -0,0 +1,116 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/tidwall/gjson"
+)
+
+func TestLoadSQLTPL(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/orders",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=pageSize,dst=pageSize,format=number`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=items[].id,src=orders.#.id,required
+		fullname=items[].userName,src=orders.#.user.name,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		orders:=[{id:"1",userId:10},{id:"2",userId:11},{id:"3",userId:10}]
+		loads:=[]
+		for order in orders {
+			loads=append(loads,loadSQLTPL(ctx,"UserByIDs","id",order.userId))
+		}
+		storage.Set("orders",orders)
+		for i, load in loads {
+			storage.SetRaw("orders."+i+".user",load.first())
+		}
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("user", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryDB := &tengodb.TengoMemoryDB{InOutMap: map[string]string{
+		"select * from user where id in (10,11)": `[{"id":"10","name":"alice"},{"id":"11","name":"bob"}]`,
+	}}
+	source.SetProvider(memoryDB)
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "UserByIDs"}}select * from user where id in ({{in . .Keys}}){{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "user"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := capi.Run(context.Background(), `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["alice","bob","alice"]`
+	if got := gjson.Get(out, "items.#.userName").Raw; got != want {
+		t.Errorf("want:%s\ngot: %s", want, got)
+	}
+}
+
+func TestLoadSQLTPLFlushOnWrite(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "loader.db"))
+	source, err := dataexchanger.MakeSource("user", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, sql := range []string{`create table user (id integer primary key, name text)`, `insert into user (id,name) values (10,'alice'),(11,'bob')`} {
+		if _, err = provider.ExecOrQueryContext(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/user/rename",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=name,dst=name`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=before,src=before.name,required
+		fullname=after,src=after.name,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		load:=loadSQLTPL(ctx,"UserByIDs","id",10)
+		storage.SetRaw("before",load.first())
+		execSQLTPL(ctx,"Rename",{id:10,name:storage.GetMemory().name})
+		storage.SetRaw("after",loadSQLTPL(ctx,"UserByIDs","id",10).first())
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "UserByIDs"}}select id,name from user where id in ({{in . .Keys}}){{end}}
+	{{define "Rename"}}update user set name=:name where id=:id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "user"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := capi.Run(ctx, `{"name":"carol"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.Get(out, "[before,after]").Raw; got != `["alice","carol"]` {
+		t.Errorf("want loader flushed after write,got:%s", got)
+	}
+}
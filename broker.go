@@ -0,0 +1,634 @@
+package dataexchanger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+)
+
+const (
+	PUBLISH_RETRY_TIMES    = 3                      // 发布失败重试次数
+	PUBLISH_RETRY_INTERVAL = 100 * time.Millisecond // 首次重试间隔,之后翻倍
+
+	REDIS_STREAM_FIELD_ID      = "id"
+	REDIS_STREAM_FIELD_BODY    = "body"
+	REDIS_STREAM_FIELD_HEADERS = "headers"
+	REDIS_CONSUMER_GROUP       = "dataexchanger" // 默认消费组
+	REDIS_READ_BLOCK           = time.Second     // 读取消息阻塞时长,到期后检查是否停止
+	REDIS_READ_COUNT           = 10
+	REDIS_CLAIM_MIN_IDLE       = time.Minute      // 其他消费者未确认超过此时长的消息被认领
+	REDIS_CLAIM_INTERVAL       = 30 * time.Second // 认领空闲消息的间隔
+
+	RABBITMQ_RETURN_BUFFER = 16 // 无法路由被退回的消息缓冲
+)
+
+// Message 发布到队列的消息,消费方按 ID 去重(至少一次投递)
+type Message struct {
+	ID      string            `json:"id"`
+	Queue   string            `json:"queue"` // rabbitmq 路由键、redis stream 名称
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+}
+
+// MessagePublisher 消息发布资源
+type MessagePublisher interface {
+	PublishMessage(ctx context.Context, message Message) (err error)
+}
+
+// Delivery 消费到的消息,处理后必须调用 Ack 或 Nack
+type Delivery struct {
+	Message
+	Ack  func() (err error)
+	Nack func(requeue bool) (err error) // requeue 为 true 时重新入队
+}
+
+// MessageConsumer 消息消费资源
+type MessageConsumer interface {
+	// Consume 阻塞读取队列消息直到 ctx 取消或出错,handler 返回后才读取下一条
+	Consume(ctx context.Context, queue string, handler func(delivery Delivery)) (err error)
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// publishWithRetry 发布失败时按间隔翻倍重试
+func publishWithRetry(ctx context.Context, publisher MessagePublisher, message Message) (err error) {
+	interval := PUBLISH_RETRY_INTERVAL
+	for i := 0; i <= PUBLISH_RETRY_TIMES; i++ {
+		if err = publisher.PublishMessage(ctx, message); err == nil {
+			return nil
+		}
+		if i == PUBLISH_RETRY_TIMES {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+	return err
+}
+
+// tengoPublishMessage 注入到tengo脚本 publish(ctx, queue, body)
+func tengoPublishMessage(publisher MessagePublisher, args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 3 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctx := context.Background()
+	if ctxObj, ok := args[0].(*tengocontext.TengoContext); ok {
+		ctx = ctxObj.Context
+	}
+	queue, _ := tengo.ToString(args[1])
+	body, _ := tengo.ToString(args[2])
+	message := Message{ID: newMessageID(), Queue: queue, Body: body}
+	if err = publishWithRetry(ctx, publisher, message); err != nil {
+		return nil, err
+	}
+	return &tengo.String{Value: message.ID}, nil
+}
+
+func newPublisherObject(publisher MessagePublisher) tengo.ImmutableMap {
+	return tengo.ImmutableMap{
+		Value: map[string]tengo.Object{
+			"publish": &tengo.UserFunction{
+				Name: "publish",
+				Value: func(args ...tengo.Object) (tengo.Object, error) {
+					return tengoPublishMessage(publisher, args...)
+				},
+			},
+		},
+	}
+}
+
+// RabbitMQConfig rabbitmq 资源配置
+type RabbitMQConfig struct {
+	URL      string `json:"url"`
+	Exchange string `json:"exchange"` // 为空时使用默认交换机,路由键即队列名
+	Prefetch int    `json:"prefetch"` // 消费时未确认消息上限,0 不限制
+}
+
+// RabbitMQProvider rabbitmq 资源,开启发布确认,收到 broker 确认且未被退回(无法路由)才算发布成功
+type RabbitMQProvider struct {
+	tengo.ImmutableMap
+	config  RabbitMQConfig
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	returns chan amqp.Return // 发布通道上被退回的消息
+	lock    sync.Mutex
+}
+
+func NewRabbitMQProvider(config string) (p *RabbitMQProvider, err error) {
+	p = &RabbitMQProvider{}
+	if err = json.Unmarshal([]byte(config), &p.config); err != nil {
+		return nil, err
+	}
+	if p.config.URL == "" {
+		err = errors.New("rabbitmq config url required")
+		return nil, err
+	}
+	p.ImmutableMap = newPublisherObject(p)
+	return p, nil
+}
+
+func (p *RabbitMQProvider) TypeName() string {
+	return "rabbitmq"
+}
+
+func (p *RabbitMQProvider) String() string {
+	return ""
+}
+
+// getConn 延迟连接,连接断开后重连,调用方需持有锁
+func (p *RabbitMQProvider) getConn() (conn *amqp.Connection, err error) {
+	if p.conn == nil || p.conn.IsClosed() {
+		if p.conn, err = amqp.Dial(p.config.URL); err != nil {
+			err = errors.WithMessage(err, "rabbitmq dial")
+			return nil, err
+		}
+	}
+	return p.conn, nil
+}
+
+// getChannel 发布使用的通道,调用方需持有锁
+func (p *RabbitMQProvider) getChannel() (channel *amqp.Channel, err error) {
+	if p.channel != nil && !p.channel.IsClosed() {
+		return p.channel, nil
+	}
+	conn, err := p.getConn()
+	if err != nil {
+		return nil, err
+	}
+	if p.channel, err = conn.Channel(); err != nil {
+		return nil, err
+	}
+	if err = p.channel.Confirm(false); err != nil {
+		return nil, err
+	}
+	p.returns = p.channel.NotifyReturn(make(chan amqp.Return, RABBITMQ_RETURN_BUFFER))
+	return p.channel, nil
+}
+
+// returned 取出已退回的消息中是否有 messageID,broker 在确认前发送退回,确认后检查即可,调用方需持有锁
+func (p *RabbitMQProvider) returned(messageID string) (ret amqp.Return, ok bool) {
+	for {
+		select {
+		case r := <-p.returns:
+			if r.MessageId == messageID {
+				ret, ok = r, true
+			}
+		default:
+			return ret, ok
+		}
+	}
+}
+
+// PublishMessage 实现 MessagePublisher
+func (p *RabbitMQProvider) PublishMessage(ctx context.Context, message Message) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	channel, err := p.getChannel()
+	if err != nil {
+		return err
+	}
+	p.returned("") // 丢弃之前超时未检查的退回消息
+	headers := amqp.Table{}
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	confirm, err := channel.PublishWithDeferredConfirmWithContext(ctx, p.config.Exchange, message.Queue, true, false, amqp.Publishing{
+		MessageId:    message.ID,
+		Headers:      headers,
+		ContentType:  MEDIA_TYPE_JSON,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         []byte(message.Body),
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		err = errors.WithMessagef(err, "rabbitmq publish wait confirm,message:%s", message.ID)
+		return err
+	}
+	if !acked {
+		err = errors.Errorf("rabbitmq publish not confirmed,message:%s", message.ID)
+		return err
+	}
+	if ret, ok := p.returned(message.ID); ok {
+		err = errors.Errorf("rabbitmq publish returned,message:%s,routingKey:%s,reason:%d %s", message.ID, ret.RoutingKey, ret.ReplyCode, ret.ReplyText)
+		return err
+	}
+	return nil
+}
+
+// Consume 实现 MessageConsumer,每次消费使用独立通道,手动确认
+func (p *RabbitMQProvider) Consume(ctx context.Context, queue string, handler func(delivery Delivery)) (err error) {
+	p.lock.Lock()
+	conn, err := p.getConn()
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	channel, err := conn.Channel()
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	if p.config.Prefetch > 0 {
+		if err = channel.Qos(p.config.Prefetch, 0, false); err != nil {
+			return err
+		}
+	}
+	deliveries, err := channel.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				err = errors.Errorf("rabbitmq consume channel closed,queue:%s", queue)
+				return err
+			}
+			headers := make(map[string]string, len(d.Headers))
+			for k, v := range d.Headers {
+				headers[k] = fmt.Sprintf("%v", v)
+			}
+			handler(Delivery{
+				Message: Message{ID: d.MessageId, Queue: queue, Body: string(d.Body), Headers: headers},
+				Ack: func() error {
+					return d.Ack(false)
+				},
+				Nack: func(requeue bool) error {
+					return d.Nack(false, requeue)
+				},
+			})
+		}
+	}
+}
+
+func (p *RabbitMQProvider) Close() (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn != nil {
+		err = p.conn.Close()
+		p.conn, p.channel = nil, nil
+	}
+	return err
+}
+
+// RedisConfig redis 资源配置
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	MaxLen   int64  `json:"maxLen"` // stream 最大长度(近似),0 不限制
+	Group    string `json:"group"`  // 消费组,默认 dataexchanger
+	// Consumer 消费者名称,默认主机名;需在重启后保持不变,才能继续处理重启前未确认的消息
+	Consumer string `json:"consumer"`
+	// ClaimMinIdle 认领其他消费者(如已下线)未确认超过此时长的消息,默认 1 分钟
+	ClaimMinIdle time.Duration `json:"claimMinIdle"`
+}
+
+// RedisProvider redis 资源,消息写入 stream
+type RedisProvider struct {
+	tengo.ImmutableMap
+	config RedisConfig
+	client *redis.Client
+}
+
+func NewRedisProvider(config string) (p *RedisProvider, err error) {
+	p = &RedisProvider{}
+	if err = json.Unmarshal([]byte(config), &p.config); err != nil {
+		return nil, err
+	}
+	if p.config.Addr == "" {
+		err = errors.New("redis config addr required")
+		return nil, err
+	}
+	p.client = redis.NewClient(&redis.Options{Addr: p.config.Addr, Password: p.config.Password, DB: p.config.DB})
+	p.ImmutableMap = newPublisherObject(p)
+	return p, nil
+}
+
+func (p *RedisProvider) TypeName() string {
+	return "redis"
+}
+
+func (p *RedisProvider) String() string {
+	return ""
+}
+
+func (p *RedisProvider) GetClient() *redis.Client {
+	return p.client
+}
+
+// PublishMessage 实现 MessagePublisher
+func (p *RedisProvider) PublishMessage(ctx context.Context, message Message) (err error) {
+	headers, err := json.Marshal(message.Headers)
+	if err != nil {
+		return err
+	}
+	args := &redis.XAddArgs{
+		Stream: message.Queue,
+		Values: map[string]interface{}{
+			REDIS_STREAM_FIELD_ID:      message.ID,
+			REDIS_STREAM_FIELD_BODY:    message.Body,
+			REDIS_STREAM_FIELD_HEADERS: string(headers),
+		},
+	}
+	if p.config.MaxLen > 0 {
+		args.MaxLen, args.Approx = p.config.MaxLen, true
+	}
+	return p.client.XAdd(ctx, args).Err()
+}
+
+// Consume 实现 MessageConsumer,以消费组读取 stream,确认即 XACK,重新入队为追加到 stream 末尾后确认;
+// 开始时先处理本消费者未确认的消息,并定期认领其他消费者空闲未确认的消息(XAUTOCLAIM,需 redis 6.2+)
+func (p *RedisProvider) Consume(ctx context.Context, queue string, handler func(delivery Delivery)) (err error) {
+	group := p.config.Group
+	if group == "" {
+		group = REDIS_CONSUMER_GROUP
+	}
+	err = p.client.XGroupCreateMkStream(ctx, queue, group, "0").Err()
+	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	consumer := p.consumerName()
+	if err = p.readPending(ctx, queue, group, consumer, handler); err != nil {
+		return err
+	}
+	var claimedAt time.Time
+	for {
+		if time.Since(claimedAt) >= REDIS_CLAIM_INTERVAL {
+			if err = p.claimIdle(ctx, queue, group, consumer, handler); err != nil {
+				return err
+			}
+			claimedAt = time.Now()
+		}
+		streams, err := p.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{queue, ">"},
+			Count:    REDIS_READ_COUNT,
+			Block:    REDIS_READ_BLOCK,
+		}).Result()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, stream := range streams {
+			for _, xMessage := range stream.Messages {
+				handler(p.delivery(queue, group, xMessage))
+			}
+		}
+	}
+}
+
+// consumerName 消费者名称,未配置时使用主机名
+func (p *RedisProvider) consumerName() (consumer string) {
+	if p.config.Consumer != "" {
+		return p.config.Consumer
+	}
+	consumer, _ = os.Hostname()
+	if consumer == "" {
+		consumer = REDIS_CONSUMER_GROUP
+	}
+	return consumer
+}
+
+// readPending 处理本消费者已读取未确认的消息(如重启前处理中的消息)
+func (p *RedisProvider) readPending(ctx context.Context, queue string, group string, consumer string, handler func(delivery Delivery)) (err error) {
+	start := "0"
+	for {
+		streams, err := p.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{queue, start},
+			Count:    REDIS_READ_COUNT,
+			Block:    -1, // 读取历史消息不阻塞
+		}).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		read := 0
+		for _, stream := range streams {
+			for _, xMessage := range stream.Messages {
+				read++
+				start = xMessage.ID
+				p.handlePending(queue, group, xMessage, handler)
+			}
+		}
+		if read == 0 {
+			return nil
+		}
+	}
+}
+
+// claimIdle 认领其他消费者未确认且空闲超过 ClaimMinIdle 的消息并处理
+func (p *RedisProvider) claimIdle(ctx context.Context, queue string, group string, consumer string, handler func(delivery Delivery)) (err error) {
+	minIdle := p.config.ClaimMinIdle
+	if minIdle <= 0 {
+		minIdle = REDIS_CLAIM_MIN_IDLE
+	}
+	start := "0-0"
+	for {
+		messages, next, err := p.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   queue,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  minIdle,
+			Start:    start,
+			Count:    REDIS_READ_COUNT,
+		}).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, xMessage := range messages {
+			p.handlePending(queue, group, xMessage, handler)
+		}
+		if next == "" || next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+// handlePending 处理未确认的消息,已从 stream 删除(如超出 MaxLen 被裁剪)的消息直接确认
+func (p *RedisProvider) handlePending(queue string, group string, xMessage redis.XMessage, handler func(delivery Delivery)) {
+	if len(xMessage.Values) == 0 {
+		p.client.XAck(context.Background(), queue, group, xMessage.ID)
+		return
+	}
+	handler(p.delivery(queue, group, xMessage))
+}
+
+func (p *RedisProvider) delivery(queue string, group string, xMessage redis.XMessage) (delivery Delivery) {
+	message := Message{Queue: queue, Headers: map[string]string{}}
+	message.ID, _ = xMessage.Values[REDIS_STREAM_FIELD_ID].(string)
+	message.Body, _ = xMessage.Values[REDIS_STREAM_FIELD_BODY].(string)
+	if headers, ok := xMessage.Values[REDIS_STREAM_FIELD_HEADERS].(string); ok && headers != "" {
+		_ = json.Unmarshal([]byte(headers), &message.Headers)
+	}
+	ack := func() error {
+		return p.client.XAck(context.Background(), queue, group, xMessage.ID).Err()
+	}
+	return Delivery{
+		Message: message,
+		Ack:     ack,
+		Nack: func(requeue bool) error {
+			if requeue {
+				if err := p.PublishMessage(context.Background(), message); err != nil {
+					return err
+				}
+			}
+			return ack()
+		},
+	}
+}
+
+func (p *RedisProvider) Close() (err error) {
+	return p.client.Close()
+}
+
+// MemoryBroker 内存消息代理,用于测试替代 rabbitmq、redis
+type MemoryBroker struct {
+	tengo.ImmutableMap
+	queues    map[string][]Message // 已发布的全部消息
+	pending   map[string][]Message // 待消费的消息
+	notify    chan struct{}        // 有新消息时关闭并替换,唤醒等待的消费者
+	failTimes int                  // 之后的发布调用依次失败的次数,用于测试重试
+	lock      sync.Mutex
+}
+
+func NewMemoryBroker() (b *MemoryBroker) {
+	b = &MemoryBroker{
+		queues:  make(map[string][]Message),
+		pending: make(map[string][]Message),
+		notify:  make(chan struct{}),
+	}
+	b.ImmutableMap = newPublisherObject(b)
+	return b
+}
+
+func (b *MemoryBroker) TypeName() string {
+	return "memoryBroker"
+}
+
+func (b *MemoryBroker) String() string {
+	return ""
+}
+
+// PublishMessage 实现 MessagePublisher
+func (b *MemoryBroker) PublishMessage(ctx context.Context, message Message) (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failTimes > 0 {
+		b.failTimes--
+		err = errors.Errorf("memory broker publish failed,message:%s", message.ID)
+		return err
+	}
+	b.queues[message.Queue] = append(b.queues[message.Queue], message)
+	b.enqueue(message)
+	return nil
+}
+
+// enqueue 加入待消费队列并唤醒消费者,调用方需持有锁
+func (b *MemoryBroker) enqueue(message Message) {
+	b.pending[message.Queue] = append(b.pending[message.Queue], message)
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// pop 取出一条待消费消息,队列为空时返回等待通道
+func (b *MemoryBroker) pop(queue string) (message Message, ok bool, wait chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.pending[queue]) == 0 {
+		return message, false, b.notify
+	}
+	message, b.pending[queue] = b.pending[queue][0], b.pending[queue][1:]
+	return message, true, nil
+}
+
+// Consume 实现 MessageConsumer
+func (b *MemoryBroker) Consume(ctx context.Context, queue string, handler func(delivery Delivery)) (err error) {
+	for {
+		message, ok, wait := b.pop(queue)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-wait:
+			}
+			continue
+		}
+		handler(Delivery{
+			Message: message,
+			Ack: func() error {
+				return nil
+			},
+			Nack: func(requeue bool) error {
+				if requeue {
+					b.lock.Lock()
+					b.enqueue(message)
+					b.lock.Unlock()
+				}
+				return nil
+			},
+		})
+	}
+}
+
+// Pending 队列中待消费的消息数
+func (b *MemoryBroker) Pending(queue string) (n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.pending[queue])
+}
+
+// SetFailTimes 设置之后的发布调用依次失败的次数
+func (b *MemoryBroker) SetFailTimes(times int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failTimes = times
+}
+
+// Messages 队列中已发布的消息
+func (b *MemoryBroker) Messages(queue string) (messages []Message) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append(messages, b.queues[queue]...)
+}
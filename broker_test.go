@@ -0,0 +1,191 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/tidwall/gjson"
+)
+
+func TestAfterEventOutbox(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+8", 8*3600) // outbox 时间不受本地时区影响
+	defer func() {
+		time.Local = local
+	}()
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "outbox.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = provider.ExecOrQueryContext(ctx, `create table orders (id integer primary key, status text)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.ExecOrQueryContext(ctx, dataexchanger.OutboxDDL(provider.Dialect(), "")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.ExecOrQueryContext(ctx, `insert into orders (id,status) values (1,'new'),(2,'new')`); err != nil {
+		t.Fatal(err)
+	}
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := dataexchanger.NewMemoryBroker()
+	brokerSource.SetProvider(broker)
+
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/order/pay",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number,required
+		fullname=fail,dst=fail`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		input:=storage.GetMemory()
+		execSQLTPL(ctx,"Pay",input)
+		if input.fail {
+			return error("pay failed")
+		}
+		`,
+		AfterEvents: []dataexchanger.DtoAfterEvent{{Source: "mq", Queue: "order.paid", Template: "OrderPaid"}},
+		Transaction: "db",
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Pay"}}update orders set status='paid' where id=:id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	capi.RegisterTemplate("", `{{define "OrderPaid"}}{"orderId":{{.input.id}}}{{end}}`)
+
+	outboxStatus := func() string {
+		out, err := provider.ExecOrQueryContext(ctx, `select status,attempts from dataexchanger_outbox order by created_at`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gjson.Get(out, "#.[status,attempts]").Raw
+	}
+
+	if _, err = capi.Run(ctx, `{"id":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	messages := broker.Messages("order.paid")
+	if len(messages) != 1 || gjson.Get(messages[0].Body, "orderId").Int() != 1 || messages[0].Headers[dataexchanger.MESSAGE_HEADER_ROUTE] != api.Route {
+		t.Fatalf("published messages got:%+v", messages)
+	}
+	if got := outboxStatus(); got != `[["1","1"]]` {
+		t.Errorf("outbox after publish got:%s", got)
+	}
+	createdAt, err := provider.ExecOrQueryContext(ctx, `select created_at from dataexchanger_outbox`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at, err := time.Parse(dataexchanger.OUTBOX_TIME_LAYOUT, createdAt); err != nil || time.Since(at) > time.Minute || time.Until(at) > time.Minute {
+		t.Errorf("outbox time want utc,got:%s", createdAt)
+	}
+
+	// 业务失败时回滚,不写 outbox 也不发布
+	if _, err = capi.Run(ctx, `{"id":"2","fail":"1"}`); err == nil {
+		t.Fatal("want error")
+	}
+	if status, _ := provider.ExecOrQueryContext(ctx, `select status from orders where id=2`); status != "new" {
+		t.Errorf("rollback want status new,got:%s", status)
+	}
+	if got := outboxStatus(); got != `[["1","1"]]` {
+		t.Errorf("outbox after rollback got:%s", got)
+	}
+
+	// 提交后发布失败,消息留在 outbox 待中继重试
+	broker.SetFailTimes(1)
+	if _, err = capi.Run(ctx, `{"id":"2"}`); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(broker.Messages("order.paid")); got != 1 {
+		t.Errorf("failed publish want 1 message,got:%d", got)
+	}
+	if got := outboxStatus(); got != `[["1","1"],["0","1"]]` {
+		t.Errorf("outbox after failed publish got:%s", got)
+	}
+}
+
+func TestAfterEventRetry(t *testing.T) {
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := dataexchanger.NewMemoryBroker()
+	brokerSource.SetProvider(broker)
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/user/login",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=userId,dst=userId,required`,
+		PostScript: `
+		getDBByTemplateName("Post").publish(storage.GetCtx(),"user.post",storage.Get("input.userId"))
+		`,
+		AfterEvents: []dataexchanger.DtoAfterEvent{{Source: "mq", Queue: "user.login", Template: "Login"}, {Source: "mq", Queue: "user.audit", Template: "Login"}},
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	capi.RegisterTemplate("", `{{define "Login"}}{"userId":"{{.input.userId}}"}{{end}}`)
+	postSource, err := dataexchanger.MakeSource("post", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postBroker := dataexchanger.NewMemoryBroker()
+	postSource.SetProvider(postBroker)
+	if err = capi.RegisterSource(postSource); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateDependSource(capi.RegisterTemplate("", `{{define "Post"}}{{end}}`), "post"); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.SetFailTimes(dataexchanger.PUBLISH_RETRY_TIMES)
+	if _, err = capi.Run(context.Background(), `{"userId":"7"}`); err != nil {
+		t.Fatal(err)
+	}
+	messages := broker.Messages("user.login")
+	if len(messages) != 1 || messages[0].Body != `{"userId":"7"}` {
+		t.Fatalf("retry published got:%+v", messages)
+	}
+
+	// 最终发布失败时写操作已生效,不返回错误,其余消息继续发布
+	broker.SetFailTimes(dataexchanger.PUBLISH_RETRY_TIMES + 1)
+	if _, err = capi.Run(context.Background(), `{"userId":"8"}`); err != nil {
+		t.Errorf("publish failed want logged only,got:%v", err)
+	}
+	if messages = broker.Messages("user.login"); len(messages) != 1 {
+		t.Errorf("failed message want not published,got:%+v", messages)
+	}
+	if messages = broker.Messages("user.audit"); len(messages) != 2 || messages[1].Body != `{"userId":"8"}` {
+		t.Errorf("remaining message want published,got:%+v", messages)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if messages = postBroker.Messages("user.post"); len(messages) != 2 {
+		t.Errorf("post script want run after publish,got:%+v", messages)
+	}
+}
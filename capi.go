@@ -3,16 +3,17 @@ package dataexchanger
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/d5/tengo/v2"
-	"github.com/d5/tengo/v2/stdlib"
 	tengojson "github.com/d5/tengo/v2/stdlib/json"
 	"github.com/pkg/errors"
 	"github.com/suifengpiao14/gojsonschemavalidator"
 	"github.com/suifengpiao14/jsonschemaline"
 	"github.com/suifengpiao14/logchan/v2"
-	"github.com/suifengpiao14/tengolib"
 	"github.com/suifengpiao14/tengolib/tengocontext"
 	"github.com/suifengpiao14/tengolib/tengodb"
 	"github.com/suifengpiao14/tengolib/tengogsjson"
@@ -30,48 +31,96 @@ const (
 type ContextKeyType string
 
 const (
-	CONTEXT_KEY_STORAGE = ContextKeyType(VARIABLE_STORAGE)
+	CONTEXT_KEY_STORAGE   = ContextKeyType(VARIABLE_STORAGE)
+	CONTEXT_KEY_RUN_STATE = ContextKeyType("runState")
 )
 
 // DtoAPI 外部接收参数 dto
 type DtoAPI struct {
-	Methods          string `json:"methods"`
-	Route            string `json:"route"`            // 路由,唯一
-	BeforeEvent      string `json:"beforeEvent"`      // 执行前异步事件
-	InputLineSchema  string `json:"inputLineSchema"`  // 输入格式化规则
-	OutputLineSchema string `json:"outputLineSchema"` // 输出格式化规则
-	PreScript        string `json:"preScript"`        // 前置脚本(如提前验证)
-	MainScript       string `json:"mainScript"`       // 主脚本
-	PostScript       string `json:"postScript"`       // 后置脚本(后置脚本异步执行)
-	AfterEvent       string `json:"afterEvent"`       // 异步事件
+	Methods          string          `json:"methods"`
+	Route            string          `json:"route"`            // 路由,唯一
+	BeforeEvent      string          `json:"beforeEvent"`      // 执行前异步事件
+	InputLineSchema  string          `json:"inputLineSchema"`  // 输入格式化规则
+	OutputLineSchema string          `json:"outputLineSchema"` // 输出格式化规则
+	PreScript        string          `json:"preScript"`        // 前置脚本(如提前验证)
+	MainScript       string          `json:"mainScript"`       // 主脚本
+	PostScript       string          `json:"postScript"`       // 后置脚本(后置脚本异步执行)
+	AfterEvent       string          `json:"afterEvent"`       // 异步事件
+	AfterEvents      []DtoAfterEvent `json:"afterEvents"`      // 执行成功后发布的消息(至少一次投递)
+	Transaction      string          `json:"transaction"`      // 事务资源标识,设置后该资源上的模板在同一事务内执行,消息写入 outbox 表随事务提交
+	Outbox           string          `json:"outbox"`           // outbox 表名,默认 dataexchanger_outbox
+	LockSource       string          `json:"lockSource"`       // 脚本 lock 使用的锁资源标识(redis、sql),为空时使用进程内锁
+	Idempotency      *DtoIdempotency `json:"idempotency"`      // 幂等声明,重复请求直接返回保存的输出
+	Roles            []string        `json:"roles"`            // 调用方需拥有其中任一角色
+	Permissions      []string        `json:"permissions"`      // 调用方需拥有全部权限
+	Joins            []DtoJoin       `json:"joins"`            // 主脚本后执行的关联步骤
+	Paginate         *DtoPaginate    `json:"paginate"`         // 分页声明,前置脚本后、主脚本前执行
+	Stream           *DtoStream      `json:"stream"`           // 流式输出声明,设置后通过 RunStream 逐行输出查询结果
+	Sandbox          *SandboxPolicy  `json:"sandbox"`          // 脚本沙箱策略,为空时使用容器策略,均为空时不限制
 
 }
 
 type apiCompiled struct {
 	Route            string `json:"route"`
 	Methods          string
-	_preScript       *tengo.Compiled
-	_mainScript      *tengo.Compiled
-	_postScript      *tengo.Compiled
+	scripts          *apiScripts // 编译后的脚本,沙箱策略变更时整体替换
+	lockScripts      sync.RWMutex
+	preScript        string // 脚本源码,沙箱策略变更时重新编译
+	mainScript       string
+	postScript       string
+	ownSandbox       bool // 沙箱策略在 api 上声明,不使用容器策略
 	defaultJson      string
 	inputSchema      *gojsonschema.JSONLoader
 	inputGjsonPath   string
 	inputLineSchema  *jsonschemaline.Jsonschemaline
+	inputLocations   []inputLocation // 输入字段来源(body、query、path、header、cookie)
+	inputJsonSchema  string
 	outputDefault    string
 	outputSchema     *gojsonschema.JSONLoader
 	outputGjsonPath  string
 	outputLineSchema *jsonschemaline.Jsonschemaline
 	sourcePool       *tengosource.SourcePool
 	template         *tengotemplate.TengoTemplate
+	joins            []DtoJoin
+	pagination       *DtoPaginate
+	stream           *DtoStream
+	afterEvents      []DtoAfterEvent
+	transaction      string
+	outboxTable      string
+	lockSource       string
+	idempotency      *DtoIdempotency
+	idempotencyStore IdempotencyStore
+	roles            []string
+	permissions      []string
+	masks            []fieldMask              // 输出字段脱敏声明
+	sensitiveInput   []sensitiveField         // 日志中需脱敏的输入字段
+	sensitiveOutput  []sensitiveField         // 日志中需脱敏的输出字段
+	dialects         map[string]Dialect       // 资源标识 => 方言
+	dbRoutes         map[string]string        // 模板名称 => 读写分离路由(primary、replica)
+	auditKeys        map[string]DtoAuditKey   // 模板名称 => 审计主键
+	topics           map[string]templateTopic // 模板名称 => 写操作影响的主题
+	resolvedSources  *resolvedSourcePool
 	_container       *Container
 }
 
 func NewApiCompiled(api *DtoAPI) (capi *apiCompiled, err error) {
 	capi = &apiCompiled{
-		Methods:    api.Methods,
-		Route:      api.Route,
-		sourcePool: tengosource.NewSourcePool(),
-		template:   tengotemplate.NewTemplate(),
+		Methods:     api.Methods,
+		Route:       api.Route,
+		sourcePool:  tengosource.NewSourcePool(),
+		template:    tengotemplate.NewTemplate(),
+		dialects:    make(map[string]Dialect),
+		dbRoutes:    make(map[string]string),
+		auditKeys:   make(map[string]DtoAuditKey),
+		topics:      make(map[string]templateTopic),
+		transaction: api.Transaction,
+		outboxTable: api.Outbox,
+		lockSource:  api.LockSource,
+		roles:       api.Roles,
+		permissions: api.Permissions,
+	}
+	if capi.outboxTable == "" {
+		capi.outboxTable = OUTBOX_TABLE_DEFAULT
 	}
 	if api.InputLineSchema != "" {
 		inputLineschema, err := jsonschemaline.ParseJsonschemaline(api.InputLineSchema)
@@ -85,6 +134,22 @@ func NewApiCompiled(api *DtoAPI) (capi *apiCompiled, err error) {
 			err = errors.WithMessagef(err, "makeApiCompiled.JsonSchema.InputLineSchema,route:%s", api.Route)
 			return nil, err
 		}
+		capi.inputLocations, err = parseInputLocations(inputLineschema)
+		if err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.parseInputLocations.InputLineSchema,route:%s", api.Route)
+			return nil, err
+		}
+		inputSchema, err = schemaWithInputLocations(inputSchema, capi.inputLocations)
+		if err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.schemaWithInputLocations.InputLineSchema,route:%s", api.Route)
+			return nil, err
+		}
+		capi.inputJsonSchema = string(inputSchema)
+		capi.sensitiveInput, err = parseSensitiveFields(inputLineschema, jsonschemaline.LINE_SCHEMA_DIRECTION_IN)
+		if err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.parseSensitiveFields.InputLineSchema,route:%s", api.Route)
+			return nil, err
+		}
 		inputSchemaLoader := gojsonschema.NewStringLoader(string(inputSchema))
 		capi.inputSchema = &inputSchemaLoader
 		defaultInputJson, err := jsonschemaline.ParseDefaultJson(*inputLineschema)
@@ -125,6 +190,16 @@ func NewApiCompiled(api *DtoAPI) (capi *apiCompiled, err error) {
 			return nil, err
 		}
 		capi.outputDefault = defaultOutputJson.Json
+		capi.masks, err = parseFieldMasks(outputLineschema)
+		if err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.parseFieldMasks.OutputLineSchema,route:%s", api.Route)
+			return nil, err
+		}
+		capi.sensitiveOutput, err = parseSensitiveFields(outputLineschema, jsonschemaline.LINE_SCHEMA_DIRECTION_OUT)
+		if err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.parseSensitiveFields.OutputLineSchema,route:%s", api.Route)
+			return nil, err
+		}
 		capi.outputGjsonPath = outputLineschema.GjsonPath(func(format, src string, item *jsonschemaline.JsonschemalineItem) (path string) {
 			typ := strings.ToLower(item.Type)
 			path = src // 默认值
@@ -138,33 +213,112 @@ func NewApiCompiled(api *DtoAPI) (capi *apiCompiled, err error) {
 		})
 	}
 
-	if api.PreScript != "" {
-		c, err := capi.compileScript(api.PreScript)
+	for _, join := range api.Joins {
+		if err := join.validate(); err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.Joins,route:%s", api.Route)
+			return nil, err
+		}
+		capi.joins = append(capi.joins, join)
+	}
+
+	if api.Paginate != nil {
+		if err := api.Paginate.validate(); err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.Paginate,route:%s", api.Route)
+			return nil, err
+		}
+		pagination := *api.Paginate
+		if pagination.Dst == "" {
+			pagination.Dst = PAGINATE_DST_DEFAULT
+		}
+		capi.pagination = &pagination
+	}
+
+	if api.Stream != nil {
+		if err := api.Stream.validate(); err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.Stream,route:%s", api.Route)
+			return nil, err
+		}
+		stream := *api.Stream
+		if stream.Format == "" {
+			stream.Format = STREAM_FORMAT_JSON
+		}
+		capi.stream = &stream
+	}
+
+	if api.Idempotency != nil {
+		if err := api.Idempotency.validate(); err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.Idempotency,route:%s", api.Route)
+			return nil, err
+		}
+		idempotency := *api.Idempotency
+		if idempotency.TTL <= 0 {
+			idempotency.TTL = IDEMPOTENCY_TTL_DEFAULT
+		}
+		capi.idempotency = &idempotency
+		if idempotency.Source == "" {
+			capi.idempotencyStore = NewMemoryIdempotencyStore()
+		}
+	}
+
+	for _, afterEvent := range api.AfterEvents {
+		if err := afterEvent.validate(); err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.AfterEvent,route:%s", api.Route)
+			return nil, err
+		}
+		capi.afterEvents = append(capi.afterEvents, afterEvent)
+	}
+
+	if api.Sandbox != nil {
+		if err := api.Sandbox.validate(); err != nil {
+			err = errors.WithMessagef(err, "makeApiCompiled.Sandbox,route:%s", api.Route)
+			return nil, err
+		}
+		capi.ownSandbox = true
+	}
+	capi.preScript, capi.mainScript, capi.postScript = api.PreScript, api.MainScript, api.PostScript
+	scripts, err := capi.compileScripts(api.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	capi.scripts = scripts
+	return capi, nil
+}
+
+// apiScripts 按同一沙箱策略编译的前置、主、后置脚本,编译后不再修改
+type apiScripts struct {
+	pre     *tengo.Compiled
+	main    *tengo.Compiled
+	post    *tengo.Compiled
+	sandbox *SandboxPolicy // 编译使用的沙箱策略
+}
+
+// compileScripts 按沙箱策略编译前置、主、后置脚本
+func (capi *apiCompiled) compileScripts(policy *SandboxPolicy) (scripts *apiScripts, err error) {
+	scripts = &apiScripts{sandbox: policy}
+	if capi.preScript != "" {
+		scripts.pre, err = capi.compileScript(capi.preScript, policy)
 		if err != nil {
-			err = errors.WithMessagef(err, "makeApiCompiled.Compiled.PreScript,route:%s", api.Route)
+			err = errors.WithMessagef(err, "makeApiCompiled.Compiled.PreScript,route:%s", capi.Route)
 			return nil, err
 		}
-		capi._preScript = c
 	}
 
-	if api.MainScript != "" {
-		c, err := capi.compileScript(api.MainScript)
+	if capi.mainScript != "" {
+		scripts.main, err = capi.compileScript(capi.mainScript, policy)
 		if err != nil {
-			err = errors.WithMessagef(err, "makeApiCompiled.Compiled.MainScript,route:%s", api.Route)
+			err = errors.WithMessagef(err, "makeApiCompiled.Compiled.MainScript,route:%s", capi.Route)
 			return nil, err
 		}
-		capi._mainScript = c
 	}
 
-	if api.PostScript != "" {
-		c, err := capi.compileScript(api.PostScript)
+	if capi.postScript != "" {
+		scripts.post, err = capi.compileScript(capi.postScript, policy)
 		if err != nil {
-			err = errors.WithMessagef(err, "makeApiCompiled.Compiled.PostScript,route:%s", api.Route)
+			err = errors.WithMessagef(err, "makeApiCompiled.Compiled.PostScript,route:%s", capi.Route)
 			return nil, err
 		}
-		capi._postScript = c
 	}
-	return capi, nil
+	return scripts, nil
 }
 
 //RegisterTemplateAndRelationSource 注册模板
@@ -184,8 +338,26 @@ func (capi *apiCompiled) SetTemplateDependSource(templateIdentifers []string, so
 	return nil
 }
 
+//SetTemplateDBRoute 设置模版在读写分离资源上的路由,primary 强制主库,replica 读操作强制从库
+func (capi *apiCompiled) SetTemplateDBRoute(templateIdentifers []string, route string) (err error) {
+	if route != DB_ROUTE_PRIMARY && route != DB_ROUTE_REPLICA {
+		err = errors.Errorf("db route want primary/replica,got:%s", route)
+		return err
+	}
+	for _, tplName := range templateIdentifers {
+		capi.dbRoutes[tplName] = route
+	}
+	return nil
+}
+
 //RegisterSource 注册所有可能使用到的资源
 func (capi *apiCompiled) RegisterSource(s tengosource.Source) (err error) {
+	dialect, err := GetDialect(gjson.Get(s.Config, "dialect").String())
+	if err != nil {
+		err = errors.WithMessagef(err, "apiCompiled.RegisterSource,source:%s", s.Identifer)
+		return err
+	}
+	capi.dialects[s.Identifer] = dialect
 	err = capi.sourcePool.RegisterSource(s)
 	if err != nil {
 		return err
@@ -202,37 +374,67 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 		OriginalInput: inputJson,
 		DefaultJson:   capi.defaultJson,
 	}
+	state := newRunState()
+	state.logMasker = capi.newRunLogMasker()
+	logInfo.masker = state.logMasker
+	collectSensitiveValues(state.logMasker, inputJson, capi.sensitiveInput, false)
+	defer state.releaseLocks()
+	defer state.releaseSources()
 	defer func() {
 		// 发送日志
 		logInfo.Err = err
+		logInfo.CacheHit, logInfo.CacheMiss = state.cacheStats()
 		logchan.SendLogInfo(&logInfo)
 	}()
-	// 合并默认值
-	if capi.defaultJson != "" {
-		inputJson, err = jsonschemaline.JsonMerge(capi.defaultJson, inputJson)
-		if err != nil {
-			return "", err
-		}
+	if err = capi.authorize(ctx); err != nil {
+		return "", err
 	}
-	// 验证参数
-	if capi.inputSchema != nil {
-		err = gojsonschemavalidator.Validate(inputJson, *capi.inputSchema)
+	inputJson, err = capi.formatInput(inputJson)
+	if err != nil {
+		return "", err
+	}
+	logInfo.PreInput = inputJson
+	state.input = inputJson
+	collectSensitiveValues(state.logMasker, inputJson, capi.sensitiveInput, true)
+	var rawOut string // 脱敏前的输出
+	if capi.idempotency != nil {
+		var done bool
+		var finish func(out string, err error)
+		out, done, finish, err = capi.reserveIdempotency(ctx, inputJson)
 		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.Run.Idempotency,route:%s", capi.Route)
 			return "", err
 		}
+		if done { // 重复请求,不执行脚本
+			logInfo.IdempotentHit = true
+			collectSensitiveValues(state.logMasker, out, capi.sensitiveOutput, false)
+			return capi.maskOutput(ctx, out)
+		}
+		if finish != nil {
+			defer func() {
+				finish(rawOut, err) // 保存脱敏前的输出,重复请求时按调用方权限脱敏
+			}()
+		}
 	}
-	if inputJson != "" && capi.inputGjsonPath != "" { // 初步格式化入参(转换成脚本中的输入)
-		fmtInupt := fmt.Sprintf(`{"%s":%s}`, capi.inputLineSchema.Meta.ID, inputJson)
-		inputJson = gjson.Get(fmtInupt, capi.inputGjsonPath).String()
-	}
-	logInfo.PreInput = inputJson
 	inputRootName := string(capi.inputLineSchema.Meta.ID)
 	storage := tengogsjson.NewStorage()
 	ctx = context.WithValue(ctx, CONTEXT_KEY_STORAGE, storage) //增加存储到上下文
+	ctx = context.WithValue(ctx, CONTEXT_KEY_RUN_STATE, state) //单次执行共享状态
 	ctxObj := &tengocontext.TengoContext{
 		Context: ctx,
 	}
-	storage.Ctx = ctxObj                                                               // 记录上下文
+	storage.Ctx = ctxObj // 记录上下文
+	if capi.transaction != "" {
+		if err = capi.beginTransaction(ctx, state); err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.Run.Transaction,route:%s", capi.Route)
+			return "", err
+		}
+		defer func() {
+			if err != nil {
+				state.rollbackTx()
+			}
+		}()
+	}
 	storage.DiskSpace, err = sjson.SetRaw(storage.DiskSpace, inputRootName, inputJson) // 输入也作为输出的一个参考
 	storage.Memory = &tengo.String{Value: inputJson}
 	if gjson.Valid(inputJson) { //重新修改storage.Memory
@@ -252,13 +454,14 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 		err = errors.WithMessagef(err, "set input to storage,route:%s", capi.Route)
 		return "", err
 	}
-	if c := capi.getPreScript(); c != nil {
+	scripts := capi.getScripts()
+	if c := cloneScript(scripts.pre); c != nil {
 		logInfo.PreInput = storage.DiskSpace
 		if err = c.Set(VARIABLE_STORAGE, storage); err != nil {
 			err = errors.WithMessagef(err, "apiCompiled.SetStorage.PreScript,route:%s", capi.Route)
 			return "", err
 		}
-		err = c.Run()
+		err = capi.runScript(c, storage, scripts.sandbox)
 		if err != nil {
 			err = errors.WithMessagef(err, "apiCompiled.Run.PreScript,route:%s", capi.Route)
 			return "", err
@@ -271,13 +474,25 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 		}
 		logInfo.PreOutput = storage.DiskSpace
 	}
+	if capi.pagination != nil {
+		var paginateOut string
+		paginateOut, err = capi.paginate(ctx, tengoMapToInterface(storage.Memory))
+		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.Run.Paginate,route:%s", capi.Route)
+			return "", err
+		}
+		storage.DiskSpace, err = sjson.SetRaw(storage.DiskSpace, capi.pagination.Dst, paginateOut)
+		if err != nil {
+			return "", err
+		}
+	}
 
-	if c := capi.getMainScript(); c != nil {
+	if c := cloneScript(scripts.main); c != nil {
 		if err = c.Set(VARIABLE_STORAGE, storage); err != nil {
 			err = errors.WithMessagef(err, "apiCompiled.SetStorage.MainScript,route:%s", capi.Route)
 			return "", err
 		}
-		if err = c.Run(); err != nil {
+		if err = capi.runScript(c, storage, scripts.sandbox); err != nil {
 			err = errors.WithMessagef(err, "apiCompiled.Run.MainScript,route:%s", capi.Route)
 			return "", err
 		}
@@ -289,12 +504,41 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 		}
 		logInfo.Out = storage.DiskSpace
 	}
+	for _, join := range capi.joins {
+		storage.DiskSpace, err = join.run(storage.DiskSpace)
+		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.Run.Join,route:%s", capi.Route)
+			return "", err
+		}
+		logInfo.Out = storage.DiskSpace
+	}
+	messages, err := capi.renderAfterEvents(storage.DiskSpace)
+	if err != nil {
+		err = errors.WithMessagef(err, "apiCompiled.Run.AfterEvent,route:%s", capi.Route)
+		return "", err
+	}
+	var outbox *DBProvider
+	if tx := state.getTx(); tx != nil {
+		outbox = tx.provider
+		if err = capi.commitTransaction(ctx, state, messages); err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.Run.Commit,route:%s", capi.Route)
+			return "", err
+		}
+	}
+	// 在后置脚本、事件发布等副作用之前发布
+	capi.publishAfterEvents(ctx, outbox, messages)
 	//pos script 异步执行,需要同步处理的需要放到main中
-	if c := capi.getPostScript(); c != nil {
+	if c := cloneScript(scripts.post); c != nil {
 		if err = c.Set(VARIABLE_STORAGE, storage); err != nil {
 			err = errors.WithMessagef(err, "apiCompiled.SetStorage.PostScript,route:%s", capi.Route)
 			return "", err
 		}
+		// 后置脚本使用独立的执行状态,其中获取的锁在后置脚本结束时释放,事件直接发布
+		postState := newRunState()
+		postState.released = true
+		postState.logMasker = state.logMasker
+		// 后置脚本在请求结束后执行,上下文保留请求中的值(身份、链路ID等),不随请求取消
+		storage.Ctx = &tengocontext.TengoContext{Context: context.WithValue(detachContext(ctx), CONTEXT_KEY_RUN_STATE, postState)}
 
 		go func(c *tengo.Compiled, runLogInfo RunLogInfo) {
 
@@ -308,6 +552,7 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 				PreInput:      runLogInfo.PreInput,
 				PreOutput:     runLogInfo.PreOutput,
 				Out:           runLogInfo.Out,
+				masker:        runLogInfo.masker,
 			}
 			defer func() {
 				if panicInfo := recover(); panicInfo != nil {
@@ -320,8 +565,10 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 				cpRunLogInfo.Err = err
 				logchan.SendLogInfo(&cpRunLogInfo)
 			}()
+			defer postState.releaseLocks()
+			defer postState.releaseSources()
 
-			if err = c.Run(); err != nil {
+			if err = capi.runScript(c, storage, scripts.sandbox); err != nil { // 后置脚本在请求结束后执行,不随请求取消
 				err = errors.WithMessagef(err, "apiCompiled.Run.PostScript,route:%s", capi.Route)
 				return
 			}
@@ -341,25 +588,68 @@ func (capi *apiCompiled) Run(ctx context.Context, inputJson string) (out string,
 		rootName := string(capi.outputLineSchema.Meta.ID)
 		out = gjson.Get(out, rootName).String()
 	}
-	return out, nil
+	capi.releaseEvents(state)
+	rawOut = out
+	collectSensitiveValues(state.logMasker, out, capi.sensitiveOutput, false)
+	return capi.maskOutput(ctx, out)
+}
+
+// detachedContext 保留父上下文中的值,不继承其取消和超时
+type detachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func detachContext(parent context.Context) context.Context {
+	return detachedContext{Context: context.Background(), parent: parent}
 }
 
-func (capi *apiCompiled) compileScript(script string) (c *tengo.Compiled, err error) {
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// formatInput 合并默认值、验证参数并格式化为脚本中的输入
+func (capi *apiCompiled) formatInput(inputJson string) (out string, err error) {
+	// 合并默认值
+	if capi.defaultJson != "" {
+		inputJson, err = jsonschemaline.JsonMerge(capi.defaultJson, inputJson)
+		if err != nil {
+			return "", err
+		}
+	}
+	// 验证参数
+	if capi.inputSchema != nil {
+		err = gojsonschemavalidator.Validate(inputJson, *capi.inputSchema)
+		if err != nil {
+			err = NewStatusError(http.StatusBadRequest, err)
+			return "", err
+		}
+	}
+	if inputJson != "" && capi.inputGjsonPath != "" { // 初步格式化入参(转换成脚本中的输入)
+		fmtInupt := fmt.Sprintf(`{"%s":%s}`, capi.inputLineSchema.Meta.ID, inputJson)
+		inputJson = gjson.Get(fmtInupt, capi.inputGjsonPath).String()
+	}
+	return inputJson, nil
+}
+
+func (capi *apiCompiled) compileScript(script string, policy *SandboxPolicy) (c *tengo.Compiled, err error) {
 	script = fmt.Sprintf(`__res__:=func(){%s}()`, script)
 	s := tengo.NewScript([]byte(script))
-	s.EnableFileImport(true)
-	mods := stdlib.GetModuleMap(stdlib.AllModuleNames()...)
-	mods2 := tengolib.GetModuleMap(tengolib.AllModuleNames()...)
-	mods.AddMap(mods2)
-	s.SetImports(mods)
-	if err = s.Add("execSQLTPL", capi.execSQLTPL); err != nil {
-		return nil, err
-	}
-	if err = s.Add("getDBByTemplateName", capi.sourcePool.TengoGetProviderByTemplateIdentifer); err != nil {
-		return nil, err
+	var sandbox *sandboxModules
+	if policy == nil {
+		s.EnableFileImport(true)
+		s.SetImports(builtinModules())
+	} else { // 沙箱内文件导入由 sandboxModules 限制在根目录
+		sandbox = newSandboxModules(policy)
+		s.SetImports(sandbox)
+		if policy.MaxAllocs > 0 {
+			s.SetMaxAllocs(policy.MaxAllocs)
+		}
 	}
-	if err = s.Add("execTPL", capi.template.TengoExec); err != nil {
-		return nil, err
+	for name, fn := range capi.scriptFuncs() {
+		if err = s.Add(name, fn); err != nil {
+			return nil, err
+		}
 	}
 	gjsonMemory := tengogsjson.NewStorage()
 	if err = s.Add(VARIABLE_STORAGE, gjsonMemory); err != nil {
@@ -367,6 +657,10 @@ func (capi *apiCompiled) compileScript(script string) (c *tengo.Compiled, err er
 	}
 	c, err = s.Compile()
 	if err != nil {
+		if sandbox != nil && sandbox.violation != nil {
+			sandbox.violation.Err = err
+			return nil, sandbox.violation
+		}
 		return nil, err
 	}
 	return c, nil
@@ -408,56 +702,207 @@ func (capi *apiCompiled) execSQLTPL(args ...tengo.Object) (dbResultTengo tengo.O
 	for k, v := range tengoMap.Value {
 		volume.SetValue(k, tengo.ToInterface(v))
 	}
+	dbResult, err := capi.execSQLTemplate(ctx, tplName, volume)
+	if err != nil {
+		return nil, err
+	}
+	dbResultTengo = &tengo.String{Value: dbResult}
+	return dbResultTengo, nil
+}
 
+// execSQLTemplate 渲染sql模板并在模板关联的资源上执行
+func (capi *apiCompiled) execSQLTemplate(ctx context.Context, tplName string, volume tengotemplate.VolumeInterface) (out string, err error) {
+	volume.SetValue(VOLUME_KEY_DIALECT, capi.templateDialect(ctx, tplName).Name())
 	tplOut, volumeI, err := capi.template.Exec(tplName, volume)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	sqlStr, err := tengotemplate.ToSQL(tplOut, volumeI.ToMap())
+	return capi.execNamedSQL(ctx, tplName, tplOut, volumeI.ToMap())
+}
+
+// execNamedSQL 在模板关联的资源上执行带命名参数的sql,资源支持绑定参数时参数不拼接到sql中
+func (capi *apiCompiled) execNamedSQL(ctx context.Context, tplName string, named string, data map[string]interface{}) (out string, err error) {
+	sourceIdentifer, provider, err := capi.getProviderByTemplate(ctx, tplName)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	provider, err := capi.sourcePool.GetProviderByTemplateIdentifer(tplName)
+	dialect := capi.providerDialect(tplName, provider)
+	statement, args, err := toStatement(dialect, named, data)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	dbProvider, ok := provider.(*tengodb.TengoDB)
-	if !ok {
-		err = errors.Errorf("ExecSQLTPL required tengodb.TengoDB  source,got:%s", provider.TypeName())
-		return nil, err
+	if sink := capi.getAuditSink(); sink != nil && tengodb.SQLType(statement) != tengodb.SQL_TYPE_SELECT {
+		return capi.execAudited(ctx, sink, tplName, dialect, sourceIdentifer, provider, statement, args, data)
+	}
+	return capi.execStatement(ctx, tplName, dialect, sourceIdentifer, provider, statement, args, data)
+}
+
+// execStatement 在资源上执行语句,事务内使用事务执行,读操作使用单次执行内的缓存,写操作后发布模板事件
+func (capi *apiCompiled) execStatement(ctx context.Context, tplName string, dialect Dialect, sourceIdentifer string, provider tengo.Object, statement string, args []interface{}, data map[string]interface{}) (out string, err error) {
+	state := getRunState(ctx)
+	isRead := tengodb.SQLType(statement) == tengodb.SQL_TYPE_SELECT
+	if tx := state.getTx(); tx != nil && tx.sourceIdentifer == sourceIdentifer { // 事务内执行,不使用缓存
+		if out, err = execOrQueryContext(ctx, tx.tx, statement, args...); err != nil {
+			return "", err
+		}
+		if !isRead {
+			state.flushCache()
+			capi.publishTemplateEvent(ctx, tplName, data)
+		}
+		return out, nil
+	}
+	argsExecutor, bindArgs := provider.(SQLArgsExecutor)
+	dbProvider, ok := provider.(tengodb.TengoDBInterface)
+	if !ok && !bindArgs {
+		err = errors.Errorf("ExecSQLTPL required tengodb.TengoDBInterface  source,got:%s", provider.TypeName())
+		return "", err
 	}
-	if dbProvider.GetDB() == nil {
+	if tengoDB, ok := dbProvider.(*tengodb.TengoDB); ok && tengoDB.GetDB() == nil {
 		err = errors.Errorf("ExecSQLTPL  tengodb.TengoDB  required,got nil (%s)", provider.TypeName())
-		return nil, err
+		return "", err
+	}
+	if !bindArgs {
+		statement, args = explainSQL(dialect, statement, args), nil
+	}
+	if route, ok := capi.dbRoutes[tplName]; ok {
+		ctx = context.WithValue(ctx, CONTEXT_KEY_DB_ROUTE, route)
+	}
+	route, _ := ctx.Value(CONTEXT_KEY_DB_ROUTE).(string)
+	if state != nil {
+		if !isRead {
+			state.flushCache() // 写操作后缓存可能失效
+		} else if out, ok := state.getCache(sourceIdentifer, route, statement, args); ok {
+			return out, nil
+		}
+	}
+	if bindArgs {
+		out, err = argsExecutor.ExecOrQueryArgsContext(ctx, statement, args...)
+	} else {
+		out, err = dbProvider.ExecOrQueryContext(ctx, statement)
 	}
-	dbResult, err := dbProvider.ExecOrQueryContext(ctx, sqlStr)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	dbResultTengo = &tengo.String{Value: dbResult}
-	return dbResultTengo, nil
+	if state != nil && isRead {
+		state.setCache(sourceIdentifer, route, statement, args, out)
+	}
+	if !isRead {
+		capi.publishTemplateEvent(ctx, tplName, data)
+	}
+	return out, nil
 }
 
-// 确保多协程安全
-func (capi *apiCompiled) getPreScript() *tengo.Compiled {
-	if capi._preScript == nil {
-		return nil
+// getProviderByTemplate 获取模板关联的资源,设置了资源解析器时按上下文解析实际资源
+func (capi *apiCompiled) getProviderByTemplate(ctx context.Context, tplName string) (sourceIdentifer string, provider tengo.Object, err error) {
+	sourceIdentifer, err = capi.sourcePool.IdentiferRelationCollection.GetSourceIdentiferByTemplateIdentifer(tplName)
+	if err != nil {
+		return "", nil, err
 	}
-	return capi._preScript.Clone()
+	return capi.getProviderBySource(ctx, sourceIdentifer)
 }
 
-// 确保多协程安全
-func (capi *apiCompiled) getMainScript() *tengo.Compiled {
-	if capi._mainScript == nil {
+// getProviderBySource 获取资源,设置了资源解析器时按上下文解析实际资源
+func (capi *apiCompiled) getProviderBySource(ctx context.Context, sourceIdentifer string) (identifer string, provider tengo.Object, err error) {
+	if pool := capi.getResolvedSourcePool(); pool != nil {
+		identifer, resolvedProvider, ok, err := pool.getProvider(ctx, sourceIdentifer)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			return identifer, resolvedProvider, nil
+		}
+	}
+	provider, err = capi.sourcePool.GetProviderBySourceIdentifer(sourceIdentifer)
+	if err != nil {
+		return "", nil, err
+	}
+	return sourceIdentifer, provider, nil
+}
+
+//SetSourceResolver 设置运行时资源解析器(如多租户),优先于容器上的解析器
+func (capi *apiCompiled) SetSourceResolver(resolver SourceResolver) {
+	capi.resolvedSources = newResolvedSourcePool(resolver)
+}
+
+//EvictIdleSources 淘汰空闲超时的运行时资源
+func (capi *apiCompiled) EvictIdleSources(idle time.Duration) (evicted []string) {
+	if capi.resolvedSources == nil {
 		return nil
 	}
-	return capi._mainScript.Clone()
+	return capi.resolvedSources.evictIdle(idle)
+}
+
+func (capi *apiCompiled) getResolvedSourcePool() (pool *resolvedSourcePool) {
+	if capi.resolvedSources != nil {
+		return capi.resolvedSources
+	}
+	if capi._container != nil {
+		return capi._container.resolvedSources
+	}
+	return nil
+}
+
+// templateDialect 获取模板本次执行实际使用资源的方言,用于渲染模板
+func (capi *apiCompiled) templateDialect(ctx context.Context, tplName string) (d Dialect) {
+	_, provider, err := capi.getProviderByTemplate(ctx, tplName)
+	if err != nil { // 资源获取失败在执行时返回
+		return capi.getDialectByTemplate(tplName)
+	}
+	return capi.providerDialect(tplName, provider)
+}
+
+// providerDialect 资源提供方言时使用资源的方言(资源解析器解析出的租户资源可能与模板绑定的资源方言不同),否则使用模板绑定资源的方言
+func (capi *apiCompiled) providerDialect(tplName string, provider tengo.Object) (d Dialect) {
+	if p, ok := provider.(interface{ Dialect() Dialect }); ok {
+		if d = p.Dialect(); d != nil {
+			return d
+		}
+	}
+	return capi.getDialectByTemplate(tplName)
+}
+
+// getDialectByTemplate 获取模板绑定资源的方言,默认 mysql
+func (capi *apiCompiled) getDialectByTemplate(tplName string) (d Dialect) {
+	sourceIdentifer, err := capi.sourcePool.IdentiferRelationCollection.GetSourceIdentiferByTemplateIdentifer(tplName)
+	if err == nil {
+		if d, ok := capi.dialects[sourceIdentifer]; ok {
+			return d
+		}
+	}
+	return dialectMysql{}
+}
+
+// scriptFuncs 注入脚本的原生函数
+func (capi *apiCompiled) scriptFuncs() (funcs map[string]tengo.CallableFunc) {
+	return map[string]tengo.CallableFunc{
+		"execSQLTPL":          capi.execSQLTPL,
+		"getDBByTemplateName": capi.sourcePool.TengoGetProviderByTemplateIdentifer,
+		"execTPL":             capi.template.TengoExec,
+		"join":                TengoJoin,
+		"loadSQLTPL":          capi.loadSQLTPL,
+		"publish":             capi.TengoPublish,
+		"lock":                capi.TengoLock,
+		"principal":           TengoPrincipal,
+	}
+}
+
+// getScripts 当前生效的脚本,与沙箱策略变更并发安全
+func (capi *apiCompiled) getScripts() *apiScripts {
+	capi.lockScripts.RLock()
+	defer capi.lockScripts.RUnlock()
+	return capi.scripts
+}
+
+func (capi *apiCompiled) setScripts(scripts *apiScripts) {
+	capi.lockScripts.Lock()
+	defer capi.lockScripts.Unlock()
+	capi.scripts = scripts
 }
 
 // 确保多协程安全
-func (capi *apiCompiled) getPostScript() *tengo.Compiled {
-	if capi._postScript == nil {
+func cloneScript(c *tengo.Compiled) *tengo.Compiled {
+	if c == nil {
 		return nil
 	}
-	return capi._postScript.Clone()
+	return c.Clone()
 }
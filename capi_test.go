@@ -91,7 +91,9 @@ func TestAPIMemory(t *testing.T) {
 	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {
 		fmt.Println(logInfo)
 	})
-	container.RegisterAPI(capi)
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
 
 	routeCapi, ok := container.GetCApi(route, method)
 	if !ok {
@@ -108,3 +110,56 @@ func TestAPIMemory(t *testing.T) {
 	fmt.Println(out)
 
 }
+
+type countingMemoryDB struct {
+	tengodb.TengoMemoryDB
+	count int
+}
+
+func (m *countingMemoryDB) ExecOrQueryContext(ctx context.Context, sql string) (out string, err error) {
+	m.count++
+	return m.TengoMemoryDB.ExecOrQueryContext(ctx, sql)
+}
+
+func TestRunCache(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/cache",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		input:=storage.GetMemory()
+		execSQLTPL(ctx,"Get",input)
+		execSQLTPL(ctx,"Get",input)
+		execSQLTPL(ctx,"Update",input)
+		execSQLTPL(ctx,"Get",input)
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &countingMemoryDB{TengoMemoryDB: tengodb.TengoMemoryDB{InOutMap: map[string]string{
+		"select name from user where id=1":      "alice",
+		"update user set name='bob' where id=1": "1",
+	}}}
+	source.SetProvider(db)
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Get"}}select name from user where id=:id{{end}}{{define "Update"}}update user set name='bob' where id=:id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = capi.Run(context.Background(), `{"id":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if db.count != 3 { // 第二次查询命中缓存,写操作后缓存失效
+		t.Errorf("want 3 calls,got:%d", db.count)
+	}
+}
@@ -0,0 +1,289 @@
+package dataexchanger
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+const (
+	CDC_ACTION_INSERT = "insert"
+	CDC_ACTION_UPDATE = "update"
+	CDC_ACTION_DELETE = "delete"
+
+	CDC_TOPIC_PREFIX = "cdc." // 未指定主题时事件主题为 cdc.表名
+)
+
+// RowChange 行变更事件
+type RowChange struct {
+	Schema    string                 `json:"schema"`
+	Table     string                 `json:"table"`
+	Action    string                 `json:"action"` // insert、update、delete
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty"`
+	Position  string                 `json:"position"` // 变更在日志中的位置(如 binlog 文件:偏移、gtid),用于断点续读
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// ChangeFeed 变更数据源,本包不直接依赖 binlog 协议库,MySQL binlog 读取(如 go-mysql canal)需适配此接口接入,
+// 位置为 binlog 文件:偏移 时 ComparePosition 可直接使用 CompareBinlogPosition
+type ChangeFeed interface {
+	// Run 从 position 之后开始读取变更(为空时从当前位置),阻塞直到 ctx 取消或出错
+	Run(ctx context.Context, position string, handler func(change RowChange) error) (err error)
+	// ComparePosition 比较两个位置的先后,a 在 b 之前返回 -1,相同返回 0,之后返回 1
+	ComparePosition(a string, b string) (result int, err error)
+}
+
+// BinlogPosition binlog 位置,格式为 文件名:偏移,如 mysql-bin.000012:4567
+type BinlogPosition struct {
+	File   string
+	Offset uint64
+}
+
+// ParseBinlogPosition 解析 文件名:偏移 格式的位置
+func ParseBinlogPosition(position string) (pos BinlogPosition, err error) {
+	index := strings.LastIndex(position, ":")
+	if index <= 0 {
+		err = errors.Errorf("binlog position want file:offset,got:%s", position)
+		return pos, err
+	}
+	pos.File = position[:index]
+	if pos.Offset, err = strconv.ParseUint(position[index+1:], 10, 64); err != nil {
+		err = errors.WithMessagef(err, "binlog position offset,got:%s", position)
+		return pos, err
+	}
+	return pos, nil
+}
+
+// CompareBinlogPosition 按文件序号、偏移比较 binlog 位置(按字符串比较时 :900 会排在 :1000 之后)
+func CompareBinlogPosition(a string, b string) (result int, err error) {
+	posA, err := ParseBinlogPosition(a)
+	if err != nil {
+		return 0, err
+	}
+	posB, err := ParseBinlogPosition(b)
+	if err != nil {
+		return 0, err
+	}
+	if result = compareBinlogFile(posA.File, posB.File); result != 0 {
+		return result, nil
+	}
+	switch {
+	case posA.Offset < posB.Offset:
+		return -1, nil
+	case posA.Offset > posB.Offset:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// compareBinlogFile 文件名为 前缀.序号,序号超过补零位数后长度增加,按数值比较
+func compareBinlogFile(a string, b string) int {
+	indexA, indexB := strings.LastIndex(a, "."), strings.LastIndex(b, ".")
+	if indexA >= 0 && indexB >= 0 && a[:indexA] == b[:indexB] {
+		seqA, errA := strconv.ParseUint(a[indexA+1:], 10, 64)
+		seqB, errB := strconv.ParseUint(b[indexB+1:], 10, 64)
+		if errA == nil && errB == nil {
+			switch {
+			case seqA < seqB:
+				return -1
+			case seqA > seqB:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// CDCTable 需要捕获变更的表
+type CDCTable struct {
+	Table string `json:"table"` // 表名或 库名.表名
+	Topic string `json:"topic"` // 发布到事件总线的主题,默认 cdc.表名
+}
+
+// CacheInvalidator 表数据变更时调用,用于失效与表关联的缓存
+type CacheInvalidator func(change RowChange)
+
+// cdc 变更捕获,行变更转换为事件发布到容器事件总线,并失效关联缓存
+type cdc struct {
+	tables       []CDCTable
+	invalidators map[string][]CacheInvalidator // 表名 => 失效函数
+	feed         ChangeFeed                    // 比较位置先后,位置只前进不后退
+	position     string
+	lock         sync.Mutex
+}
+
+// LogInfoCDC 变更捕获日志
+type LogInfoCDC struct {
+	Change RowChange `json:"change"`
+	Topic  string    `json:"topic"`
+	Err    error
+	logchan.EmptyLogInfo
+	container *Container // 产生日志的容器,按其脱敏规则脱敏
+}
+
+func (l LogInfoCDC) GetName() logchan.LogName {
+	return LogName(LOG_INFO_CDC)
+}
+
+func (l LogInfoCDC) Error() error {
+	return l.Err
+}
+
+// topic 匹配配置的表,返回事件主题
+func (c *cdc) topic(change RowChange) (topic string, ok bool) {
+	for _, table := range c.tables {
+		if table.Table != change.Table && table.Table != change.Schema+"."+change.Table {
+			continue
+		}
+		if table.Topic == "" {
+			return CDC_TOPIC_PREFIX + change.Table, true
+		}
+		return table.Topic, true
+	}
+	return "", false
+}
+
+// after 位置是否在已记录的位置之后,无法比较时视为之后,调用方需持有锁
+func (c *cdc) after(position string) bool {
+	if c.position == "" || c.feed == nil {
+		return true
+	}
+	result, err := c.feed.ComparePosition(position, c.position)
+	return err != nil || result > 0
+}
+
+// RegisterCacheInvalidator 注册表数据变更时的缓存失效函数,表名不含库名
+func (c *Container) RegisterCacheInvalidator(table string, invalidator CacheInvalidator) {
+	c.cdc.lock.Lock()
+	defer c.cdc.lock.Unlock()
+	c.cdc.invalidators[table] = append(c.cdc.invalidators[table], invalidator)
+}
+
+// CDCPosition 最后处理的变更位置,重启时传给 StartCDC 断点续读
+func (c *Container) CDCPosition() (position string) {
+	c.cdc.lock.Lock()
+	defer c.cdc.lock.Unlock()
+	return c.cdc.position
+}
+
+// HandleRowChange 处理一条行变更:失效关联缓存、发布事件(数据为行变更 json)
+func (c *Container) HandleRowChange(change RowChange) (err error) {
+	switch change.Action {
+	case CDC_ACTION_INSERT, CDC_ACTION_UPDATE, CDC_ACTION_DELETE:
+	default:
+		err = errors.Errorf("row change action want insert/update/delete,got:%s", change.Action)
+		return err
+	}
+	c.cdc.lock.Lock()
+	topic, ok := c.cdc.topic(change)
+	invalidators := c.cdc.invalidators[change.Table]
+	if change.Position != "" && c.cdc.after(change.Position) {
+		c.cdc.position = change.Position
+	}
+	c.cdc.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	logInfo := &LogInfoCDC{Change: change, Topic: topic, container: c}
+	defer func() {
+		logInfo.Err = err
+		logchan.SendLogInfo(logInfo)
+	}()
+	for _, invalidator := range invalidators {
+		invalidator(change)
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	c.Publish(topic, string(data))
+	return nil
+}
+
+// StartCDC 开始捕获配置表的变更,position 为空时从变更源当前位置开始,返回停止函数(等待读取结束)
+func (c *Container) StartCDC(feed ChangeFeed, tables []CDCTable, position string) (stop func() (err error)) {
+	c.cdc.lock.Lock()
+	c.cdc.tables = append(c.cdc.tables, tables...)
+	c.cdc.feed = feed
+	c.cdc.lock.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		err := feed.Run(ctx, position, c.HandleRowChange)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			err = errors.WithMessage(err, "Container.StartCDC")
+			logchan.SendLogInfo(&LogInfoCDC{Err: err, container: c})
+		}
+		done <- err
+	}()
+	var once sync.Once
+	var stopErr error
+	return func() error {
+		once.Do(func() {
+			cancel()
+			stopErr = <-done
+			if errors.Is(stopErr, context.Canceled) {
+				stopErr = nil
+			}
+		})
+		return stopErr
+	}
+}
+
+// MemoryChangeFeed 内存变更源,用于测试或由业务代码推送变更
+type MemoryChangeFeed struct {
+	changes chan RowChange
+	// Compare 位置比较函数,默认 CompareBinlogPosition
+	Compare func(a string, b string) (result int, err error)
+}
+
+func NewMemoryChangeFeed() (feed *MemoryChangeFeed) {
+	return &MemoryChangeFeed{changes: make(chan RowChange, EVENT_SUBSCRIBER_BUFFER)}
+}
+
+// Push 推送变更,未设置时间时使用当前时间
+func (f *MemoryChangeFeed) Push(change RowChange) {
+	if change.Timestamp.IsZero() {
+		change.Timestamp = time.Now().Local()
+	}
+	f.changes <- change
+}
+
+func (f *MemoryChangeFeed) ComparePosition(a string, b string) (result int, err error) {
+	if f.Compare != nil {
+		return f.Compare(a, b)
+	}
+	return CompareBinlogPosition(a, b)
+}
+
+// Run 实现 ChangeFeed,position 之前(含)的变更会被跳过
+func (f *MemoryChangeFeed) Run(ctx context.Context, position string, handler func(change RowChange) error) (err error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change := <-f.changes:
+			if position != "" && change.Position != "" {
+				result, err := f.ComparePosition(change.Position, position)
+				if err != nil {
+					err = errors.WithMessage(err, "MemoryChangeFeed.Run")
+					return err
+				}
+				if result <= 0 {
+					continue
+				}
+			}
+			if err = handler(change); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package dataexchanger_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestCDC(t *testing.T) {
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	err := container.RegisterSubscription(dataexchanger.DtoSubscription{
+		Route: "/sub/orders",
+		Topic: "cdc.orders",
+		FilterLineSchema: `version=http://json-schema.org/draft-07/schema,id=filter,direction=in
+		fullname=status,dst=after.status`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	invalidated := make([]string, 0)
+	container.RegisterCacheInvalidator("orders", func(change dataexchanger.RowChange) {
+		lock.Lock()
+		defer lock.Unlock()
+		invalidated = append(invalidated, change.Position)
+	})
+	feed := dataexchanger.NewMemoryChangeFeed()
+	stop := container.StartCDC(feed, []dataexchanger.CDCTable{{Table: "shop.orders"}, {Table: "users", Topic: "user"}}, "")
+	feed.Push(dataexchanger.RowChange{Schema: "shop", Table: "products", Action: dataexchanger.CDC_ACTION_INSERT, Position: "binlog.000001:100"})
+	feed.Push(dataexchanger.RowChange{
+		Schema:   "shop",
+		Table:    "orders",
+		Action:   dataexchanger.CDC_ACTION_UPDATE,
+		Before:   map[string]interface{}{"id": 1, "status": "new"},
+		After:    map[string]interface{}{"id": 1, "status": "paid"},
+		Position: "binlog.000001:200",
+	})
+	feed.Push(dataexchanger.RowChange{Schema: "shop", Table: "orders", Action: dataexchanger.CDC_ACTION_INSERT, After: map[string]interface{}{"id": 2, "status": "new"}, Position: "binlog.000001:300"})
+
+	poll := func(query string) (body string) {
+		rec := httptest.NewRecorder()
+		container.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/orders?timeout=2&"+query, nil))
+		return rec.Body.String()
+	}
+	body := poll("status=paid&lastEventId=0")
+	if got := gjson.Get(body, "events.#.data.[action,before.status,after.id]").Raw; got != `[["update","new",1]]` {
+		t.Errorf("cdc event got:%s", body)
+	}
+	body = poll("lastEventId=" + gjson.Get(body, "events.0.id").String()) // 过滤条件变化,从已收到的事件续读
+	if got := gjson.Get(body, "events.#.data.[action,position]").Raw; got != `[["insert","binlog.000001:300"]]` {
+		t.Errorf("cdc event got:%s", body)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := container.CDCPosition(); got != "binlog.000001:300" {
+		t.Errorf("position want binlog.000001:300,got:%s", got)
+	}
+	lock.Lock()
+	if len(invalidated) != 2 {
+		t.Errorf("orders cache want invalidated 2 times,got:%v", invalidated)
+	}
+	lock.Unlock()
+
+	// 断点续读,已处理的变更被跳过
+	feed.Push(dataexchanger.RowChange{Schema: "shop", Table: "orders", Action: dataexchanger.CDC_ACTION_INSERT, Position: "binlog.000001:300"})
+	feed.Push(dataexchanger.RowChange{Schema: "shop", Table: "orders", Action: dataexchanger.CDC_ACTION_DELETE, Before: map[string]interface{}{"id": 2}, Position: "binlog.000001:1000"})
+	stop = container.StartCDC(feed, nil, container.CDCPosition())
+	defer stop()
+	body = poll("lastEventId=" + gjson.Get(body, "lastEventId").String())
+	if got := gjson.Get(body, "events.0.data.[action,position]").Raw; got != `["delete","binlog.000001:1000"]` {
+		t.Errorf("events after resume got:%s", body)
+	}
+}
+
+func TestCompareBinlogPosition(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"binlog.000001:900", "binlog.000001:1000", -1},
+		{"binlog.000002:4", "binlog.000001:1000", 1},
+		{"binlog.999999:4", "binlog.1000000:4", -1},
+		{"binlog.000001:300", "binlog.000001:300", 0},
+	}
+	for _, c := range cases {
+		got, err := dataexchanger.CompareBinlogPosition(c.a, c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("compare %s %s want:%d,got:%d", c.a, c.b, c.want, got)
+		}
+	}
+	if _, err := dataexchanger.CompareBinlogPosition("gtid-set", "binlog.000001:4"); err == nil {
+		t.Errorf("invalid position want error")
+	}
+}
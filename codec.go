@@ -0,0 +1,534 @@
+package dataexchanger
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/jsonschemaline"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	MEDIA_TYPE_JSON    = "application/json"
+	MEDIA_TYPE_FORM    = "application/x-www-form-urlencoded"
+	MEDIA_TYPE_XML     = "application/xml"
+	MEDIA_TYPE_CSV     = "text/csv"
+	MEDIA_TYPE_MSGPACK = "application/msgpack"
+
+	XML_ROOT_DEFAULT = "root" // 输出行 schema 未设置 id 时的 xml 根节点
+	XML_ITEM         = "item" // xml 中数组元素节点名
+)
+
+// Codec 编解码器,http 层按 Content-Type、Accept 选择,与内部 json 互转
+type Codec interface {
+	MediaType() string
+	// Decode 请求体转换为输入 json
+	Decode(body []byte) (inputJson string, err error)
+	// Encode 输出 json 转换为响应体,outputLineSchema 可能为 nil
+	Encode(out string, outputLineSchema *jsonschemaline.Jsonschemaline) (body []byte, err error)
+}
+
+// RegisterCodec 注册编解码器,aliases 为同一编解码器的其它媒体类型(如 text/xml)
+func (c *Container) RegisterCodec(codec Codec, aliases ...string) {
+	c.lockCodec.Lock()
+	defer c.lockCodec.Unlock()
+	for _, mediaType := range append([]string{codec.MediaType()}, aliases...) {
+		c.codecs[strings.ToLower(mediaType)] = codec
+	}
+}
+
+func (c *Container) registerDefaultCodecs() {
+	c.RegisterCodec(&JsonCodec{})
+	c.RegisterCodec(&FormCodec{})
+	c.RegisterCodec(&XmlCodec{}, "text/xml")
+	c.RegisterCodec(&CsvCodec{})
+	c.RegisterCodec(&MsgpackCodec{}, "application/x-msgpack")
+}
+
+// GetCodec 按媒体类型获取编解码器
+func (c *Container) GetCodec(mediaType string) (codec Codec, ok bool) {
+	c.lockCodec.Lock()
+	defer c.lockCodec.Unlock()
+	codec, ok = c.codecs[strings.ToLower(mediaType)]
+	return codec, ok
+}
+
+// requestCodec 按 Content-Type 选择解码器,未设置时使用 json
+func (c *Container) requestCodec(contentType string) (codec Codec, err error) {
+	if strings.TrimSpace(contentType) == "" {
+		contentType = MEDIA_TYPE_JSON
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		err = errors.WithMessagef(err, "invalid Content-Type:%s", contentType)
+		return nil, err
+	}
+	codec, ok := c.GetCodec(mediaType)
+	if !ok {
+		err = errors.Errorf("unsupported Content-Type:%s", contentType)
+		return nil, err
+	}
+	return codec, nil
+}
+
+// responseCodec 按 Accept 选择编码器(支持 q 权重),未设置或 */* 时使用 json
+func (c *Container) responseCodec(accept string) (codec Codec, err error) {
+	type acceptItem struct {
+		mediaType string
+		q         float64
+	}
+	items := make([]acceptItem, 0)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qStr, 64); err != nil || q <= 0 {
+				continue
+			}
+		}
+		items = append(items, acceptItem{mediaType: mediaType, q: q})
+	}
+	if len(items) == 0 {
+		items = append(items, acceptItem{mediaType: "*/*", q: 1})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].q > items[j].q })
+	for _, item := range items {
+		if item.mediaType == "*/*" || item.mediaType == "application/*" {
+			item.mediaType = MEDIA_TYPE_JSON
+		}
+		if codec, ok := c.GetCodec(item.mediaType); ok {
+			return codec, nil
+		}
+	}
+	err = errors.Errorf("unsupported Accept:%s", accept)
+	return nil, err
+}
+
+// JsonCodec json 编解码
+type JsonCodec struct{}
+
+func (codec *JsonCodec) MediaType() string {
+	return MEDIA_TYPE_JSON
+}
+
+func (codec *JsonCodec) Decode(body []byte) (inputJson string, err error) {
+	inputJson = strings.TrimSpace(string(body))
+	if inputJson == "" {
+		return "{}", nil
+	}
+	if !gjson.Valid(inputJson) {
+		err = errors.New("invalid json body")
+		return "", err
+	}
+	return inputJson, nil
+}
+
+func (codec *JsonCodec) Encode(out string, outputLineSchema *jsonschemaline.Jsonschemaline) (body []byte, err error) {
+	return []byte(out), nil
+}
+
+// FormCodec 表单编解码,字段名为 gjson 路径(如 user.name),同名多值转为数组
+type FormCodec struct{}
+
+func (codec *FormCodec) MediaType() string {
+	return MEDIA_TYPE_FORM
+}
+
+func (codec *FormCodec) Decode(body []byte) (inputJson string, err error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		err = errors.WithMessage(err, "FormCodec.Decode")
+		return "", err
+	}
+	inputJson = "{}"
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var value interface{} = values[key]
+		if len(values[key]) == 1 {
+			value = values[key][0]
+		}
+		if inputJson, err = sjson.Set(inputJson, formPath(key), value); err != nil {
+			err = errors.WithMessagef(err, "FormCodec.Decode,key:%s", key)
+			return "", err
+		}
+	}
+	return inputJson, nil
+}
+
+func (codec *FormCodec) Encode(out string, outputLineSchema *jsonschemaline.Jsonschemaline) (body []byte, err error) {
+	values := url.Values{}
+	var walk func(prefix string, result gjson.Result)
+	walk = func(prefix string, result gjson.Result) {
+		if !result.IsObject() && !result.IsArray() {
+			values.Add(prefix, result.String())
+			return
+		}
+		result.ForEach(func(key, value gjson.Result) bool {
+			path := escapePathKey(key.String())
+			if result.IsArray() { // 数组元素使用同名多值
+				path = ""
+			}
+			switch {
+			case prefix == "":
+			case path == "":
+				path = prefix
+			default:
+				path = prefix + "." + path
+			}
+			walk(path, value)
+			return true
+		})
+	}
+	walk("", gjson.Parse(out))
+	return []byte(values.Encode()), nil
+}
+
+// XmlCodec xml 编解码,根节点下子节点转为对象属性,同名子节点转为数组,叶子节点值为字符串
+type XmlCodec struct{}
+
+func (codec *XmlCodec) MediaType() string {
+	return MEDIA_TYPE_XML
+}
+
+type xmlNode struct {
+	name     string
+	text     strings.Builder
+	children []*xmlNode
+}
+
+func (codec *XmlCodec) Decode(body []byte) (inputJson string, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var root *xmlNode
+	stack := make([]*xmlNode, 0)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = errors.WithMessage(err, "XmlCodec.Decode")
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return "{}", nil
+	}
+	value := xmlNodeValue(root)
+	if _, ok := value.(string); ok { // 根节点无子节点
+		value = map[string]interface{}{}
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func xmlNodeValue(node *xmlNode) (value interface{}) {
+	if len(node.children) == 0 {
+		return strings.TrimSpace(node.text.String())
+	}
+	// 子节点全部为 item 时视为数组
+	isArray := true
+	for _, child := range node.children {
+		if child.name != XML_ITEM {
+			isArray = false
+			break
+		}
+	}
+	if isArray {
+		arr := make([]interface{}, 0, len(node.children))
+		for _, child := range node.children {
+			arr = append(arr, xmlNodeValue(child))
+		}
+		return arr
+	}
+	counts := make(map[string]int)
+	for _, child := range node.children {
+		counts[child.name]++
+	}
+	obj := make(map[string]interface{})
+	for _, child := range node.children {
+		childValue := xmlNodeValue(child)
+		if counts[child.name] == 1 {
+			obj[child.name] = childValue
+			continue
+		}
+		arr, _ := obj[child.name].([]interface{})
+		obj[child.name] = append(arr, childValue)
+	}
+	return obj
+}
+
+func (codec *XmlCodec) Encode(out string, outputLineSchema *jsonschemaline.Jsonschemaline) (body []byte, err error) {
+	rootName := XML_ROOT_DEFAULT
+	if outputLineSchema != nil && outputLineSchema.Meta != nil && outputLineSchema.Meta.ID != "" {
+		rootName = string(outputLineSchema.Meta.ID)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	var write func(name string, result gjson.Result) error
+	write = func(name string, result gjson.Result) error {
+		start := xml.StartElement{Name: xml.Name{Local: name}}
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		switch {
+		case result.IsArray():
+			for _, item := range result.Array() {
+				if err := write(XML_ITEM, item); err != nil {
+					return err
+				}
+			}
+		case result.IsObject():
+			var err error
+			result.ForEach(func(key, value gjson.Result) bool {
+				err = write(key.String(), value)
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		case result.Type != gjson.Null:
+			if err := encoder.EncodeToken(xml.CharData(result.String())); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	}
+	if err = write(rootName, gjson.Parse(out)); err != nil {
+		err = errors.WithMessage(err, "XmlCodec.Encode")
+		return nil, err
+	}
+	if err = encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formPath 表单字段名、csv 列名转为 sjson 路径,保留 "." 嵌套,每段按字面量处理
+func formPath(key string) string {
+	segments := strings.Split(key, ".")
+	for i, segment := range segments {
+		segments[i] = literalPathKey(segment)
+	}
+	return strings.Join(segments, ".")
+}
+
+// literalPathKey 客户端传入的 key 按字面量设置,数字 key 加 ":" 作为对象 key,避免 a.5000000 之类的 key 生成超大数组
+func literalPathKey(key string) string {
+	key = escapePathKey(key)
+	if key == "-1" {
+		return ":" + key
+	}
+	for _, r := range key {
+		if r < '0' || r > '9' {
+			return key
+		}
+	}
+	if key == "" {
+		return key
+	}
+	return ":" + key
+}
+
+// CsvCodec csv 编解码,解码时首行为列名,转为对象数组;编码时按输出行 schema 中数组元素字段顺序输出列
+type CsvCodec struct{}
+
+func (codec *CsvCodec) MediaType() string {
+	return MEDIA_TYPE_CSV
+}
+
+func (codec *CsvCodec) Decode(body []byte) (inputJson string, err error) {
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		err = errors.WithMessage(err, "CsvCodec.Decode")
+		return "", err
+	}
+	inputJson = "[]"
+	if len(records) == 0 {
+		return inputJson, nil
+	}
+	header := records[0]
+	for i, record := range records[1:] {
+		row := "{}"
+		for j, column := range header {
+			if j >= len(record) {
+				break
+			}
+			if row, err = sjson.Set(row, formPath(column), record[j]); err != nil {
+				err = errors.WithMessagef(err, "CsvCodec.Decode,column:%s", column)
+				return "", err
+			}
+		}
+		if inputJson, err = sjson.SetRaw(inputJson, strconv.Itoa(i), row); err != nil {
+			return "", err
+		}
+	}
+	return inputJson, nil
+}
+
+// csvColumns 从输出行 schema 获取行数据路径和列,取第一个数组字段的元素属性作为列;
+// 无数组字段时输出一行,列为全部字段
+func csvColumns(outputLineSchema *jsonschemaline.Jsonschemaline) (rowsPath string, columns []string) {
+	if outputLineSchema == nil {
+		return "", nil
+	}
+	for _, item := range outputLineSchema.Items {
+		index := strings.Index(item.Fullname, "[]")
+		if index < 0 {
+			continue
+		}
+		prefix := strings.TrimSuffix(item.Fullname[:index], ".")
+		if columns != nil && prefix != rowsPath {
+			continue
+		}
+		rowsPath = prefix
+		column := strings.TrimPrefix(item.Fullname[index+2:], ".")
+		if column == "" || strings.Contains(column, "[]") {
+			continue
+		}
+		columns = append(columns, column)
+	}
+	if columns != nil {
+		if rowsPath == "" {
+			rowsPath = "@this"
+		}
+		return rowsPath, columns
+	}
+	for _, item := range outputLineSchema.Items {
+		columns = append(columns, item.Fullname)
+	}
+	return "", columns
+}
+
+func (codec *CsvCodec) Encode(out string, outputLineSchema *jsonschemaline.Jsonschemaline) (body []byte, err error) {
+	rowsPath, columns := csvColumns(outputLineSchema)
+	var rows []gjson.Result
+	if rowsPath == "" {
+		rows = []gjson.Result{gjson.Parse(out)}
+	} else {
+		rows = gjson.Get(out, rowsPath).Array()
+	}
+	if columns == nil && len(rows) > 0 { // 无输出行 schema 时按首行字段
+		rows[0].ForEach(func(key, value gjson.Result) bool {
+			columns = append(columns, escapePathKey(key.String()))
+			return true
+		})
+	}
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err = writer.Write(columns); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		record := make([]string, 0, len(columns))
+		for _, column := range columns {
+			record = append(record, row.Get(column).String())
+		}
+		if err = writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		err = errors.WithMessage(err, "CsvCodec.Encode")
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MsgpackCodec msgpack 编解码
+type MsgpackCodec struct{}
+
+func (codec *MsgpackCodec) MediaType() string {
+	return MEDIA_TYPE_MSGPACK
+}
+
+func (codec *MsgpackCodec) Decode(body []byte) (inputJson string, err error) {
+	if len(body) == 0 {
+		return "{}", nil
+	}
+	var value interface{}
+	if err = msgpack.Unmarshal(body, &value); err != nil {
+		err = errors.WithMessage(err, "MsgpackCodec.Decode")
+		return "", err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		err = errors.WithMessage(err, "MsgpackCodec.Decode")
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (codec *MsgpackCodec) Encode(out string, outputLineSchema *jsonschemaline.Jsonschemaline) (body []byte, err error) {
+	if out == "" {
+		out = "null"
+	}
+	decoder := json.NewDecoder(strings.NewReader(out))
+	decoder.UseNumber()
+	var value interface{}
+	if err = decoder.Decode(&value); err != nil {
+		err = errors.WithMessage(err, "MsgpackCodec.Encode")
+		return nil, err
+	}
+	return msgpack.Marshal(jsonNumberToNative(value))
+}
+
+// jsonNumberToNative json.Number 转换为 int64 或 float64,整数不丢失精度
+func jsonNumberToNative(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumberToNative(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumberToNative(item)
+		}
+	}
+	return value
+}
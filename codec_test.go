@@ -0,0 +1,133 @@
+package dataexchanger_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestServeHTTPCodec(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "POST",
+		Route:   "/api/users",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=keyword,dst=keyword,required`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=total,src=total,required
+		fullname=items[].name,src=users.#.name,required
+		fullname=items[].id,src=users.#.id,required`,
+		MainScript: `
+		input:=storage.GetMemory()
+		storage.Set("total","2")
+		storage.Set("users",[{id:"1",name:"a,b"},{id:"2",name:input.keyword}])
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(contentType string, accept string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		container.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(dataexchanger.MEDIA_TYPE_FORM, "text/csv", []byte("keyword=go"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("form to csv,status:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	if want := "name,id\n\"a,b\",1\ngo,2\n"; rec.Body.String() != want {
+		t.Errorf("csv want:%q,got:%q", want, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != dataexchanger.MEDIA_TYPE_CSV {
+		t.Errorf("csv Content-Type got:%s", got)
+	}
+
+	rec = serve("text/xml; charset=utf-8", "application/xml", []byte(`<input><keyword>xml</keyword></input>`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("xml,status:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	xmlOut, err := (&dataexchanger.XmlCodec{}).Decode(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.Get(xmlOut, "[total,items.#.name,items.#.id]").Raw; got != `["2",["a,b","xml"],["1","2"]]` {
+		t.Errorf("xml got:%s", rec.Body.String())
+	}
+
+	input, err := msgpack.Marshal(map[string]interface{}{"keyword": "pack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(dataexchanger.MEDIA_TYPE_MSGPACK, "application/json;q=0.5, application/msgpack", input)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("msgpack,status:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	var out map[string]interface{}
+	if err = msgpack.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := out["items"].([]interface{})
+	if len(items) != 2 || items[1].(map[string]interface{})["name"] != "pack" {
+		t.Errorf("msgpack got:%v", out)
+	}
+
+	rec = serve("application/yaml", "", []byte("keyword: go"))
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unsupported Content-Type want 415,got:%d", rec.Code)
+	}
+	rec = serve(dataexchanger.MEDIA_TYPE_JSON, "image/png", []byte(`{"keyword":"go"}`))
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("unsupported Accept want 406,got:%d", rec.Code)
+	}
+	rec = serve(dataexchanger.MEDIA_TYPE_JSON, "*/*", []byte(`{"keyword":"go"}`))
+	if got := gjson.Get(rec.Body.String(), "items.1.name").String(); got != "go" {
+		t.Errorf("json got:%s", rec.Body.String())
+	}
+}
+
+func TestCsvCodecDecode(t *testing.T) {
+	codec := &dataexchanger.CsvCodec{}
+	got, err := codec.Decode([]byte("id,user.name\n1,alice\n2,bob\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"id":"1","user":{"name":"alice"}},{"id":"2","user":{"name":"bob"}}]`
+	if got != want {
+		t.Errorf("want:%s\ngot: %s", want, got)
+	}
+}
+
+func TestCodecDecodeHostileKey(t *testing.T) {
+	form := &dataexchanger.FormCodec{}
+	got, err := form.Decode([]byte("a.5000000=1&b.-1=2&c.%23=3&user.name=alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"5000000":"1"},"b":{"-1":"2"},"c":{"#":"3"},"user":{"name":"alice"}}`
+	if got != want {
+		t.Errorf("form want:%s\ngot: %s", want, got)
+	}
+	csvCodec := &dataexchanger.CsvCodec{}
+	got, err = csvCodec.Decode([]byte("a.5000000,id\n1,2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `[{"a":{"5000000":"1"},"id":"2"}]`
+	if got != want {
+		t.Errorf("csv want:%s\ngot: %s", want, got)
+	}
+}
@@ -0,0 +1,212 @@
+package dataexchanger
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+const (
+	MESSAGE_HEADER_ATTEMPTS = "x-attempts" // 消息头:已失败的次数
+	MESSAGE_HEADER_ERROR    = "x-error"    // 消息头:最后一次失败原因
+
+	CONSUMER_CONCURRENCY_DEFAULT = 1
+	CONSUMER_MAX_RETRIES_DEFAULT = 3
+	DEAD_LETTER_QUEUE_SUFFIX     = ".dead" // 未指定死信队列时为 队列名.dead
+
+	CONSUMER_RECONNECT_INTERVAL     = 100 * time.Millisecond // 消费中断后首次重连间隔,之后翻倍
+	CONSUMER_RECONNECT_MAX_INTERVAL = 30 * time.Second
+)
+
+// DtoConsumer 消费队列消息,每条消息以消息体为输入执行一次 api
+type DtoConsumer struct {
+	Source          string     `json:"source"`          // 消息资源标识(rabbitmq、redis),需注册在 api 上
+	Queue           string     `json:"queue"`           // 队列或 stream 名称
+	Route           string     `json:"route"`           // 执行的 api 路由
+	Method          string     `json:"method"`          // 执行的 api 方法
+	Concurrency     int        `json:"concurrency"`     // 并发处理数,默认 1
+	MaxRetries      int        `json:"maxRetries"`      // 失败后重试次数,默认 3,小于0 不重试
+	DeadLetterQueue string     `json:"deadLetterQueue"` // 超过重试次数后转入的队列
+	Principal       *Principal `json:"principal"`       // 执行 api 的服务身份,api 声明了角色、权限时需配置
+}
+
+func (dto DtoConsumer) validate() (err error) {
+	if dto.Source == "" || dto.Queue == "" || dto.Route == "" || dto.Method == "" {
+		err = errors.Errorf("consumer source,queue,route,method required,got:%+v", dto)
+		return err
+	}
+	return nil
+}
+
+// LogInfoConsume 消息消费日志
+type LogInfoConsume struct {
+	Queue    string  `json:"queue"`
+	Message  Message `json:"message"`
+	Attempts int     `json:"attempts"` // 本次之前已失败的次数
+	Out      string  `json:"out"`
+	Err      error
+	logchan.EmptyLogInfo
+	container *Container // 产生日志的容器,按其脱敏规则脱敏
+}
+
+func (l LogInfoConsume) GetName() logchan.LogName {
+	return LogName(LOG_INFO_CONSUME)
+}
+
+func (l LogInfoConsume) Error() error {
+	return l.Err
+}
+
+// messageAttempts 消息已失败的次数
+func messageAttempts(message Message) (attempts int) {
+	attempts, _ = strconv.Atoi(message.Headers[MESSAGE_HEADER_ATTEMPTS])
+	return attempts
+}
+
+// consumer 队列消费者
+type consumer struct {
+	dto       DtoConsumer
+	capi      *apiCompiled
+	source    MessageConsumer
+	publisher MessagePublisher
+}
+
+// handle 执行 api,成功后确认;失败时带上失败次数重新发布到原队列(超过重试次数发布到死信队列)后确认,重新发布失败时退回消息
+func (c *consumer) handle(delivery Delivery) {
+	ctx := context.Background() // 停止消费时不中断处理中的消息
+	if c.dto.Principal != nil {
+		ctx = WithPrincipal(ctx, c.dto.Principal)
+	}
+	attempts := messageAttempts(delivery.Message)
+	logInfo := &LogInfoConsume{Queue: c.dto.Queue, Message: delivery.Message, Attempts: attempts, container: c.capi._container}
+	defer func() {
+		logchan.SendLogInfo(logInfo)
+	}()
+	logInfo.Out, logInfo.Err = c.capi.Run(ctx, delivery.Body)
+	if logInfo.Err == nil {
+		if err := delivery.Ack(); err != nil {
+			logInfo.Err = errors.WithMessage(err, "consumer.ack")
+		}
+		return
+	}
+	retry := delivery.Message
+	retry.Headers = make(map[string]string, len(delivery.Headers)+2)
+	for k, v := range delivery.Headers {
+		retry.Headers[k] = v
+	}
+	retry.Headers[MESSAGE_HEADER_ATTEMPTS] = strconv.Itoa(attempts + 1)
+	retry.Headers[MESSAGE_HEADER_ERROR] = logInfo.Err.Error()
+	if attempts >= c.dto.MaxRetries {
+		retry.Queue = c.dto.DeadLetterQueue
+	}
+	if err := publishWithRetry(ctx, c.publisher, retry); err != nil {
+		logInfo.Err = errors.WithMessagef(logInfo.Err, "consumer.republish:%s", err.Error())
+		if err = delivery.Nack(true); err != nil {
+			logInfo.Err = errors.WithMessagef(logInfo.Err, "consumer.nack:%s", err.Error())
+		}
+		return
+	}
+	if err := delivery.Ack(); err != nil {
+		logInfo.Err = errors.WithMessagef(logInfo.Err, "consumer.ack:%s", err.Error())
+	}
+}
+
+// StartConsumer 开始消费队列消息,返回停止函数(等待处理中的消息结束)
+func (c *Container) StartConsumer(dto DtoConsumer) (stop func() (err error), err error) {
+	if err = dto.validate(); err != nil {
+		return nil, err
+	}
+	if dto.Concurrency <= 0 {
+		dto.Concurrency = CONSUMER_CONCURRENCY_DEFAULT
+	}
+	if dto.MaxRetries == 0 {
+		dto.MaxRetries = CONSUMER_MAX_RETRIES_DEFAULT
+	}
+	if dto.DeadLetterQueue == "" {
+		dto.DeadLetterQueue = dto.Queue + DEAD_LETTER_QUEUE_SUFFIX
+	}
+	capi, ok := c.GetCApi(dto.Route, dto.Method)
+	if !ok {
+		err = errors.Errorf("Container.StartConsumer api not found,route:%s,method:%s", dto.Route, dto.Method)
+		return nil, err
+	}
+	_, provider, err := capi.getProviderBySource(context.Background(), dto.Source)
+	if err != nil {
+		err = errors.WithMessagef(err, "Container.StartConsumer,route:%s", dto.Route)
+		return nil, err
+	}
+	source, ok := provider.(MessageConsumer)
+	if !ok {
+		err = errors.Errorf("Container.StartConsumer required message consumer source,got:%s", provider.TypeName())
+		return nil, err
+	}
+	publisher, ok := provider.(MessagePublisher)
+	if !ok {
+		err = errors.Errorf("Container.StartConsumer required message publisher source,got:%s", provider.TypeName())
+		return nil, err
+	}
+	consumer := &consumer{dto: dto, capi: capi, source: source, publisher: publisher}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slots := make(chan struct{}, dto.Concurrency)
+	var wg sync.WaitGroup
+	done := make(chan error, 1)
+	var delivered int64
+	handler := func(delivery Delivery) {
+		atomic.AddInt64(&delivered, 1)
+		slots <- struct{}{} // 达到并发上限时阻塞读取
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			consumer.handle(delivery)
+		}()
+	}
+	go func() {
+		var err error
+		interval := CONSUMER_RECONNECT_INTERVAL
+		for {
+			// 连接断开、读取出错时消费中断,按间隔翻倍重连,直到停止
+			err = source.Consume(ctx, dto.Queue, handler)
+			if ctx.Err() != nil {
+				break
+			}
+			if err == nil {
+				err = errors.New("consume returned")
+			}
+			err = errors.WithMessagef(err, "Container.StartConsumer,queue:%s", dto.Queue)
+			logchan.SendLogInfo(&LogInfoConsume{Queue: dto.Queue, Err: err, container: c})
+			if atomic.SwapInt64(&delivered, 0) > 0 { // 中断前消费过消息,视为恢复正常后再次中断
+				interval = CONSUMER_RECONNECT_INTERVAL
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+			if interval *= 2; interval > CONSUMER_RECONNECT_MAX_INTERVAL {
+				interval = CONSUMER_RECONNECT_MAX_INTERVAL
+			}
+		}
+		wg.Wait()
+		done <- err
+	}()
+	var once sync.Once
+	var stopErr error
+	return func() error {
+		once.Do(func() {
+			cancel()
+			stopErr = <-done
+			if errors.Is(stopErr, context.Canceled) {
+				stopErr = nil
+			}
+		})
+		return stopErr
+	}, nil
+}
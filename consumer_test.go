@@ -0,0 +1,156 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+func TestConsumer(t *testing.T) {
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := dataexchanger.NewMemoryBroker()
+	brokerSource.SetProvider(broker)
+	api := &dataexchanger.DtoAPI{
+		Methods:     "post",
+		Route:       "/api/order/sync",
+		Permissions: []string{"order:sync"},
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,required
+		fullname=fail,dst=fail`,
+		MainScript: `
+		input:=storage.GetMemory()
+		if input.fail {
+			return error("sync failed")
+		}
+		`,
+		AfterEvents: []dataexchanger.DtoAfterEvent{{Source: "mq", Queue: "order.synced", Template: "Synced"}},
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	capi.RegisterTemplate("", `{{define "Synced"}}{"id":"{{.input.id}}"}{{end}}`)
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = container.StartConsumer(dataexchanger.DtoConsumer{Source: "mq", Queue: "orders", Route: api.Route, Method: "get"}); err == nil {
+		t.Error("unknown api want error")
+	}
+	stop, err := container.StartConsumer(dataexchanger.DtoConsumer{
+		Source:      "mq",
+		Queue:       "orders",
+		Route:       api.Route,
+		Method:      "post",
+		Concurrency: 4,
+		MaxRetries:  2,
+		Principal:   &dataexchanger.Principal{Subject: "order-sync", Permissions: []string{"order:*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		if err = broker.PublishMessage(ctx, dataexchanger.Message{ID: fmt.Sprint(i), Queue: "orders", Body: fmt.Sprintf(`{"id":"%d"}`, i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = broker.PublishMessage(ctx, dataexchanger.Message{ID: "bad", Queue: "orders", Body: `{"id":"bad","fail":"1"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && (len(broker.Messages("order.synced")) < 20 || len(broker.Messages("orders.dead")) < 1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(broker.Messages("order.synced")); got != 20 {
+		t.Errorf("synced want 20,got:%d", got)
+	}
+	dead := broker.Messages("orders.dead")
+	if len(dead) != 1 || dead[0].ID != "bad" || dead[0].Headers[dataexchanger.MESSAGE_HEADER_ATTEMPTS] != "3" || !strings.Contains(dead[0].Headers[dataexchanger.MESSAGE_HEADER_ERROR], "sync failed") {
+		t.Fatalf("dead letter got:%+v", dead)
+	}
+	if got := len(broker.Messages("orders")); got != 23 { // 21 条原始消息 + 2 次重试
+		t.Errorf("orders want 23 published,got:%d", got)
+	}
+	if got := broker.Pending("orders"); got != 0 {
+		t.Errorf("orders pending want 0,got:%d", got)
+	}
+}
+
+// flakyBroker 前几次消费立即中断,模拟连接断开
+type flakyBroker struct {
+	*dataexchanger.MemoryBroker
+	failTimes int32
+}
+
+func (b *flakyBroker) Consume(ctx context.Context, queue string, handler func(delivery dataexchanger.Delivery)) (err error) {
+	if atomic.AddInt32(&b.failTimes, -1) >= 0 {
+		return errors.New("connection reset")
+	}
+	return b.MemoryBroker.Consume(ctx, queue, handler)
+}
+
+func TestConsumerReconnect(t *testing.T) {
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &flakyBroker{MemoryBroker: dataexchanger.NewMemoryBroker(), failTimes: 2}
+	brokerSource.SetProvider(broker)
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/order/sync",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,required`,
+		AfterEvents: []dataexchanger.DtoAfterEvent{{Source: "mq", Queue: "order.synced", Template: "Synced"}},
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	capi.RegisterTemplate("", `{{define "Synced"}}{"id":"{{.input.id}}"}{{end}}`)
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := container.StartConsumer(dataexchanger.DtoConsumer{Source: "mq", Queue: "orders", Route: api.Route, Method: "post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if err = broker.PublishMessage(context.Background(), dataexchanger.Message{ID: "1", Queue: "orders", Body: `{"id":"1"}`}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(broker.Messages("order.synced")) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(broker.Messages("order.synced")); got != 1 {
+		t.Errorf("consume after reconnect want 1 synced,got:%d", got)
+	}
+}
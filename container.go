@@ -4,28 +4,60 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/suifengpiao14/logchan/v2"
 )
 
 // 容器，包含所有预备的资源、脚本等
 type Container struct {
-	apis     map[string]*apiCompiled
-	lockCApi sync.Mutex
+	apis            map[string]*apiCompiled
+	apiPatterns     routePatterns // 带路径参数的 api 路由
+	lockCApi        sync.Mutex
+	resolvedSources *resolvedSourcePool
+	codecs          map[string]Codec // 媒体类型 => 编解码器
+	lockCodec       sync.Mutex
+	eventBus        *eventBus
+	subscriptions   map[string]*subscription // 订阅路由 => 订阅
+	subPatterns     routePatterns            // 带路径参数的订阅路由
+	lockSub         sync.Mutex
+	cdc             *cdc
+	authenticators  []Authenticator
+	lockAuth        sync.Mutex
+	logMasker       *logMasker // 全局日志脱敏规则
+	lockLogMask     sync.Mutex
+	auditSink       AuditSink // 写操作审计存储
+	lockAudit       sync.Mutex
+	sandbox         *SandboxPolicy // 默认脚本沙箱策略
+	maxBodyBytes    int64          // 请求体大小上限
 }
 
 func NewContainer(logFn func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error)) (container *Container) {
 	container = &Container{
 		apis:     map[string]*apiCompiled{},
 		lockCApi: sync.Mutex{},
+		codecs:   map[string]Codec{},
+		eventBus: newEventBus(EVENT_HISTORY_SIZE_DEFAULT),
+
+		subscriptions: map[string]*subscription{},
+		cdc:           &cdc{invalidators: map[string][]CacheInvalidator{}},
 	}
+	container.registerDefaultCodecs()
 	container.setLogger(logFn) // 外部注入日志处理组件
 	return container
 }
 
-func (c *Container) RegisterAPI(capi *apiCompiled) {
+func (c *Container) RegisterAPI(capi *apiCompiled) (err error) {
 	c.lockCApi.Lock()
 	defer c.lockCApi.Unlock()
+	scripts, err := capi.containerScripts(c.sandbox)
+	if err != nil {
+		return err
+	}
+	if scripts != nil {
+		capi.setScripts(scripts)
+	}
 	methods := make([]string, 0)
 	if capi.Methods != "" {
 		methods = strings.Split(capi.Methods, ",")
@@ -34,7 +66,9 @@ func (c *Container) RegisterAPI(capi *apiCompiled) {
 	for _, method := range methods {
 		key := apiMapKey(capi.Route, method)
 		c.apis[key] = capi
+		c.apiPatterns = c.apiPatterns.add(capi.Route, key)
 	}
+	return nil
 }
 
 // 计算api map key
@@ -51,7 +85,63 @@ func (c *Container) GetCApi(route string, method string) (capi *apiCompiled, ok
 	return capi, ok
 }
 
-// SsetLogger 封装相关性——全局设置 功能
+// SetSourceResolver 设置所有api共用的运行时资源解析器(如多租户),解析出的资源按需创建并缓存
+func (c *Container) SetSourceResolver(resolver SourceResolver) {
+	c.resolvedSources = newResolvedSourcePool(resolver)
+}
+
+// EvictIdleSources 淘汰空闲超时的运行时资源
+func (c *Container) EvictIdleSources(idle time.Duration) (evicted []string) {
+	if c.resolvedSources != nil {
+		evicted = c.resolvedSources.evictIdle(idle)
+	}
+	c.lockCApi.Lock()
+	defer c.lockCApi.Unlock()
+	for _, capi := range c.apis {
+		evicted = append(evicted, capi.EvictIdleSources(idle)...)
+	}
+	return evicted
+}
+
+// StartSourceEvictor 定时淘汰空闲资源,返回停止函数
+func (c *Container) StartSourceEvictor(interval time.Duration, idle time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				c.EvictIdleSources(idle)
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// loggerWriter 日志处理函数及其所在容器
+type loggerWriter struct {
+	container *Container
+	fn        func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error)
+}
+
+// currentLoggerWriter logchan 只能设置一次日志处理函数,通过它转发到最后设置的容器;
+// 执行中产生及记录了所属容器的日志按所属容器的规则脱敏,其余(如执行外直接调用资源的 sql 日志)按最后设置的容器的规则脱敏
+var currentLoggerWriter atomic.Value
+
+// SsetLogger 封装相关性——全局设置 功能,日志按容器的脱敏规则脱敏后交给处理函数
 func (c *Container) setLogger(fn func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error)) {
-	logchan.SetLoggerWriter(fn)
+	if fn == nil {
+		return
+	}
+	currentLoggerWriter.Store(loggerWriter{container: c, fn: fn})
+	logchan.SetLoggerWriter(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {
+		writer := currentLoggerWriter.Load().(loggerWriter)
+		writer.fn(writer.container.MaskLogInfo(logInfo), typeName, err)
+	})
 }
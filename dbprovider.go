@@ -0,0 +1,364 @@
+package dataexchanger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/suifengpiao14/tengolib/util"
+)
+
+// DBConfig sql 资源配置
+type DBConfig struct {
+	DSN     string `json:"dsn"`
+	Dialect string `json:"dialect"` // mysql(默认)、postgres、sqlite
+	Driver  string `json:"driver"`  // database/sql 驱动名称,默认由方言决定,驱动需使用方自行引入
+	// StmtCacheSize 预处理语句缓存数量,0 使用默认值,小于0 不缓存
+	StmtCacheSize int `json:"stmtCacheSize"`
+}
+
+// SQLArgsExecutor 支持绑定参数执行的资源,execSQLTPL 优先使用
+type SQLArgsExecutor interface {
+	ExecOrQueryArgsContext(ctx context.Context, statement string, args ...interface{}) (out string, err error)
+}
+
+// DBProvider sql 资源提供者,按方言执行sql
+type DBProvider struct {
+	tengo.ImmutableMap
+	config    string
+	sqlDB     *sql.DB
+	dialect   Dialect
+	stmtCache *stmtCache
+	shares    int // NewDBProvider 返回的次数,全部 release 后关闭
+}
+
+var (
+	dbProviderMap  = make(map[string]*DBProvider)
+	dbProviderLock sync.Mutex
+)
+
+// NewDBProvider 相同配置共用一个连接池
+func NewDBProvider(config string) (p *DBProvider, err error) {
+	dbProviderLock.Lock()
+	defer dbProviderLock.Unlock()
+	p, ok := dbProviderMap[config]
+	if ok {
+		p.shares++
+		return p, nil
+	}
+	cfg := &DBConfig{}
+	err = json.Unmarshal([]byte(config), cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialect, err := GetDialect(cfg.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	driverName := cfg.Driver
+	if driverName == "" {
+		driverName = dialect.DriverName()
+	}
+	db, err := sql.Open(driverName, cfg.DSN)
+	if err != nil {
+		err = errors.WithMessagef(err, "sql.Open:%s", driverName)
+		return nil, err
+	}
+	p = &DBProvider{
+		ImmutableMap: tengo.ImmutableMap{
+			Value: make(map[string]tengo.Object),
+		},
+		config:  config,
+		sqlDB:   db,
+		dialect: dialect,
+		shares:  1,
+	}
+	if cfg.StmtCacheSize >= 0 {
+		capacity := cfg.StmtCacheSize
+		if capacity == 0 {
+			capacity = STMT_CACHE_SIZE_DEFAULT
+		}
+		p.stmtCache = newStmtCache(db, capacity)
+	}
+	//注入tengo 脚本方法
+	methods := map[string]tengo.CallableFunc{
+		"execOrQueryContext": p.TengoExecOrQueryContext,
+		"beginTx":            p.BeginTx,
+	}
+	for key, method := range methods {
+		p.Value[key] = &tengo.UserFunction{
+			Name:  key,
+			Value: method,
+		}
+	}
+	dbProviderMap[config] = p
+	return p, nil
+}
+
+func (p *DBProvider) TypeName() string {
+	return "db"
+}
+func (p *DBProvider) String() string {
+	return ""
+}
+
+func (p *DBProvider) GetDB() (db *sql.DB) {
+	return p.sqlDB
+}
+
+func (p *DBProvider) Dialect() Dialect {
+	return p.dialect
+}
+
+// ExecOrQueryContext 实现 tengodb.TengoDBInterface
+func (p *DBProvider) ExecOrQueryContext(ctx context.Context, sqls string) (out string, err error) {
+	return execOrQueryContext(ctx, p.sqlDB, sqls)
+}
+
+// ExecOrQueryArgsContext 实现 SQLArgsExecutor,参数通过占位符绑定,语句优先复用缓存的预处理语句
+func (p *DBProvider) ExecOrQueryArgsContext(ctx context.Context, statement string, args ...interface{}) (out string, err error) {
+	if p.stmtCache == nil {
+		return execOrQueryContext(ctx, p.sqlDB, statement, args...)
+	}
+	statement = util.StandardizeSpaces(util.TrimSpaces(statement))
+	entry, err := p.stmtCache.acquire(ctx, statement)
+	if err != nil { // 部分语句不支持预处理(如多语句),直接执行
+		return execOrQueryContext(ctx, p.sqlDB, statement, args...)
+	}
+	defer func() {
+		p.stmtCache.release(entry, err)
+	}()
+	out, err = execOrQueryContext(ctx, stmtExecutor{stmt: entry.stmt}, statement, args...)
+	return out, err
+}
+
+// Close 释放一次 NewDBProvider 获得的连接池,相同配置的其他使用方不受影响,全部关闭后才关闭连接池,
+// 每次 NewDBProvider 对应一次 Close
+func (p *DBProvider) Close() (err error) {
+	return p.release()
+}
+
+// release 释放一次 NewDBProvider 获得的引用,相同配置的使用方全部释放后关闭连接池,再次创建时重新连接
+func (p *DBProvider) release() (err error) {
+	dbProviderLock.Lock()
+	p.shares--
+	closing := p.shares <= 0
+	if closing && dbProviderMap[p.config] == p {
+		delete(dbProviderMap, p.config)
+	}
+	dbProviderLock.Unlock()
+	if !closing {
+		return nil
+	}
+	p.ResetStmtCache()
+	return p.sqlDB.Close()
+}
+
+// StmtCacheStats 预处理语句复用统计
+func (p *DBProvider) StmtCacheStats() (stats StmtCacheStats) {
+	if p.stmtCache == nil {
+		return stats
+	}
+	return p.stmtCache.getStats()
+}
+
+// ResetStmtCache 关闭并清空预处理语句,连接重置或表结构变更后调用
+func (p *DBProvider) ResetStmtCache() {
+	if p.stmtCache != nil {
+		p.stmtCache.reset()
+	}
+}
+
+func (p *DBProvider) TengoExecOrQueryContext(args ...tengo.Object) (ret tengo.Object, err error) {
+	return tengoExecOrQueryContext(p.sqlDB, args...)
+}
+
+func (p *DBProvider) BeginTx(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 1 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctxObj, ok := args[0].(*tengocontext.TengoContext)
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "context",
+			Expected: "context.Context",
+			Found:    args[0].TypeName(),
+		}
+	}
+	tx, err := p.sqlDB.BeginTx(ctxObj.Context, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newDBTx(tx), nil
+}
+
+// DBTx 脚本中使用的事务
+type DBTx struct {
+	tengo.ImmutableMap
+	sqlTx *sql.Tx
+}
+
+func newDBTx(tx *sql.Tx) (t *DBTx) {
+	t = &DBTx{
+		ImmutableMap: tengo.ImmutableMap{
+			Value: make(map[string]tengo.Object),
+		},
+		sqlTx: tx,
+	}
+	methods := map[string]tengo.CallableFunc{
+		"execOrQueryContext": func(args ...tengo.Object) (ret tengo.Object, err error) {
+			return tengoExecOrQueryContext(t.sqlTx, args...)
+		},
+		"commit": func(args ...tengo.Object) (ret tengo.Object, err error) {
+			return nil, t.sqlTx.Commit()
+		},
+		"rollback": func(args ...tengo.Object) (ret tengo.Object, err error) {
+			return nil, t.sqlTx.Rollback()
+		},
+	}
+	for key, method := range methods {
+		t.Value[key] = &tengo.UserFunction{
+			Name:  key,
+			Value: method,
+		}
+	}
+	return t
+}
+
+func (t *DBTx) TypeName() string {
+	return "db-tx"
+}
+func (t *DBTx) String() string {
+	return ""
+}
+
+func tengoExecOrQueryContext(executor tengodb.ExectorInterface, args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctxObj, ok := args[0].(*tengocontext.TengoContext)
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "context",
+			Expected: "context.Context",
+			Found:    args[0].TypeName(),
+		}
+	}
+	sqls, ok := tengo.ToString(args[1])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "sql",
+			Expected: "string",
+			Found:    args[1].TypeName(),
+		}
+	}
+	out, err := execOrQueryContext(ctxObj.Context, executor, sqls)
+	if err != nil {
+		return nil, err
+	}
+	return &tengo.String{Value: out}, nil
+}
+
+// execOrQueryContext 与 tengodb.ExecOrQueryContext 输出一致,兼容不同驱动返回的值类型,支持绑定参数
+func execOrQueryContext(ctx context.Context, executor tengodb.ExectorInterface, sqls string, args ...interface{}) (out string, err error) {
+	sqlLogInfo := &LogInfoEXECSQL{Args: args}
+	sqlLogInfo.Context = ctx
+	defer func() {
+		sqlLogInfo.Err = err
+		duration := float64(sqlLogInfo.EndAt.Sub(sqlLogInfo.BeginAt).Nanoseconds()) / 1e6
+		sqlLogInfo.Duration = fmt.Sprintf("%.3fms", duration)
+		logchan.SendLogInfo(sqlLogInfo)
+	}()
+	sqls = util.StandardizeSpaces(util.TrimSpaces(sqls)) // 格式化sql语句
+	sqlLogInfo.SQL = sqls
+	sqlLogInfo.BeginAt = time.Now().Local()
+	if tengodb.SQLType(sqls) != tengodb.SQL_TYPE_SELECT {
+		var res sql.Result
+		res, err = executor.ExecContext(ctx, sqls, args...)
+		sqlLogInfo.EndAt = time.Now().Local()
+		if err != nil {
+			return "", err
+		}
+		sqlLogInfo.AffectedRows, _ = res.RowsAffected()
+		lastInsertId, _ := res.LastInsertId()
+		if result, ok := ctx.Value(CONTEXT_KEY_EXEC_RESULT).(*execResult); ok {
+			result.captured, result.AffectedRows, result.LastInsertID = true, sqlLogInfo.AffectedRows, lastInsertId
+		}
+		if lastInsertId > 0 {
+			return strconv.FormatInt(lastInsertId, 10), nil
+		}
+		return strconv.FormatInt(sqlLogInfo.AffectedRows, 10), nil
+	}
+	rows, err := executor.QueryContext(ctx, sqls, args...)
+	sqlLogInfo.EndAt = time.Now().Local()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	allResult := make([][]map[string]string, 0)
+	for {
+		records := make([]map[string]string, 0)
+		for rows.Next() {
+			sqlLogInfo.AffectedRows++
+			record := make(map[string]interface{})
+			if err = tengodb.MapScan(rows, record); err != nil {
+				return "", err
+			}
+			recordStr := make(map[string]string, len(record))
+			for k, v := range record {
+				recordStr[k] = dbValueToString(v)
+			}
+			records = append(records, recordStr)
+		}
+		allResult = append(allResult, records)
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	var result interface{} = allResult
+	if len(allResult) == 1 { // allResult 初始值为[[]],至少有一个元素
+		records := allResult[0]
+		if len(records) == 0 { // 结果为空，返回空字符串
+			return "", nil
+		}
+		if len(records) == 1 && len(records[0]) == 1 {
+			for _, val := range records[0] {
+				return val, nil // 只有一个值时，直接返回值本身
+			}
+		}
+		result = records
+	}
+	jsonByte, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	out = string(jsonByte)
+	sqlLogInfo.Result = out
+	return out, nil
+}
+
+func dbValueToString(v interface{}) (s string) {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	case time.Time:
+		return val.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,208 @@
+package dataexchanger
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengotemplate"
+	gormLogger "gorm.io/gorm/logger"
+)
+
+const (
+	DIALECT_MYSQL    = "mysql"
+	DIALECT_POSTGRES = "postgres"
+	DIALECT_SQLITE   = "sqlite"
+
+	VOLUME_KEY_DIALECT = "__dialect" // 模板数据中记录当前资源方言的key,供模板函数使用
+)
+
+// Dialect sql 方言,负责占位符、标识符引用、分页、upsert 等差异
+type Dialect interface {
+	Name() string
+	DriverName() string // database/sql 驱动名称
+	BindType() int      // sqlx 占位符类型
+	Quote(identifier string) string
+	Limit(offsetNamed string, limitNamed string) string
+	Upsert(table string, columns []string, keys []string) string
+}
+
+type dialectMysql struct{}
+
+func (d dialectMysql) Name() string       { return DIALECT_MYSQL }
+func (d dialectMysql) DriverName() string { return "mysql" }
+func (d dialectMysql) BindType() int      { return sqlx.QUESTION }
+func (d dialectMysql) Quote(identifier string) string {
+	return quoteIdentifier(identifier, "`")
+}
+func (d dialectMysql) Limit(offsetNamed string, limitNamed string) string {
+	return fmt.Sprintf("limit :%s,:%s", offsetNamed, limitNamed)
+}
+func (d dialectMysql) Upsert(table string, columns []string, keys []string) string {
+	updates := make([]string, 0)
+	for _, column := range columns {
+		if !containsString(keys, column) {
+			updates = append(updates, fmt.Sprintf("%s=values(%s)", d.Quote(column), d.Quote(column)))
+		}
+	}
+	if len(updates) == 0 && len(keys) > 0 { // 全部是主键时,冲突后保持不变
+		updates = append(updates, fmt.Sprintf("%s=%s", d.Quote(keys[0]), d.Quote(keys[0])))
+	}
+	return fmt.Sprintf("%s on duplicate key update %s", insertSQL(d, table, columns), strings.Join(updates, ","))
+}
+
+// dialectStandard postgres、sqlite 共用的语法
+type dialectStandard struct {
+	name       string
+	driverName string
+	bindType   int
+}
+
+func (d dialectStandard) Name() string       { return d.name }
+func (d dialectStandard) DriverName() string { return d.driverName }
+func (d dialectStandard) BindType() int      { return d.bindType }
+func (d dialectStandard) Quote(identifier string) string {
+	return quoteIdentifier(identifier, `"`)
+}
+func (d dialectStandard) Limit(offsetNamed string, limitNamed string) string {
+	return fmt.Sprintf("limit :%s offset :%s", limitNamed, offsetNamed)
+}
+func (d dialectStandard) Upsert(table string, columns []string, keys []string) string {
+	updates := make([]string, 0)
+	for _, column := range columns {
+		if !containsString(keys, column) {
+			updates = append(updates, fmt.Sprintf("%s=excluded.%s", d.Quote(column), d.Quote(column)))
+		}
+	}
+	quotedKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		quotedKeys = append(quotedKeys, d.Quote(key))
+	}
+	action := "do nothing"
+	if len(updates) > 0 {
+		action = "do update set " + strings.Join(updates, ",")
+	}
+	return fmt.Sprintf("%s on conflict (%s) %s", insertSQL(d, table, columns), strings.Join(quotedKeys, ","), action)
+}
+
+var (
+	dialectMap = map[string]Dialect{
+		DIALECT_MYSQL:    dialectMysql{},
+		DIALECT_POSTGRES: dialectStandard{name: DIALECT_POSTGRES, driverName: "postgres", bindType: sqlx.DOLLAR},
+		DIALECT_SQLITE:   dialectStandard{name: DIALECT_SQLITE, driverName: "sqlite", bindType: sqlx.QUESTION},
+	}
+	dialectLock sync.RWMutex
+)
+
+// RegisterDialect 注册(或替换)方言
+func RegisterDialect(d Dialect) {
+	dialectLock.Lock()
+	defer dialectLock.Unlock()
+	dialectMap[d.Name()] = d
+}
+
+// GetDialect 获取方言,名称为空时默认 mysql
+func GetDialect(name string) (d Dialect, err error) {
+	if name == "" {
+		name = DIALECT_MYSQL
+	}
+	dialectLock.RLock()
+	defer dialectLock.RUnlock()
+	d, ok := dialectMap[strings.ToLower(name)]
+	if !ok {
+		err = errors.Errorf("not found dialect:%s", name)
+		return nil, err
+	}
+	return d, nil
+}
+
+func quoteIdentifier(identifier string, quote string) string {
+	parts := strings.Split(identifier, ".")
+	for i, part := range parts {
+		parts[i] = quote + strings.ReplaceAll(part, quote, quote+quote) + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+func insertSQL(d Dialect, table string, columns []string) string {
+	quoted := make([]string, 0, len(columns))
+	placeholders := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, d.Quote(column))
+		placeholders = append(placeholders, ":"+column)
+	}
+	return fmt.Sprintf("insert into %s (%s) values (%s)", d.Quote(table), strings.Join(quoted, ","), strings.Join(placeholders, ","))
+}
+
+func containsString(arr []string, s string) bool {
+	for _, item := range arr {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func splitColumns(s string) (columns []string) {
+	for _, column := range strings.Split(s, ",") {
+		column = strings.TrimSpace(column)
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// volumeDialect 获取模板数据中记录的方言
+func volumeDialect(volume tengotemplate.VolumeInterface) (d Dialect) {
+	var name string
+	volume.GetValue(VOLUME_KEY_DIALECT, &name)
+	d, err := GetDialect(name)
+	if err != nil {
+		d = dialectMysql{}
+	}
+	return d
+}
+
+// TemplatefuncMapDialect 方言相关模板函数,如 {{quoteIdentifier . "order"}}、{{limitOffset .}}、{{upsert . "user" "id,name" "id"}}
+var TemplatefuncMapDialect = template.FuncMap{
+	"quoteIdentifier": func(volume tengotemplate.VolumeInterface, identifier string) string {
+		return volumeDialect(volume).Quote(identifier)
+	},
+	"limitOffset": func(volume tengotemplate.VolumeInterface) string {
+		return volumeDialect(volume).Limit(PAGINATE_VAR_OFFSET, PAGINATE_VAR_LIMIT)
+	},
+	"upsert": func(volume tengotemplate.VolumeInterface, table string, columns string, keys string) string {
+		return volumeDialect(volume).Upsert(table, splitColumns(columns), splitColumns(keys))
+	},
+}
+
+func init() {
+	tengotemplate.TemplateFuncMap = append(tengotemplate.TemplateFuncMap, TemplatefuncMapDialect)
+}
+
+var numericPlaceholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// toStatement 将命名参数sql按方言转换为占位符语句和有序参数
+func toStatement(d Dialect, named string, data map[string]interface{}) (statement string, args []interface{}, err error) {
+	statement, args, err = sqlx.Named(named, data)
+	if err != nil {
+		err = errors.WithStack(err)
+		return "", nil, err
+	}
+	statement = sqlx.Rebind(d.BindType(), statement)
+	return statement, args, nil
+}
+
+// explainSQL 将参数填充到语句中,用于不支持绑定参数的资源(如内存数据库)
+func explainSQL(d Dialect, statement string, args []interface{}) (sqlStr string) {
+	var numericPlaceholder *regexp.Regexp
+	if d.BindType() == sqlx.DOLLAR {
+		numericPlaceholder = numericPlaceholderRegexp
+	}
+	return gormLogger.ExplainSQL(statement, numericPlaceholder, `'`, args...)
+}
@@ -0,0 +1,110 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/tidwall/gjson"
+	_ "modernc.org/sqlite"
+)
+
+func TestDialectSQLite(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "dialect.db"))
+	source, err := dataexchanger.MakeSource("sqlite", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = provider.ExecOrQueryContext(ctx, `create table component (id integer primary key, title text)`); err != nil {
+		t.Fatal(err)
+	}
+	tplStr := `
+	{{define "Save"}}{{upsert . "component" "id,title" "id"}}{{end}}
+	{{define "List"}}select {{quoteIdentifier . "id"}},{{quoteIdentifier . "title"}} from {{quoteIdentifier . "component"}} order by id{{end}}
+	`
+	newAPI := func(api *dataexchanger.DtoAPI) func(input string) string {
+		capi, err := dataexchanger.NewApiCompiled(api)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = capi.RegisterSource(source); err != nil {
+			t.Fatal(err)
+		}
+		if err = capi.SetTemplateDependSource(capi.RegisterTemplate("", tplStr), "sqlite"); err != nil {
+			t.Fatal(err)
+		}
+		return func(input string) string {
+			out, err := capi.Run(ctx, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return out
+		}
+	}
+	save := newAPI(&dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/component/save",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number,required
+		fullname=title,dst=title,required`,
+		MainScript: `execSQLTPL(storage.GetCtx(),"Save",storage.GetMemory())`,
+	})
+	save(`{"id":"1","title":"pay"}`)
+	save(`{"id":"2","title":"fsm"}`)
+	save(`{"id":"3","title":"x'); drop table component;--"}`) // 参数绑定,不会被当作sql执行
+	save(`{"id":"1","title":"payment"}`)                      // 冲突时更新
+	list := newAPI(&dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/component/list",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=pageIndex,dst=pageIndex,format=number
+		fullname=pageSize,dst=pageSize,format=number`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=items[].title,src=paginate.items.#.title,required
+		fullname=pageInfo,src=paginate.pageInfo,type=object,required`,
+		Paginate: &dataexchanger.DtoPaginate{Template: "List"},
+	})
+	out := list(`{"pageIndex":"0","pageSize":"1"}`)
+	if got := gjson.Get(out, "[items.#.title,pageInfo.total]").Raw; got != `[["payment"],3]` {
+		t.Errorf("got:%s", out)
+	}
+	out = list(`{"pageIndex":"1","pageSize":"1"}`)
+	if got := gjson.Get(out, "items.#.title").Raw; got != `["fsm"]` {
+		t.Errorf("got:%s", out)
+	}
+	out = list(`{"pageIndex":"2","pageSize":"1"}`)
+	if got := gjson.Get(out, "items.0.title").String(); got != "x'); drop table component;--" {
+		t.Errorf("got:%s", out)
+	}
+	stats := provider.StmtCacheStats()
+	if stats.Hits == 0 || stats.Size == 0 { // 相同语句复用预处理语句
+		t.Errorf("stmt cache not reused:%#v", stats)
+	}
+	provider.ResetStmtCache()
+	if stats = provider.StmtCacheStats(); stats.Size != 0 {
+		t.Errorf("stmt cache not reset:%#v", stats)
+	}
+}
+
+func TestDialectUpsert(t *testing.T) {
+	cases := map[string]string{
+		dataexchanger.DIALECT_MYSQL:    "insert into `user` (`id`,`name`) values (:id,:name) on duplicate key update `name`=values(`name`)",
+		dataexchanger.DIALECT_POSTGRES: `insert into "user" ("id","name") values (:id,:name) on conflict ("id") do update set "name"=excluded."name"`,
+	}
+	for name, want := range cases {
+		d, err := dataexchanger.GetDialect(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Upsert("user", []string{"id", "name"}, []string{"id"}); got != want {
+			t.Errorf("%s want:%s\ngot: %s", name, want, got)
+		}
+	}
+}
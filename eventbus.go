@@ -0,0 +1,230 @@
+package dataexchanger
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	EVENT_HISTORY_SIZE_DEFAULT = 1024 // 保留的历史事件数量,用于断线重连补发
+	EVENT_SUBSCRIBER_BUFFER    = 64   // 订阅者缓冲,写满后断开慢订阅者(可凭最后事件ID重连补发)
+)
+
+// Event 数据变更事件
+type Event struct {
+	ID        string    `json:"id"` // 单调递增
+	Topic     string    `json:"topic"`
+	Data      string    `json:"data"` // json
+	CreatedAt time.Time `json:"createdAt"`
+	seq       uint64
+}
+
+type eventSubscriber struct {
+	topic  string
+	events chan Event
+	closed bool
+}
+
+// eventBus 容器内的事件总线,按主题发布、订阅,保留最近的事件用于补发
+type eventBus struct {
+	lock        sync.Mutex
+	seq         uint64
+	history     []Event
+	historySize int
+	subscribers map[*eventSubscriber]bool
+}
+
+func newEventBus(historySize int) *eventBus {
+	if historySize <= 0 {
+		historySize = EVENT_HISTORY_SIZE_DEFAULT
+	}
+	return &eventBus{
+		historySize: historySize,
+		subscribers: make(map[*eventSubscriber]bool),
+	}
+}
+
+func (b *eventBus) publish(topic string, data string) (event Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.seq++
+	event = Event{
+		ID:        strconv.FormatUint(b.seq, 10),
+		Topic:     topic,
+		Data:      data,
+		CreatedAt: time.Now().Local(),
+		seq:       b.seq,
+	}
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = append(b.history[:0:0], b.history[len(b.history)-b.historySize:]...)
+	}
+	for sub := range b.subscribers {
+		if sub.topic != topic {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default: // 慢订阅者断开
+			b.closeSubscriber(sub)
+		}
+	}
+	return event
+}
+
+// subscribe 订阅主题,返回订阅时的最新序号;lastEventID 不为空时返回其后的历史事件(超出保留范围的事件无法补发),
+// lastEventID 大于最新序号(如重启后序号重置)时返回全部历史事件
+func (b *eventBus) subscribe(topic string, lastEventID string) (sub *eventSubscriber, missed []Event, seq uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sub = &eventSubscriber{topic: topic, events: make(chan Event, EVENT_SUBSCRIBER_BUFFER)}
+	b.subscribers[sub] = true
+	if lastEventID == "" {
+		return sub, nil, b.seq
+	}
+	lastSeq, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return sub, nil, b.seq
+	}
+	if lastSeq > b.seq {
+		lastSeq = 0
+	}
+	for _, event := range b.history {
+		if event.seq > lastSeq && event.Topic == topic {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, b.seq
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closeSubscriber(sub)
+}
+
+// closeSubscriber 调用方需持有锁
+func (b *eventBus) closeSubscriber(sub *eventSubscriber) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// Publish 发布事件到容器事件总线
+func (c *Container) Publish(topic string, data string) (event Event) {
+	return c.eventBus.publish(topic, data)
+}
+
+// templateTopic 模板写操作发布的主题及事件中包含的模板入参字段
+type templateTopic struct {
+	topic  string
+	fields []string
+}
+
+// SetTemplateTopic 设置模板写操作影响的主题,本次执行成功后发布事件,
+// 事件数据仅包含 fields 声明的模板入参(gjson 路径),并按敏感字段、输出脱敏声明脱敏,未声明字段时事件数据为空对象
+func (capi *apiCompiled) SetTemplateTopic(templateIdentifers []string, topic string, fields ...string) {
+	for _, tplName := range templateIdentifers {
+		capi.topics[tplName] = templateTopic{topic: topic, fields: fields}
+	}
+}
+
+// publish 发布事件,Run 内的事件在执行成功后才发布
+func (capi *apiCompiled) publish(ctx context.Context, topic string, data string) {
+	if capi._container == nil {
+		return
+	}
+	if state := getRunState(ctx); state != nil && !state.addEvent(topic, data) {
+		return
+	}
+	capi._container.Publish(topic, data)
+}
+
+// releaseEvents 执行成功后发布暂存的事件
+func (capi *apiCompiled) releaseEvents(state *runState) {
+	for _, event := range state.releaseEvents() {
+		if capi._container != nil {
+			capi._container.Publish(event.Topic, event.Data)
+		}
+	}
+}
+
+// publishTemplateEvent 模板写操作后发布事件
+func (capi *apiCompiled) publishTemplateEvent(ctx context.Context, tplName string, data map[string]interface{}) {
+	tplTopic, ok := capi.topics[tplName]
+	if !ok || capi._container == nil {
+		return
+	}
+	capi.publish(ctx, tplTopic.topic, capi.templateEventData(ctx, tplTopic.fields, data))
+}
+
+// templateEventData 事件广播给所有订阅者,只保留声明的字段,敏感字段及输出声明了 mask 的字段一律脱敏(不区分订阅者权限)
+func (capi *apiCompiled) templateEventData(ctx context.Context, fields []string, data map[string]interface{}) (eventData string) {
+	eventData = "{}"
+	if len(fields) == 0 {
+		return eventData
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return eventData
+	}
+	for _, field := range fields {
+		value := gjson.GetBytes(b, field)
+		if !value.Exists() {
+			continue
+		}
+		if eventData, err = sjson.SetRaw(eventData, field, value.Raw); err != nil {
+			return "{}"
+		}
+	}
+	var masker *logMasker
+	if state := getRunState(ctx); state != nil && state.logMasker != nil {
+		masker = state.logMasker.fork()
+	} else {
+		masker = capi.newRunLogMasker()
+	}
+	for _, mask := range capi.masks {
+		masker.addKey(lastPathKey(mask.Fullname), mask.masker)
+	}
+	return masker.maskPayload(eventData)
+}
+
+// TengoPublish 注入到tengo脚本 publish(ctx, topic, data)
+func (capi *apiCompiled) TengoPublish(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 3 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctxObj, ok := args[0].(*tengocontext.TengoContext)
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{Name: "context", Expected: "context", Found: args[0].TypeName()}
+	}
+	topic, ok := tengo.ToString(args[1])
+	if !ok || topic == "" {
+		return nil, tengo.ErrInvalidArgumentType{Name: "topic", Expected: "string", Found: args[1].TypeName()}
+	}
+	data := ""
+	if str, ok := args[2].(*tengo.String); ok {
+		data = str.Value
+	} else {
+		b, err := json.Marshal(tengo.ToInterface(args[2]))
+		if err != nil {
+			err = errors.WithMessage(err, "publish data")
+			return nil, err
+		}
+		data = string(b)
+	}
+	capi.publish(ctxObj.Context, topic, data)
+	return tengo.UndefinedValue, nil
+}
@@ -3,15 +3,52 @@ package dataexchanger
 import "github.com/suifengpiao14/tengolib/tengosource"
 
 const (
-	PROVIDER_SQL_MEMORY = tengosource.PROVIDER_SQL_MEMORY
-	PROVIDER_SQL        = tengosource.PROVIDER_SQL
-	PROVIDER_CURL       = tengosource.PROVIDER_CURL
-	PROVIDER_BIN        = tengosource.PROVIDER_BIN
-	PROVIDER_REDIS      = tengosource.PROVIDER_REDIS
-	PROVIDER_RABBITMQ   = tengosource.PROVIDER_RABBITMQ
+	PROVIDER_SQL_MEMORY    = tengosource.PROVIDER_SQL_MEMORY
+	PROVIDER_SQL           = tengosource.PROVIDER_SQL
+	PROVIDER_CURL          = tengosource.PROVIDER_CURL
+	PROVIDER_BIN           = tengosource.PROVIDER_BIN
+	PROVIDER_REDIS         = tengosource.PROVIDER_REDIS
+	PROVIDER_RABBITMQ      = tengosource.PROVIDER_RABBITMQ
+	PROVIDER_SQL_REPLICA   = "SQL_REPLICA"   // 一主多从读写分离
+	PROVIDER_MEMORY_BROKER = "MEMORY_BROKER" // 内存消息代理,测试时替代 rabbitmq、redis
 )
 
-//MakeSource 简单封装，隐藏包依赖细节
+//MakeSource 简单封装，隐藏包依赖细节，sql 资源按配置中的方言(dialect)创建
 func MakeSource(identifer string, typ string, config string) (s tengosource.Source, err error) {
-	return tengosource.MakeSource(identifer, typ, config)
+	s = tengosource.Source{
+		Identifer: identifer,
+		Type:      typ,
+		Config:    config,
+	}
+	switch typ {
+	case PROVIDER_SQL:
+		provider, err := NewDBProvider(config)
+		if err != nil {
+			return s, err
+		}
+		s.SetProvider(provider)
+	case PROVIDER_SQL_REPLICA:
+		provider, err := NewReplicaDBProvider(config)
+		if err != nil {
+			return s, err
+		}
+		s.SetProvider(provider)
+	case PROVIDER_RABBITMQ:
+		provider, err := NewRabbitMQProvider(config)
+		if err != nil {
+			return s, err
+		}
+		s.SetProvider(provider)
+	case PROVIDER_REDIS:
+		provider, err := NewRedisProvider(config)
+		if err != nil {
+			return s, err
+		}
+		s.SetProvider(provider)
+	case PROVIDER_MEMORY_BROKER:
+		s.SetProvider(NewMemoryBroker())
+	default:
+		return tengosource.MakeSource(identifer, typ, config)
+	}
+	return s, nil
 }
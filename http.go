@@ -0,0 +1,425 @@
+package dataexchanger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/jsonschemaline"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	INPUT_IN_BODY   = "body"
+	INPUT_IN_QUERY  = "query"
+	INPUT_IN_PATH   = "path"
+	INPUT_IN_HEADER = "header"
+	INPUT_IN_COOKIE = "cookie"
+
+	LINE_SCHEMA_KEY_IN   = "in"   // 输入行 schema 字段来源,默认 body
+	LINE_SCHEMA_KEY_NAME = "name" // 来源中的名称(如 header 名),默认 fullname
+
+	HTTP_MAX_BODY_BYTES_DEFAULT = 10 << 20 // 请求体大小上限默认 10MB
+	HTTP_ERROR_INTERNAL         = "internal server error"
+
+	CONTEXT_KEY_HTTP_METHOD = ContextKeyType("httpMethod") // 请求方法
+)
+
+// inputLocation 输入字段来源
+type inputLocation struct {
+	Fullname string
+	In       string
+	Name     string
+}
+
+// parseInputLocations 解析输入行 schema 中的 in、name 属性
+func parseInputLocations(l *jsonschemaline.Jsonschemaline) (locations []inputLocation, err error) {
+	for _, item := range l.Items {
+		location := inputLocation{Fullname: item.Fullname, In: INPUT_IN_BODY, Name: item.Fullname}
+		for _, kv := range item.TagLineKVpair {
+			switch kv.Key {
+			case LINE_SCHEMA_KEY_IN:
+				location.In = strings.ToLower(kv.Value)
+			case LINE_SCHEMA_KEY_NAME:
+				location.Name = kv.Value
+			}
+		}
+		switch location.In {
+		case INPUT_IN_BODY, INPUT_IN_QUERY, INPUT_IN_PATH, INPUT_IN_HEADER, INPUT_IN_COOKIE:
+		default:
+			err = errors.Errorf("input line schema in want body/query/path/header/cookie,got:%s,fullname:%s", location.In, item.Fullname)
+			return nil, err
+		}
+		if location.In != INPUT_IN_BODY && strings.Contains(location.Fullname, "[]") {
+			err = errors.Errorf("input line schema in=%s not support array item,fullname:%s", location.In, item.Fullname)
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// schemaWithInputLocations 在 json schema 属性中标记字段来源
+func schemaWithInputLocations(schema []byte, locations []inputLocation) (out []byte, err error) {
+	out = schema
+	for _, location := range locations {
+		if strings.Contains(location.Fullname, "[]") {
+			continue
+		}
+		segments := strings.Split(location.Fullname, ".")
+		paths := make([]string, 0, len(segments)*2)
+		for _, segment := range segments {
+			paths = append(paths, "properties", escapePathKey(segment))
+		}
+		path := strings.Join(paths, ".")
+		if !gjson.GetBytes(out, path).Exists() {
+			continue
+		}
+		if out, err = sjson.SetBytes(out, path+"."+LINE_SCHEMA_KEY_IN, location.In); err != nil {
+			return nil, err
+		}
+		if location.Name != location.Fullname {
+			if out, err = sjson.SetBytes(out, path+"."+LINE_SCHEMA_KEY_NAME, location.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// InputJsonSchema 输入 json schema(含字段来源)
+func (capi *apiCompiled) InputJsonSchema() string {
+	return capi.inputJsonSchema
+}
+
+// AssembleHTTPInput 按输入行 schema 的字段来源,将 json body、query、path、header、cookie 组装成一个输入 json,
+// body 中缺失的字段从 query 中获取(便于 GET 请求),非 body 来源的字段忽略 body 中的同名字段
+func (capi *apiCompiled) AssembleHTTPInput(r *http.Request, pathParams map[string]string) (inputJson string, err error) {
+	return capi.assembleHTTPInput(r, &JsonCodec{}, pathParams)
+}
+
+// assembleHTTPInput 使用 codec 解码 body 后组装输入
+func (capi *apiCompiled) assembleHTTPInput(r *http.Request, codec Codec, pathParams map[string]string) (inputJson string, err error) {
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.AssembleHTTPInput.ReadBody,route:%s", capi.Route)
+			return "", bodyReadError(err)
+		}
+	}
+	inputJson = "{}"
+	if len(bytes.TrimSpace(body)) > 0 {
+		inputJson, err = codec.Decode(body)
+		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.AssembleHTTPInput.Decode,route:%s,mediaType:%s", capi.Route, codec.MediaType())
+			return "", NewStatusError(http.StatusBadRequest, err)
+		}
+	}
+	query := r.URL.Query()
+	for _, location := range capi.inputLocations {
+		value, ok := "", false
+		if location.In == INPUT_IN_BODY {
+			if gjson.Get(inputJson, location.Fullname).Exists() {
+				continue
+			}
+			if _, ok = query[location.Name]; ok {
+				value = query.Get(location.Name)
+			}
+		} else {
+			value, ok = httpInputValue(r, query, location, pathParams)
+		}
+		if location.In != INPUT_IN_BODY {
+			if inputJson, err = sjson.Delete(inputJson, location.Fullname); err != nil {
+				return "", err
+			}
+		}
+		if !ok {
+			continue
+		}
+		inputJson, err = sjson.Set(inputJson, location.Fullname, value)
+		if err != nil {
+			err = errors.WithMessagef(err, "apiCompiled.AssembleHTTPInput,route:%s,fullname:%s", capi.Route, location.Fullname)
+			return "", err
+		}
+	}
+	return inputJson, nil
+}
+
+// httpInputValue 获取 query、path、header、cookie 来源的字段值
+func httpInputValue(r *http.Request, query url.Values, location inputLocation, pathParams map[string]string) (value string, ok bool) {
+	switch location.In {
+	case INPUT_IN_QUERY:
+		if _, ok = query[location.Name]; ok {
+			value = query.Get(location.Name)
+		}
+	case INPUT_IN_PATH:
+		value, ok = pathParams[location.Name]
+	case INPUT_IN_HEADER:
+		if values := r.Header.Values(location.Name); len(values) > 0 {
+			value, ok = values[0], true
+		}
+	case INPUT_IN_COOKIE:
+		if cookie, err := r.Cookie(location.Name); err == nil {
+			value, ok = cookie.Value, true
+		}
+	}
+	return value, ok
+}
+
+// StatusError 带 http 状态码的错误
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func NewStatusError(status int, err error) error {
+	return &StatusError{Status: status, Err: err}
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatus 获取错误对应的 http 状态码,默认 500
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// matchRoute 匹配路由,支持 /api/items/{id} 形式的路径参数
+func matchRoute(pattern string, path string) (params map[string]string, ok bool) {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternSegments) != len(pathSegments) {
+		return nil, false
+	}
+	params = make(map[string]string)
+	for i, segment := range patternSegments {
+		if isPathParam(segment) {
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = pathSegments[i]
+			continue
+		}
+		if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func isPathParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// patternRoute 带路径参数的路由
+type patternRoute struct {
+	route string
+	key   string // 路由表中的key
+}
+
+// routePatterns 带路径参数的路由,按具体程度(同一位置静态段优先于参数段)、注册顺序排列,多个路由匹配时结果确定
+type routePatterns []patternRoute
+
+// add 添加路由,key 已存在时保持原位置
+func (patterns routePatterns) add(route string, key string) routePatterns {
+	if !strings.Contains(route, "{") {
+		return patterns
+	}
+	for _, p := range patterns {
+		if p.key == key {
+			return patterns
+		}
+	}
+	patterns = append(patterns, patternRoute{route: route, key: key})
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return routeMoreSpecific(patterns[i].route, patterns[j].route)
+	})
+	return patterns
+}
+
+// routeMoreSpecific 逐段比较,首个不同的位置上静态段优先,各段类型相同时段数少的优先
+func routeMoreSpecific(a string, b string) bool {
+	aSegments := strings.Split(strings.Trim(a, "/"), "/")
+	bSegments := strings.Split(strings.Trim(b, "/"), "/")
+	for i := 0; i < len(aSegments) && i < len(bSegments); i++ {
+		aParam, bParam := isPathParam(aSegments[i]), isPathParam(bSegments[i])
+		if aParam != bParam {
+			return !aParam
+		}
+	}
+	return len(aSegments) < len(bSegments)
+}
+
+// MatchCApi 按请求路径匹配api,精确匹配优先,其次按具体程度、注册顺序匹配带路径参数的路由
+func (c *Container) MatchCApi(path string, method string) (capi *apiCompiled, pathParams map[string]string, ok bool) {
+	if capi, ok = c.GetCApi(path, method); ok {
+		return capi, map[string]string{}, true
+	}
+	c.lockCApi.Lock()
+	defer c.lockCApi.Unlock()
+	for _, p := range c.apiPatterns {
+		if p.key != apiMapKey(p.route, method) {
+			continue
+		}
+		if pathParams, ok = matchRoute(p.route, path); ok {
+			return c.apis[p.key], pathParams, true
+		}
+	}
+	return nil, nil, false
+}
+
+// ServeHTTP 实现 http.Handler,按 Content-Type 解码、组装输入后执行api,按 Accept 编码输出,流式api逐行输出,
+// 订阅路由推送事件,执行前通过注册的认证器将调用方身份放入上下文,请求头中的链路ID一并放入
+func (c *Container) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if maxBodyBytes := c.getMaxBodyBytes(); r.Body != nil && maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	}
+	principal, err := c.authenticate(r)
+	if err != nil {
+		writeHTTPError(w, r, err)
+		return
+	}
+	ctx := r.Context()
+	if principal != nil {
+		ctx = WithPrincipal(ctx, principal)
+	}
+	if traceID := r.Header.Get(HTTP_HEADER_TRACE_ID); traceID != "" {
+		ctx = WithTraceID(ctx, traceID)
+	}
+	ctx = context.WithValue(ctx, CONTEXT_KEY_HTTP_METHOD, r.Method)
+	r = r.WithContext(ctx)
+	if r.Method == http.MethodGet {
+		if sub, pathParams, ok := c.matchSubscription(r.URL.Path); ok {
+			c.serveSubscription(w, r, sub, pathParams)
+			return
+		}
+	}
+	capi, pathParams, ok := c.MatchCApi(r.URL.Path, r.Method)
+	if !ok {
+		writeHTTPError(w, r, NewStatusError(http.StatusNotFound, errors.Errorf("api not found,route:%s,method:%s", r.URL.Path, r.Method)))
+		return
+	}
+	requestCodec, err := c.requestCodec(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeHTTPError(w, r, NewStatusError(http.StatusUnsupportedMediaType, err))
+		return
+	}
+	if capi.IsStream() {
+		inputJson, err := capi.assembleHTTPInput(r, requestCodec, pathParams)
+		if err != nil {
+			writeHTTPError(w, r, err)
+			return
+		}
+		capi.serveStream(w, r, inputJson)
+		return
+	}
+	responseCodec, err := c.responseCodec(r.Header.Get("Accept"))
+	if err != nil {
+		writeHTTPError(w, r, NewStatusError(http.StatusNotAcceptable, err))
+		return
+	}
+	inputJson, err := capi.assembleHTTPInput(r, requestCodec, pathParams)
+	if err != nil {
+		writeHTTPError(w, r, err)
+		return
+	}
+	out, err := capi.Run(r.Context(), inputJson)
+	if err != nil {
+		writeHTTPError(w, r, err)
+		return
+	}
+	body, err := responseCodec.Encode(out, capi.outputLineSchema)
+	if err != nil {
+		err = errors.WithMessagef(err, "Container.ServeHTTP.Encode,route:%s,mediaType:%s", capi.Route, responseCodec.MediaType())
+		writeHTTPError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", responseCodec.MediaType())
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// writeHTTPError 输出错误,5xx 错误只返回通用信息和错误ID,详情(可能含 sql、驱动错误)记录到日志
+func writeHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	status := HTTPStatus(err)
+	body, _ := sjson.Set(`{}`, "error", err.Error())
+	if status >= http.StatusInternalServerError {
+		logInfo := LogInfoHTTPError{
+			Context: r.Context(),
+			ErrorID: newMessageID(),
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Status:  status,
+			Err:     err,
+		}
+		logchan.SendLogInfo(&logInfo)
+		body, _ = sjson.Set(`{}`, "error", HTTP_ERROR_INTERNAL)
+		body, _ = sjson.Set(body, "errorId", logInfo.ErrorID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// LogInfoHTTPError http 5xx 错误日志,响应中的 errorId 与之对应
+type LogInfoHTTPError struct {
+	Context context.Context `json:"context"`
+	ErrorID string          `json:"errorId"`
+	Method  string          `json:"method"`
+	Path    string          `json:"path"`
+	Status  int             `json:"status"`
+	Err     error
+	logchan.EmptyLogInfo
+}
+
+func (l LogInfoHTTPError) GetName() logchan.LogName {
+	return LogName(LOG_INFO_HTTP_ERROR)
+}
+
+func (l LogInfoHTTPError) Error() error {
+	return l.Err
+}
+
+// SetMaxBodyBytes 设置请求体大小上限,0 使用默认值,小于 0 不限制
+func (c *Container) SetMaxBodyBytes(n int64) {
+	c.lockCApi.Lock()
+	defer c.lockCApi.Unlock()
+	c.maxBodyBytes = n
+}
+
+func (c *Container) getMaxBodyBytes() (n int64) {
+	c.lockCApi.Lock()
+	defer c.lockCApi.Unlock()
+	if c.maxBodyBytes == 0 {
+		return HTTP_MAX_BODY_BYTES_DEFAULT
+	}
+	return c.maxBodyBytes
+}
+
+// bodyReadError 请求体超过上限时返回 413
+func bodyReadError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "request body too large") { // http.MaxBytesReader 的错误
+		return NewStatusError(http.StatusRequestEntityTooLarge, err)
+	}
+	return err
+}
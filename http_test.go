@@ -0,0 +1,165 @@
+package dataexchanger_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestServeHTTPInputLocation(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "POST",
+		Route:   "/api/items/{id}",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number,in=path,required
+		fullname=userId,dst=userId,in=header,name=X-User-Id,required
+		fullname=locale,dst=locale,in=cookie,default=en
+		fullname=keyword,dst=keyword,in=query
+		fullname=title,dst=title,required`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=id,src=input.id,required
+		fullname=userId,src=input.userId,required
+		fullname=locale,src=input.locale,required
+		fullname=keyword,src=input.keyword,required
+		fullname=title,src=input.title,required`,
+		MainScript: `return`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := capi.InputJsonSchema()
+	if got := gjson.Get(schema, "properties.userId.[in,name]").Raw; got != `["header","X-User-Id"]` {
+		t.Errorf("schema userId location got:%s", got)
+	}
+	if got := gjson.Get(schema, "properties.title.in").String(); got != dataexchanger.INPUT_IN_BODY {
+		t.Errorf("schema title location got:%s", got)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/items/12?keyword=go", strings.NewReader(`{"title":"hello","userId":"body"}`))
+	req.Header.Set("X-User-Id", "7")
+	req.AddCookie(&http.Cookie{Name: "locale", Value: "zh"})
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status 200,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	want := `["12","7","zh","go","hello"]`
+	if got := gjson.Get(rec.Body.String(), "[id,userId,locale,keyword,title]").Raw; got != want {
+		t.Errorf("want:%s\ngot: %s", want, got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/items/12", strings.NewReader(`{"title":"hello"}`))
+	rec = httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("missing header want status 400,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/items/12", nil)
+	rec = httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("method not registered want status 404,got:%d", rec.Code)
+	}
+}
+
+func TestServeHTTPRoutePrecedence(t *testing.T) {
+	routes := []string{"/{kind}/{id}", "/users/{id}", "/users/{id}/orders", "/users/me"}
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}} {
+		container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+		for _, i := range order {
+			capi, err := dataexchanger.NewApiCompiled(&dataexchanger.DtoAPI{Methods: "GET", Route: routes[i]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = container.RegisterAPI(capi); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cases := map[string]string{
+			"/users/1":        "/users/{id}",
+			"/orders/1":       "/{kind}/{id}",
+			"/users/1/orders": "/users/{id}/orders",
+			"/users/me":       "/users/me",
+		}
+		for i := 0; i < 20; i++ { // 多次匹配结果一致
+			for path, want := range cases {
+				got := ""
+				if capi, _, ok := container.MatchCApi(path, http.MethodGet); ok {
+					got = capi.Route
+				}
+				if got != want {
+					t.Fatalf("register order %v path %s want route %s,got:%s", order, path, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestServeHTTPErrorAndBodyLimit(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "POST",
+		Route:   "/api/fail",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=title,dst=title`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=title,src=input.title`,
+		MainScript: `secret := "password"
+		secret()`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := make(chan string, 10)
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {
+		if info, ok := logInfo.(*dataexchanger.LogInfoHTTPError); ok {
+			logged <- info.ErrorID
+		}
+	})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/fail", strings.NewReader(`{"title":"hello"}`))
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("want status 500,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if got := gjson.Get(body, "error").String(); got != dataexchanger.HTTP_ERROR_INTERNAL || strings.Contains(body, "secret") {
+		t.Errorf("5xx error detail leaked:%s", body)
+	}
+	errorID := gjson.Get(body, "errorId").String()
+	if errorID == "" {
+		t.Fatalf("5xx response want errorId,got:%s", body)
+	}
+	select {
+	case got := <-logged:
+		if got != errorID {
+			t.Errorf("logged errorId want:%s,got:%s", errorID, got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("5xx error detail not logged")
+	}
+
+	container.SetMaxBodyBytes(16)
+	req = httptest.NewRequest(http.MethodPost, "/api/fail", strings.NewReader(`{"title":"`+strings.Repeat("a", 64)+`"}`))
+	rec = httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body want status 413,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+}
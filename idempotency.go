@@ -0,0 +1,398 @@
+package dataexchanger
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	IDEMPOTENCY_TABLE_DEFAULT = "dataexchanger_idempotency"
+	IDEMPOTENCY_TTL_DEFAULT   = 24 * 60 * 60 // 秒
+
+	IDEMPOTENCY_STATUS_PROCESSING = 0 // 执行中
+	IDEMPOTENCY_STATUS_DONE       = 1 // 已完成,保存了输出
+
+	IDEMPOTENCY_REDIS_KEY_PREFIX = "dataexchanger:idempotency:"
+
+	IDEMPOTENCY_MEMORY_SWEEP_INTERVAL = time.Minute // 进程内存储清理过期记录的间隔
+)
+
+// ErrIdempotencyConflict 相同幂等键的输入不一致或上一次请求仍在执行
+var ErrIdempotencyConflict = errors.New("idempotency key conflict")
+
+// DtoIdempotency 幂等声明,相同幂等键、相同输入的重复请求直接返回保存的输出
+type DtoIdempotency struct {
+	Key    string `json:"key"`    // 幂等键在输入中的路径,来自请求头时在 inputLineSchema 中声明 in=header
+	Source string `json:"source"` // 存储资源标识(sql、redis),为空时使用进程内存储
+	Table  string `json:"table"`  // sql 存储表名,默认 dataexchanger_idempotency
+	TTL    int    `json:"ttl"`    // 保存时长(秒),默认 1 天
+}
+
+func (dto DtoIdempotency) validate() (err error) {
+	if dto.Key == "" {
+		err = errors.New("idempotency key required")
+		return err
+	}
+	return nil
+}
+
+// IdempotencyRecord 幂等记录
+type IdempotencyRecord struct {
+	Key       string `json:"key"`
+	InputHash string `json:"inputHash"`
+	Status    int    `json:"status"`
+	Output    string `json:"output"`
+}
+
+// IdempotencyStore 幂等记录存储
+type IdempotencyStore interface {
+	// Reserve 占用幂等键,已存在未过期的记录时 reserved 为 false 并返回该记录
+	Reserve(ctx context.Context, key string, inputHash string, ttl time.Duration) (record *IdempotencyRecord, reserved bool, err error)
+	// Complete 保存输出
+	Complete(ctx context.Context, key string, output string, ttl time.Duration) (err error)
+	// Release 执行失败时删除记录,允许重试
+	Release(ctx context.Context, key string) (err error)
+}
+
+// inputHash 输入摘要,重新序列化以忽略字段顺序
+func inputHash(inputJson string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(inputJson), &v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			inputJson = string(b)
+		}
+	}
+	sum := sha256.Sum256([]byte(inputJson))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryIdempotencyStore 进程内幂等存储,占用时按间隔清理过期记录
+type MemoryIdempotencyStore struct {
+	SweepInterval time.Duration // 清理间隔,默认 1 分钟
+	records       map[string]memoryIdempotencyRecord
+	sweptAt       time.Time
+	lock          sync.Mutex
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	expireAt time.Time
+}
+
+func NewMemoryIdempotencyStore() (s *MemoryIdempotencyStore) {
+	return &MemoryIdempotencyStore{records: make(map[string]memoryIdempotencyRecord)}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key string, inputHash string, ttl time.Duration) (record *IdempotencyRecord, reserved bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	interval := s.SweepInterval
+	if interval <= 0 {
+		interval = IDEMPOTENCY_MEMORY_SWEEP_INTERVAL
+	}
+	if now.Sub(s.sweptAt) >= interval {
+		s.sweep(now)
+	}
+	if existing, ok := s.records[key]; ok && now.Before(existing.expireAt) {
+		record := existing.IdempotencyRecord
+		return &record, false, nil
+	}
+	s.records[key] = memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Key: key, InputHash: inputHash, Status: IDEMPOTENCY_STATUS_PROCESSING},
+		expireAt:          now.Add(ttl),
+	}
+	return nil, true, nil
+}
+
+// sweep 删除过期记录,调用方需持有锁
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	s.sweptAt = now
+	for key, record := range s.records {
+		if !now.Before(record.expireAt) {
+			delete(s.records, key)
+		}
+	}
+}
+
+// Len 未清理的记录数
+func (s *MemoryIdempotencyStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.records)
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, output string, ttl time.Duration) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.records[key]
+	if !ok { // 已过期被清理
+		return nil
+	}
+	record.Status, record.Output, record.expireAt = IDEMPOTENCY_STATUS_DONE, output, time.Now().Add(ttl)
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// RedisIdempotencyStore redis 幂等存储,记录以 json 保存
+type RedisIdempotencyStore struct {
+	client *redis.Client
+}
+
+func NewRedisIdempotencyStore(client *redis.Client) (s *RedisIdempotencyStore) {
+	return &RedisIdempotencyStore{client: client}
+}
+
+func (s *RedisIdempotencyStore) Reserve(ctx context.Context, key string, inputHash string, ttl time.Duration) (record *IdempotencyRecord, reserved bool, err error) {
+	record = &IdempotencyRecord{Key: key, InputHash: inputHash, Status: IDEMPOTENCY_STATUS_PROCESSING}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	redisKey := IDEMPOTENCY_REDIS_KEY_PREFIX + key
+	reserved, err = s.client.SetNX(ctx, redisKey, string(b), ttl).Result()
+	if err != nil || reserved {
+		return nil, reserved, err
+	}
+	value, err := s.client.Get(ctx, redisKey).Result()
+	if err == redis.Nil { // 刚好过期,重新占用
+		return s.Reserve(ctx, key, inputHash, ttl)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	record = &IdempotencyRecord{}
+	if err = json.Unmarshal([]byte(value), record); err != nil {
+		return nil, false, err
+	}
+	return record, false, nil
+}
+
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, output string, ttl time.Duration) (err error) {
+	redisKey := IDEMPOTENCY_REDIS_KEY_PREFIX + key
+	value, err := s.client.Get(ctx, redisKey).Result()
+	if err != nil {
+		return err
+	}
+	record := &IdempotencyRecord{}
+	if err = json.Unmarshal([]byte(value), record); err != nil {
+		return err
+	}
+	record.Status, record.Output = IDEMPOTENCY_STATUS_DONE, output
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisKey, string(b), ttl).Err()
+}
+
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) (err error) {
+	return s.client.Del(ctx, IDEMPOTENCY_REDIS_KEY_PREFIX+key).Err()
+}
+
+// SQLIdempotencyStore sql 幂等存储,依赖主键唯一约束占用幂等键
+type SQLIdempotencyStore struct {
+	provider *DBProvider
+	table    string
+}
+
+func NewSQLIdempotencyStore(provider *DBProvider, table string) (s *SQLIdempotencyStore) {
+	if table == "" {
+		table = IDEMPOTENCY_TABLE_DEFAULT
+	}
+	return &SQLIdempotencyStore{provider: provider, table: table}
+}
+
+// IdempotencyDDL 幂等记录表建表语句,table 为空时使用默认表名
+func IdempotencyDDL(d Dialect, table string) string {
+	if table == "" {
+		table = IDEMPOTENCY_TABLE_DEFAULT
+	}
+	return fmt.Sprintf(`create table if not exists %s (
+	id varchar(255) not null primary key,
+	input_hash varchar(64) not null,
+	status int not null default 0,
+	output text,
+	expire_at varchar(32) not null
+)`, d.Quote(table))
+}
+
+func (s *SQLIdempotencyStore) exec(ctx context.Context, named string, data map[string]interface{}) (err error) {
+	statement, args, err := toStatement(s.provider.Dialect(), named, data)
+	if err != nil {
+		return err
+	}
+	_, err = execOrQueryContext(ctx, s.provider.GetDB(), statement, args...)
+	return err
+}
+
+func (s *SQLIdempotencyStore) Reserve(ctx context.Context, key string, inputHash string, ttl time.Duration) (record *IdempotencyRecord, reserved bool, err error) {
+	d := s.provider.Dialect()
+	table := d.Quote(s.table)
+	now := time.Now()
+	data := map[string]interface{}{
+		"id":        key,
+		"inputHash": inputHash,
+		"now":       outboxTime(now),
+		"expireAt":  outboxTime(now.Add(ttl)),
+	}
+	if err = s.exec(ctx, fmt.Sprintf(`delete from %s where id=:id and expire_at<:now`, table), data); err != nil {
+		return nil, false, err
+	}
+	insertErr := s.exec(ctx, fmt.Sprintf(`insert into %s (id,input_hash,status,expire_at) values (:id,:inputHash,%d,:expireAt)`, table, IDEMPOTENCY_STATUS_PROCESSING), data)
+	if insertErr == nil {
+		return nil, true, nil
+	}
+	statement, args, err := toStatement(d, fmt.Sprintf(`select input_hash,status,output from %s where id=:id`, table), data)
+	if err != nil {
+		return nil, false, err
+	}
+	record = &IdempotencyRecord{Key: key}
+	var output sql.NullString
+	err = s.provider.GetDB().QueryRowContext(ctx, statement, args...).Scan(&record.InputHash, &record.Status, &output)
+	if errors.Is(err, sql.ErrNoRows) { // 插入失败不是因为主键冲突
+		return nil, false, insertErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	record.Output = output.String
+	return record, false, nil
+}
+
+func (s *SQLIdempotencyStore) Complete(ctx context.Context, key string, output string, ttl time.Duration) (err error) {
+	data := map[string]interface{}{
+		"id":       key,
+		"output":   output,
+		"expireAt": outboxTime(time.Now().Add(ttl)),
+	}
+	return s.exec(ctx, fmt.Sprintf(`update %s set status=%d,output=:output,expire_at=:expireAt where id=:id`, s.provider.Dialect().Quote(s.table), IDEMPOTENCY_STATUS_DONE), data)
+}
+
+func (s *SQLIdempotencyStore) Release(ctx context.Context, key string) (err error) {
+	return s.exec(ctx, fmt.Sprintf(`delete from %s where id=:id`, s.provider.Dialect().Quote(s.table)), map[string]interface{}{"id": key})
+}
+
+//SetIdempotencyStore 设置自定义幂等存储,优先于声明中的存储资源
+func (capi *apiCompiled) SetIdempotencyStore(store IdempotencyStore) {
+	capi.idempotencyStore = store
+}
+
+// getIdempotencyStore 获取幂等存储
+func (capi *apiCompiled) getIdempotencyStore(ctx context.Context) (store IdempotencyStore, err error) {
+	if capi.idempotencyStore != nil {
+		return capi.idempotencyStore, nil
+	}
+	_, provider, err := capi.getProviderBySource(ctx, capi.idempotency.Source)
+	if err != nil {
+		return nil, err
+	}
+	switch p := provider.(type) {
+	case IdempotencyStore:
+		return p, nil
+	case *DBProvider:
+		return NewSQLIdempotencyStore(p, capi.idempotency.Table), nil
+	case *ReplicaDBProvider:
+		return NewSQLIdempotencyStore(p.Primary(), capi.idempotency.Table), nil
+	case *RedisProvider:
+		return NewRedisIdempotencyStore(p.GetClient()), nil
+	}
+	err = errors.Errorf("idempotency required sql/redis source,got:%s", provider.TypeName())
+	return nil, err
+}
+
+// reserveIdempotency 占用幂等键;重复请求返回保存的输出(done 为 true),输入不一致或仍在执行返回 409;
+// 占用成功时返回的 finish 在执行结束后保存输出或释放幂等键
+func (capi *apiCompiled) reserveIdempotency(ctx context.Context, inputJson string) (out string, done bool, finish func(out string, err error), err error) {
+	key := gjson.Get(inputJson, capi.idempotency.Key).String()
+	if key == "" {
+		return "", false, nil, nil
+	}
+	store, err := capi.getIdempotencyStore(ctx)
+	if err != nil {
+		return "", false, nil, err
+	}
+	key = idempotencyScope(ctx, capi) + "\x00" + key // 不同 api、方法、调用方的幂等键互不影响
+	ttl := time.Duration(capi.idempotency.TTL) * time.Second
+	hash := inputHash(inputJson)
+	record, reserved, err := store.Reserve(ctx, key, hash, ttl)
+	if err != nil {
+		return "", false, nil, err
+	}
+	if !reserved {
+		if record.InputHash != hash {
+			err = NewStatusError(http.StatusConflict, errors.WithMessage(ErrIdempotencyConflict, "input mismatch"))
+			return "", false, nil, err
+		}
+		if record.Status != IDEMPOTENCY_STATUS_DONE {
+			err = NewStatusError(http.StatusConflict, errors.WithMessage(ErrIdempotencyConflict, "request in progress"))
+			return "", false, nil, err
+		}
+		return record.Output, true, nil, nil
+	}
+	finish = func(out string, err error) {
+		logInfo := &LogInfoIdempotency{Context: ctx, Route: capi.Route, Key: key}
+		if err != nil {
+			logInfo.Action = "release"
+			logInfo.Err = store.Release(context.Background(), key)
+		} else {
+			logInfo.Action = "complete"
+			logInfo.Err = store.Complete(context.Background(), key, out, ttl)
+		}
+		if logInfo.Err != nil { // 保存失败时重复请求会重新执行或返回 409 直到记录过期
+			logchan.SendLogInfo(logInfo)
+		}
+	}
+	return "", false, finish, nil
+}
+
+// idempotencyScope 幂等键作用域:请求方法、路由、调用方标识
+func idempotencyScope(ctx context.Context, capi *apiCompiled) string {
+	method, _ := ctx.Value(CONTEXT_KEY_HTTP_METHOD).(string)
+	if method == "" {
+		method = capi.Methods
+	}
+	subject := ""
+	if principal := GetPrincipal(ctx); principal != nil {
+		subject = principal.Subject
+	}
+	return strings.Join([]string{strings.ToUpper(method), capi.Route, subject}, "\x00")
+}
+
+// LogInfoIdempotency 幂等记录保存、释放失败日志
+type LogInfoIdempotency struct {
+	Context context.Context `json:"context"`
+	Route   string          `json:"route"`
+	Key     string          `json:"key"`
+	Action  string          `json:"action"` // complete、release
+	Err     error
+	logchan.EmptyLogInfo
+}
+
+func (l LogInfoIdempotency) GetName() logchan.LogName {
+	return LogName(LOG_INFO_IDEMPOTENCY)
+}
+
+func (l LogInfoIdempotency) Error() error {
+	return l.Err
+}
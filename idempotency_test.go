@@ -0,0 +1,161 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+func TestIdempotency(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "idempotency.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = provider.ExecOrQueryContext(ctx, `create table orders (id integer primary key autoincrement, amount int)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.ExecOrQueryContext(ctx, dataexchanger.IdempotencyDDL(provider.Dialect(), "")); err != nil {
+		t.Fatal(err)
+	}
+	newAPI := func(route string, storeSource string) *dataexchanger.DtoAPI {
+		return &dataexchanger.DtoAPI{
+			Methods: "post",
+			Route:   route,
+			InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+			fullname=requestId,dst=requestId,in=header,name=Idempotency-Key
+			fullname=amount,dst=amount,format=number,required`,
+			OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+			fullname=orderId,src=orderId,required`,
+			MainScript: `
+			ctx:=storage.GetCtx()
+			orderId:=execSQLTPL(ctx,"Create",storage.GetMemory())
+			storage.Set("orderId",orderId)
+			`,
+			Idempotency: &dataexchanger.DtoIdempotency{Key: "requestId", Source: storeSource},
+		}
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	for _, api := range []*dataexchanger.DtoAPI{newAPI("/api/order/create", ""), newAPI("/api/order/create2", "db")} {
+		capi, err := dataexchanger.NewApiCompiled(api)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = capi.RegisterSource(source); err != nil {
+			t.Fatal(err)
+		}
+		tplNames := capi.RegisterTemplate("", `{{define "Create"}}insert into orders (amount) values (:amount){{end}}`)
+		if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+			t.Fatal(err)
+		}
+		if err = container.RegisterAPI(capi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := func(route string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, route, strings.NewReader(body))
+		req.Header.Set("Content-Type", dataexchanger.MEDIA_TYPE_JSON)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		container.ServeHTTP(rec, req)
+		return rec
+	}
+	count := func() string {
+		out, err := provider.ExecOrQueryContext(ctx, `select count(*) from orders`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	for i, route := range []string{"/api/order/create", "/api/order/create2"} {
+		first := post(route, "k1", `{"amount":"10"}`)
+		if first.Code != http.StatusOK {
+			t.Fatalf("%s first request got:%d %s", route, first.Code, first.Body.String())
+		}
+		retry := post(route, "k1", `{"amount":"10"}`)
+		if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+			t.Errorf("%s retry want %s,got:%d %s", route, first.Body.String(), retry.Code, retry.Body.String())
+		}
+		if got := count(); got != fmt.Sprint(i+1) {
+			t.Errorf("%s retry inserted duplicate,count:%s", route, got)
+		}
+		if rec := post(route, "k1", `{"amount":"20"}`); rec.Code != http.StatusConflict {
+			t.Errorf("%s different input want 409,got:%d", route, rec.Code)
+		}
+	}
+	post("/api/order/create", "", `{"amount":"10"}`)
+	post("/api/order/create", "", `{"amount":"10"}`)
+	if got := count(); got != "4" {
+		t.Errorf("requests without key want run every time,count:%s", got)
+	}
+
+	capi, _ := container.GetCApi("/api/order/create", "post")
+	if _, err = capi.Run(ctx, `{"requestId":"k1","amount":"30"}`); !errors.Is(err, dataexchanger.ErrIdempotencyConflict) {
+		t.Errorf("run want ErrIdempotencyConflict,got:%v", err)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/order/pay",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=requestId,dst=requestId
+		fullname=amount,dst=amount`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=amount,src=input.amount`,
+		Idempotency: &dataexchanger.DtoIdempotency{Key: "requestId"},
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := dataexchanger.WithPrincipal(context.Background(), &dataexchanger.Principal{Subject: "alice"})
+	bob := dataexchanger.WithPrincipal(context.Background(), &dataexchanger.Principal{Subject: "bob"})
+	if _, err = capi.Run(alice, `{"requestId":"k1","amount":"10"}`); err != nil {
+		t.Fatal(err)
+	}
+	out, err := capi.Run(bob, `{"requestId":"k1","amount":"20"}`)
+	if err != nil {
+		t.Fatalf("same key of another principal want run,got:%v", err)
+	}
+	if !strings.Contains(out, "20") {
+		t.Errorf("another principal got replayed output:%s", out)
+	}
+	if _, err = capi.Run(alice, `{"requestId":"k1","amount":"20"}`); !errors.Is(err, dataexchanger.ErrIdempotencyConflict) {
+		t.Errorf("same principal different input want conflict,got:%v", err)
+	}
+
+	store := dataexchanger.NewMemoryIdempotencyStore()
+	store.SweepInterval = time.Millisecond
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, _, err = store.Reserve(ctx, fmt.Sprint(i), "", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err = store.Reserve(ctx, "live", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Len(); got != 1 {
+		t.Errorf("expired records want evicted,left:%d", got)
+	}
+}
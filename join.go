@@ -0,0 +1,188 @@
+package dataexchanger
+
+import (
+	"strings"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	JOIN_MODE_INNER  = "inner"  // 内连接,左侧无匹配的行丢弃
+	JOIN_MODE_LEFT   = "left"   // 左连接,左侧无匹配的行保留
+	JOIN_MODE_NESTED = "nested" // 嵌套,右侧所有匹配行以数组形式挂到左侧行
+)
+
+// DtoJoin 声明式关联步骤,在主脚本执行后基于 storage.DiskSpace 执行
+type DtoJoin struct {
+	Left     string `json:"left"`     // 左侧数据在 storage 中的路径
+	Right    string `json:"right"`    // 右侧数据在 storage 中的路径
+	LeftKey  string `json:"leftKey"`  // 左侧关联字段
+	RightKey string `json:"rightKey"` // 右侧关联字段
+	Into     string `json:"into"`     // 右侧数据挂载字段,为空时(inner、left)字段合并到左侧行
+	Mode     string `json:"mode"`     // inner、left、nested,默认 inner
+	Dst      string `json:"dst"`      // 结果写入 storage 的路径,默认覆盖 Left
+}
+
+func (j DtoJoin) validate() (err error) {
+	if j.Left == "" || j.Right == "" || j.LeftKey == "" || j.RightKey == "" {
+		err = errors.Errorf("join left,right,leftKey,rightKey required,got:%#v", j)
+		return err
+	}
+	if j.Mode == JOIN_MODE_NESTED && j.Into == "" {
+		err = errors.Errorf("join mode %s required into", JOIN_MODE_NESTED)
+		return err
+	}
+	switch j.Mode {
+	case "", JOIN_MODE_INNER, JOIN_MODE_LEFT, JOIN_MODE_NESTED:
+	default:
+		err = errors.Errorf("join mode want inner/left/nested,got:%s", j.Mode)
+		return err
+	}
+	return nil
+}
+
+// run 在 storage json 上执行关联,返回新的 storage json
+func (j DtoJoin) run(diskSpace string) (newDiskSpace string, err error) {
+	left := gjson.Get(diskSpace, j.Left).Raw
+	right := gjson.Get(diskSpace, j.Right).Raw
+	out, err := Join(left, right, j.LeftKey, j.RightKey, j.Into, j.Mode)
+	if err != nil {
+		return "", err
+	}
+	dst := j.Dst
+	if dst == "" {
+		dst = j.Left
+	}
+	newDiskSpace, err = sjson.SetRaw(diskSpace, dst, out)
+	if err != nil {
+		err = errors.WithMessagef(err, "join set result to %s", dst)
+		return "", err
+	}
+	return newDiskSpace, nil
+}
+
+// Join 按键关联两个json数组(单个对象视为只有一行的数组),直接操作json字符串,避免转换为tengo对象
+func Join(left string, right string, leftKey string, rightKey string, into string, mode string) (out string, err error) {
+	if mode == "" {
+		mode = JOIN_MODE_INNER
+	}
+	if mode == JOIN_MODE_NESTED && into == "" {
+		err = errors.Errorf("join mode %s required into", JOIN_MODE_NESTED)
+		return "", err
+	}
+	rightIndex := make(map[string][]string)
+	for _, row := range jsonRows(right) {
+		key := row.Get(rightKey)
+		if !key.Exists() {
+			continue
+		}
+		rightIndex[key.String()] = append(rightIndex[key.String()], row.Raw)
+	}
+	rows := make([]string, 0)
+	for _, row := range jsonRows(left) {
+		matches := rightIndex[row.Get(leftKey).String()]
+		switch mode {
+		case JOIN_MODE_NESTED:
+			raw, err := sjson.SetRaw(row.Raw, escapePathKey(into), "["+strings.Join(matches, ",")+"]")
+			if err != nil {
+				return "", err
+			}
+			rows = append(rows, raw)
+		case JOIN_MODE_INNER, JOIN_MODE_LEFT:
+			if len(matches) == 0 {
+				if mode == JOIN_MODE_LEFT {
+					raw := row.Raw
+					if into != "" {
+						if raw, err = sjson.SetRaw(raw, escapePathKey(into), "null"); err != nil {
+							return "", err
+						}
+					}
+					rows = append(rows, raw)
+				}
+				continue
+			}
+			for _, match := range matches {
+				raw, err := joinRow(row.Raw, match, into)
+				if err != nil {
+					return "", err
+				}
+				rows = append(rows, raw)
+			}
+		default:
+			err = errors.Errorf("join mode want inner/left/nested,got:%s", mode)
+			return "", err
+		}
+	}
+	out = "[" + strings.Join(rows, ",") + "]"
+	return out, nil
+}
+
+// joinRow 合并一行,into 为空时右侧字段合并到左侧(左侧已有字段优先)
+func joinRow(leftRow string, rightRow string, into string) (out string, err error) {
+	if into != "" {
+		return sjson.SetRaw(leftRow, escapePathKey(into), rightRow)
+	}
+	out = leftRow
+	gjson.Parse(rightRow).ForEach(func(key, value gjson.Result) bool {
+		path := escapePathKey(key.String())
+		if gjson.Get(out, path).Exists() {
+			return true
+		}
+		out, err = sjson.SetRaw(out, path, value.Raw)
+		return err == nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// jsonRows 将json数组或对象转换为行
+func jsonRows(s string) (rows []gjson.Result) {
+	result := gjson.Parse(s)
+	if result.IsArray() {
+		return result.Array()
+	}
+	if result.IsObject() {
+		return []gjson.Result{result}
+	}
+	return nil
+}
+
+// escapePathKey 转义gjson/sjson路径中的特殊字符,确保字段名作为单个key使用
+func escapePathKey(key string) string {
+	replacer := strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`, "|", `\|`, "#", `\#`, "@", `\@`)
+	return replacer.Replace(key)
+}
+
+// TengoJoin 注入到tengo脚本 join(left, right, leftKey, rightKey, into, mode)
+func TengoJoin(args ...tengo.Object) (ret tengo.Object, err error) {
+	argLen := len(args)
+	if argLen != 5 && argLen != 6 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	names := []string{"left", "right", "leftKey", "rightKey", "into", "mode"}
+	strArgs := make([]string, 6)
+	for i, arg := range args {
+		str, ok := tengo.ToString(arg)
+		if !ok {
+			if arg == tengo.UndefinedValue { // execSQLTPL 可能返回空
+				continue
+			}
+			return nil, tengo.ErrInvalidArgumentType{
+				Name:     names[i],
+				Expected: "string",
+				Found:    arg.TypeName(),
+			}
+		}
+		strArgs[i] = str
+	}
+	out, err := Join(strArgs[0], strArgs[1], strArgs[2], strArgs[3], strArgs[4], strArgs[5])
+	if err != nil {
+		return nil, err
+	}
+	return &tengo.String{Value: out}, nil
+}
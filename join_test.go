@@ -0,0 +1,30 @@
+package dataexchanger_test
+
+import (
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+)
+
+func TestJoin(t *testing.T) {
+	orders := `[{"id":"1","userId":"10"},{"id":"2","userId":"11"},{"id":"3","userId":"10"}]`
+	users := `[{"userId":"10","name":"alice"}]`
+	cases := []struct {
+		mode string
+		into string
+		want string
+	}{
+		{dataexchanger.JOIN_MODE_INNER, "", `[{"id":"1","userId":"10","name":"alice"},{"id":"3","userId":"10","name":"alice"}]`},
+		{dataexchanger.JOIN_MODE_LEFT, "user", `[{"id":"1","userId":"10","user":{"userId":"10","name":"alice"}},{"id":"2","userId":"11","user":null},{"id":"3","userId":"10","user":{"userId":"10","name":"alice"}}]`},
+		{dataexchanger.JOIN_MODE_NESTED, "users", `[{"id":"1","userId":"10","users":[{"userId":"10","name":"alice"}]},{"id":"2","userId":"11","users":[]},{"id":"3","userId":"10","users":[{"userId":"10","name":"alice"}]}]`},
+	}
+	for _, c := range cases {
+		out, err := dataexchanger.Join(orders, users, "userId", "userId", c.into, c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != c.want {
+			t.Errorf("mode %s\nwant:%s\ngot: %s", c.mode, c.want, out)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package dataexchanger
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+)
+
+const (
+	LOCK_KEY_PREFIX     = "dataexchanger:lock:"
+	LOCK_RETRY_INTERVAL = 50 * time.Millisecond // 获取锁失败后的重试间隔
+	LOCK_TTL_DEFAULT    = 30 * time.Second
+	MYSQL_LOCK_NAME_MAX = 64 // mysql GET_LOCK 名称最大长度
+)
+
+// Locker 锁资源,ttl 到期自动释放,防止持有方异常退出后锁无法释放
+type Locker interface {
+	// TryLock 尝试获取锁,已被占用时 ok 为 false
+	TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func() (err error), ok bool, err error)
+}
+
+// acquireLock 获取锁,被占用时按间隔重试直到 ctx 取消
+func acquireLock(ctx context.Context, locker Locker, key string, ttl time.Duration) (unlock func() (err error), err error) {
+	for {
+		unlock, ok, err := locker.TryLock(ctx, key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return unlock, nil
+		}
+		select {
+		case <-ctx.Done():
+			err = errors.WithMessagef(ctx.Err(), "lock:%s", key)
+			return nil, err
+		case <-time.After(LOCK_RETRY_INTERVAL):
+		}
+	}
+}
+
+// onceUnlock 保证释放函数只执行一次
+func onceUnlock(unlock func() error) func() error {
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			err = unlock()
+		})
+		return err
+	}
+}
+
+// MemoryLocker 进程内锁
+type MemoryLocker struct {
+	locks map[string]memoryLock
+	lock  sync.Mutex
+}
+
+type memoryLock struct {
+	token    string
+	expireAt time.Time
+}
+
+func NewMemoryLocker() (l *MemoryLocker) {
+	return &MemoryLocker{locks: make(map[string]memoryLock)}
+}
+
+var defaultLocker = NewMemoryLocker()
+
+// TryLock 实现 Locker
+func (l *MemoryLocker) TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func() (err error), ok bool, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if held, exists := l.locks[key]; exists && now.Before(held.expireAt) {
+		return nil, false, nil
+	}
+	token := newMessageID()
+	l.locks[key] = memoryLock{token: token, expireAt: now.Add(ttl)}
+	unlock = func() error {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if held, exists := l.locks[key]; exists && held.token == token { // 过期后可能已被他人持有
+			delete(l.locks, key)
+		}
+		return nil
+	}
+	return unlock, true, nil
+}
+
+// redisUnlockScript 仅删除自己持有的锁
+var redisUnlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`)
+
+// TryLock 实现 Locker,SET NX PX
+func (p *RedisProvider) TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func() (err error), ok bool, err error) {
+	key = LOCK_KEY_PREFIX + key
+	token := newMessageID()
+	ok, err = p.client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	unlock = func() error {
+		return redisUnlockScript.Run(context.Background(), p.client, []string{key}, token).Err()
+	}
+	return unlock, true, nil
+}
+
+// TryLock 实现 Locker,使用数据库会话级咨询锁(mysql GET_LOCK、postgres pg_try_advisory_lock),连接断开时数据库自动释放
+func (p *DBProvider) TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func() (err error), ok bool, err error) {
+	var lockSQL, unlockSQL string
+	var arg interface{}
+	switch p.dialect.Name() {
+	case DIALECT_MYSQL:
+		lockSQL, unlockSQL = "select get_lock(?,0)", "select release_lock(?)"
+		arg = mysqlLockName(LOCK_KEY_PREFIX + key)
+	case DIALECT_POSTGRES:
+		lockSQL, unlockSQL = "select pg_try_advisory_lock($1)::int", "select pg_advisory_unlock($1)"
+		h := fnv.New64a()
+		h.Write([]byte(LOCK_KEY_PREFIX + key))
+		arg = int64(h.Sum64())
+	default:
+		err = errors.Errorf("advisory lock not supported by dialect:%s", p.dialect.Name())
+		return nil, false, err
+	}
+	conn, err := p.sqlDB.Conn(ctx) // 咨询锁属于会话,加锁、解锁需在同一连接
+	if err != nil {
+		return nil, false, err
+	}
+	var acquired int
+	if err = conn.QueryRowContext(ctx, lockSQL, arg).Scan(&acquired); err != nil || acquired != 1 {
+		conn.Close()
+		return nil, false, err
+	}
+	expired := make(chan struct{})
+	unlock = onceUnlock(func() error {
+		close(expired)
+		_, err := conn.ExecContext(context.Background(), unlockSQL, arg)
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	go func() { // ttl 到期释放
+		select {
+		case <-time.After(ttl):
+			unlock()
+		case <-expired:
+		}
+	}()
+	return unlock, true, nil
+}
+
+// mysqlLockName 超长的锁名称取摘要
+func mysqlLockName(name string) string {
+	if len(name) <= MYSQL_LOCK_NAME_MAX {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	return LOCK_KEY_PREFIX + hex.EncodeToString(sum[:])
+}
+
+// TryLock 实现 Locker,锁在主库
+func (p *ReplicaDBProvider) TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func() (err error), ok bool, err error) {
+	return p.primary.TryLock(ctx, key, ttl)
+}
+
+// getLocker 获取锁资源,未设置锁资源时使用进程内锁
+func (capi *apiCompiled) getLocker(ctx context.Context) (locker Locker, err error) {
+	if capi.lockSource == "" {
+		return defaultLocker, nil
+	}
+	_, provider, err := capi.getProviderBySource(ctx, capi.lockSource)
+	if err != nil {
+		return nil, err
+	}
+	locker, ok := provider.(Locker)
+	if !ok {
+		err = errors.Errorf("lock required locker source,got:%s", provider.TypeName())
+		return nil, err
+	}
+	return locker, nil
+}
+
+// Lock 获取锁直到 ctx 取消,锁在 Run 结束(后置脚本在其结束)或 ctx 取消时自动释放
+func (capi *apiCompiled) Lock(ctx context.Context, key string, ttl time.Duration) (unlock func() (err error), err error) {
+	if ttl <= 0 {
+		ttl = LOCK_TTL_DEFAULT
+	}
+	locker, err := capi.getLocker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquireLock(ctx, locker, key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	released := make(chan struct{})
+	unlock = onceUnlock(func() error {
+		close(released)
+		return release()
+	})
+	if state := getRunState(ctx); state != nil {
+		state.addLock(unlock)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			unlock()
+		case <-released:
+		}
+	}()
+	return unlock, nil
+}
+
+// TengoLock 注入到tengo脚本 lock(ctx, key, ttl),ttl 为秒数或时长字符串(如 "10s"),返回释放函数
+func (capi *apiCompiled) TengoLock(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 3 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctxObj, ok := args[0].(*tengocontext.TengoContext)
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "context",
+			Expected: "context.Context",
+			Found:    args[0].TypeName(),
+		}
+	}
+	key, ok := tengo.ToString(args[1])
+	if !ok || key == "" {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "key",
+			Expected: "string",
+			Found:    args[1].TypeName(),
+		}
+	}
+	var ttl time.Duration
+	switch ttlObj := args[2].(type) {
+	case *tengo.String:
+		if ttl, err = time.ParseDuration(ttlObj.Value); err != nil {
+			return nil, err
+		}
+	default:
+		seconds, ok := tengo.ToFloat64(ttlObj)
+		if !ok {
+			return nil, tengo.ErrInvalidArgumentType{
+				Name:     "ttl",
+				Expected: "int(seconds)/string(duration)",
+				Found:    args[2].TypeName(),
+			}
+		}
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+	unlock, err := capi.Lock(ctxObj.Context, key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &tengo.UserFunction{
+		Name: "unlock",
+		Value: func(args ...tengo.Object) (tengo.Object, error) {
+			return tengo.UndefinedValue, unlock()
+		},
+	}, nil
+}
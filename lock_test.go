@@ -0,0 +1,126 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+)
+
+func TestLock(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/counter/recalculate",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=counter,dst=counter`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		lock(ctx,storage.GetMemory().counter,"10s")
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err := capi.Run(ctx, `{"counter":"visits"}`)
+		return err
+	}
+	// 未主动释放的锁在 Run 结束时释放
+	if err = run(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = run(time.Second); err != nil {
+		t.Fatalf("lock not released after run:%v", err)
+	}
+
+	unlock, err := capi.Lock(context.Background(), "visits", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = run(200 * time.Millisecond); err == nil {
+		t.Error("run while locked want error")
+	}
+	if err = unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = run(time.Second); err != nil {
+		t.Fatalf("run after unlock:%v", err)
+	}
+
+	// ctx 取消时释放
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err = capi.Lock(ctx, "visits", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err = run(time.Second); err != nil {
+		t.Fatalf("lock not released after cancel:%v", err)
+	}
+
+	// ttl 到期释放
+	locker := dataexchanger.NewMemoryLocker()
+	if _, ok, _ := locker.TryLock(context.Background(), "k", 20*time.Millisecond); !ok {
+		t.Fatal("first lock want ok")
+	}
+	if _, ok, _ := locker.TryLock(context.Background(), "k", time.Second); ok {
+		t.Error("held lock want not ok")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok, _ := locker.TryLock(context.Background(), "k", time.Second); !ok {
+		t.Error("expired lock want ok")
+	}
+}
+
+func TestPostScriptLockAfterCancel(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/report/build",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id`,
+		PostScript: `
+		ctx:=storage.GetCtx()
+		lock(ctx,"report-"+principal(ctx).subject,"10s")
+		lock(ctx,"gate","10s")
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockGate, err := capi.Lock(context.Background(), "gate", time.Minute) // 后置脚本持有 report 锁后等待 gate
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = dataexchanger.WithPrincipal(ctx, &dataexchanger.Principal{Subject: "u1"}) // 后置脚本保留请求上下文中的身份
+	if _, err = capi.Run(ctx, `{"id":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+	cancel() // 请求结束,后置脚本仍在执行
+	tryLock := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		unlock, err := capi.Lock(ctx, "report-u1", time.Minute)
+		if err == nil {
+			unlock()
+		}
+		return err
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err = tryLock(); err == nil {
+		t.Error("post script lock released when request ctx canceled")
+	}
+	if err = unlockGate(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for err = tryLock(); err != nil && time.Now().Before(deadline); err = tryLock() {
+	}
+	if err != nil {
+		t.Errorf("post script lock not released after post script:%v", err)
+	}
+}
@@ -15,15 +15,26 @@ const (
 	LOG_INFO_SQL_TEMPLATE = tengotemplate.LOG_INFO_SQL_TEMPLATE
 )
 
-type LogInfoEXECSQL tengodb.LogInfoEXECSQL
+// LogInfoEXECSQL sql 执行日志,SQL 为占位符语句,Args 为绑定参数
+type LogInfoEXECSQL struct {
+	tengodb.LogInfoEXECSQL
+	Args []interface{} `json:"args"`
+}
+
 type LogInfoTemplateSQL tengotemplate.LogInfoTemplateSQL
 
 type LogInforInterface logchan.LogInforInterface
 
 /*****************************************统一管理日志end**********************************************/
 const (
-	LOG_INFO_RUN      = "apiCompiled.Run"
-	LOG_INFO_RUN_POST = "apiCompiled.Run.post"
+	LOG_INFO_RUN         = "apiCompiled.Run"
+	LOG_INFO_RUN_POST    = "apiCompiled.Run.post"
+	LOG_INFO_CDC         = "Container.CDC"
+	LOG_INFO_AFTER_EVENT = "apiCompiled.AfterEvent"
+	LOG_INFO_CONSUME     = "Container.Consume"
+	LOG_INFO_SCHEDULE    = "Container.Schedule"
+	LOG_INFO_HTTP_ERROR  = "Container.ServeHTTP.Error"
+	LOG_INFO_IDEMPOTENCY = "apiCompiled.Idempotency"
 )
 
 //TryConvert2LogInfoExecSQL log 类型转换,先通过名称确定类型
@@ -32,6 +43,10 @@ func TryConvert2LogInfoExecSQL(log logchan.LogInforInterface) (logInfoEXECSQL *t
 	if ok {
 		return logInfoEXECSQL, ok
 	}
+	withArgs, ok := log.(*LogInfoEXECSQL)
+	if ok {
+		return &withArgs.LogInfoEXECSQL, ok
+	}
 	tmp, ok := log.(*tengodb.LogInfoEXECSQL)
 	if ok {
 		logInfoEXECSQL = tmp
@@ -39,6 +54,12 @@ func TryConvert2LogInfoExecSQL(log logchan.LogInforInterface) (logInfoEXECSQL *t
 	return logInfoEXECSQL, ok
 }
 
+//TryConvert2LogInfoExecSQLWithArgs log 类型转换,包含绑定参数
+func TryConvert2LogInfoExecSQLWithArgs(log logchan.LogInforInterface) (logInfoEXECSQL *LogInfoEXECSQL, ok bool) {
+	logInfoEXECSQL, ok = log.(*LogInfoEXECSQL)
+	return logInfoEXECSQL, ok
+}
+
 //TryConvert2LogInfoSQLTemplate log 类型转换,先通过名称确定类型
 func TryConvert2LogInfoSQLTemplate(log logchan.LogInforInterface) (logInfoTemplateSQL *tengotemplate.LogInfoTemplateSQL, ok bool) {
 	logInfoTemplateSQL, ok = log.(*tengotemplate.LogInfoTemplateSQL)
@@ -81,7 +102,11 @@ type RunLogInfo struct {
 	PreOutput     string          `json:"preOutInput"`
 	Out           string          `json:"out"`
 	PostOut       interface{}     `json:"postOut"`
+	CacheHit      int             `json:"cacheHit"`      // 单次执行内相同查询命中缓存次数
+	CacheMiss     int             `json:"cacheMiss"`     // 单次执行内查询未命中缓存次数
+	IdempotentHit bool            `json:"idempotentHit"` // 幂等重复请求,直接返回保存的输出
 	Err           error
+	masker        *logMasker // 本次执行的日志脱敏器
 	logchan.EmptyLogInfo
 }
 
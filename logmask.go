@@ -0,0 +1,431 @@
+package dataexchanger
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/jsonschemaline"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/suifengpiao14/tengolib/tengotemplate"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	LINE_SCHEMA_KEY_SENSITIVE = "sensitive" // 行 schema 敏感字段,值为日志脱敏策略,sensitive 或 sensitive=true 时使用 hash
+
+	LOG_MASK_STRATEGY_DEFAULT = MASK_HASH
+	LOG_MASK_VALUE_MIN_LEN    = 4 // 敏感字段原值短于此长度时仅按字段名脱敏,避免误替换日志中的其它内容
+)
+
+// LogMaskRule 日志脱敏规则
+type LogMaskRule struct {
+	Key      string `json:"key"`      // json 字段名(不区分大小写),匹配任意层级的同名字段
+	Pattern  string `json:"pattern"`  // 正则表达式,匹配日志文本(sql、参数、输入输出)中的内容
+	Strategy string `json:"strategy"` // 脱敏策略,默认 hash
+}
+
+type logMaskPattern struct {
+	re     *regexp.Regexp
+	masker Masker
+}
+
+// logMasker 日志脱敏器,单次执行时附加行 schema 中敏感字段的字段名和原值
+type logMasker struct {
+	keys     map[string]Masker // 小写字段名 => 脱敏函数
+	patterns []logMaskPattern
+	values   map[string]Masker // 敏感原值 => 脱敏函数
+	lock     sync.RWMutex
+}
+
+func newLogMasker(rules []LogMaskRule) (m *logMasker, err error) {
+	m = &logMasker{keys: map[string]Masker{}, values: map[string]Masker{}}
+	for _, rule := range rules {
+		if rule.Strategy == "" {
+			rule.Strategy = LOG_MASK_STRATEGY_DEFAULT
+		}
+		masker, ok := GetMasker(rule.Strategy)
+		if !ok {
+			err = errors.Errorf("log mask strategy not found:%s", rule.Strategy)
+			return nil, err
+		}
+		if rule.Key == "" && rule.Pattern == "" {
+			err = errors.Errorf("log mask rule key or pattern required,got:%+v", rule)
+			return nil, err
+		}
+		if rule.Key != "" {
+			m.keys[strings.ToLower(rule.Key)] = masker
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				err = errors.WithMessagef(err, "log mask rule pattern:%s", rule.Pattern)
+				return nil, err
+			}
+			m.patterns = append(m.patterns, logMaskPattern{re: re, masker: masker})
+		}
+	}
+	return m, nil
+}
+
+// fork 复制规则及已记录的敏感原值,用于单次执行
+func (m *logMasker) fork() (forked *logMasker) {
+	forked = &logMasker{keys: map[string]Masker{}, values: map[string]Masker{}}
+	if m == nil {
+		return forked
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for k, masker := range m.keys {
+		forked.keys[k] = masker
+	}
+	for value, masker := range m.values {
+		forked.values[value] = masker
+	}
+	forked.patterns = append(forked.patterns, m.patterns...)
+	return forked
+}
+
+func (m *logMasker) addKey(key string, masker Masker) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keys[strings.ToLower(key)] = masker
+}
+
+func (m *logMasker) addValue(value string, masker Masker) {
+	if len(value) < LOG_MASK_VALUE_MIN_LEN {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[value] = masker
+}
+
+func (m *logMasker) empty() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.keys) == 0 && len(m.patterns) == 0 && len(m.values) == 0
+}
+
+// maskText 替换文本中的敏感原值及正则匹配的内容
+func (m *logMasker) maskText(s string) string {
+	if s == "" {
+		return s
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for value, masker := range m.values {
+		if strings.Contains(s, value) {
+			s = strings.ReplaceAll(s, value, masker(value))
+		}
+	}
+	for _, pattern := range m.patterns {
+		s = pattern.re.ReplaceAllStringFunc(s, pattern.masker)
+	}
+	return s
+}
+
+// maskPayload json 按字段名脱敏后再按文本脱敏
+func (m *logMasker) maskPayload(s string) string {
+	if s == "" {
+		return s
+	}
+	if result := gjson.Parse(s); (result.IsObject() || result.IsArray()) && gjson.Valid(s) {
+		s = m.maskJSONKeys(s, result, "")
+	}
+	return m.maskText(s)
+}
+
+func (m *logMasker) maskJSONKeys(json string, result gjson.Result, prefix string) string {
+	index := 0
+	result.ForEach(func(key, value gjson.Result) bool {
+		var path string
+		if result.IsArray() {
+			path = strconv.Itoa(index)
+			index++
+		} else {
+			path = escapePathKey(key.String())
+		}
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if value.IsObject() || value.IsArray() {
+			json = m.maskJSONKeys(json, value, path)
+			return true
+		}
+		if value.Type == gjson.Null || result.IsArray() {
+			return true
+		}
+		m.lock.RLock()
+		masker, ok := m.keys[strings.ToLower(key.String())]
+		m.lock.RUnlock()
+		if ok {
+			if masked, err := sjson.Set(json, path, masker(value.String())); err == nil {
+				json = masked
+			}
+		}
+		return true
+	})
+	return json
+}
+
+// maskInterface 脱敏 sql 参数、模板数据等
+func (m *logMasker) maskInterface(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return m.maskPayload(value)
+	case []byte:
+		return m.maskPayload(string(value))
+	case []interface{}:
+		masked := make([]interface{}, len(value))
+		for i, item := range value {
+			masked[i] = m.maskInterface(item)
+		}
+		return masked
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			m.lock.RLock()
+			masker, ok := m.keys[strings.ToLower(k)]
+			m.lock.RUnlock()
+			if s, isString := item.(string); ok && isString {
+				masked[k] = masker(s)
+				continue
+			}
+			masked[k] = m.maskInterface(item)
+		}
+		return masked
+	}
+	return v
+}
+
+// maskLogInfo 复制日志并脱敏,未知类型的日志原样返回
+func (m *logMasker) maskLogInfo(logInfo logchan.LogInforInterface) logchan.LogInforInterface {
+	switch l := logInfo.(type) {
+	case *RunLogInfo:
+		masked := *l
+		masked.OriginalInput = m.maskPayload(l.OriginalInput)
+		masked.DefaultJson = m.maskPayload(l.DefaultJson)
+		masked.PreInput = m.maskPayload(l.PreInput)
+		masked.PreOutput = m.maskPayload(l.PreOutput)
+		masked.Out = m.maskPayload(l.Out)
+		masked.PostOut = m.maskInterface(l.PostOut)
+		return &masked
+	case *LogInfoEXECSQL:
+		masked := *l
+		masked.SQL = m.maskText(l.SQL)
+		masked.Result = m.maskPayload(l.Result)
+		masked.Args = m.maskInterface(l.Args).([]interface{})
+		return &masked
+	case *tengodb.LogInfoEXECSQL:
+		masked := *l
+		masked.SQL = m.maskText(l.SQL)
+		masked.Result = m.maskPayload(l.Result)
+		return &masked
+	case *tengotemplate.LogInfoTemplateSQL:
+		masked := *l
+		masked.SQL = m.maskText(l.SQL)
+		masked.Named = m.maskText(l.Named)
+		masked.Data = m.maskInterface(l.Data)
+		masked.Result = m.maskPayload(l.Result)
+		return &masked
+	case *LogInfoAfterEvent:
+		masked := *l
+		masked.Message.Body = m.maskPayload(l.Message.Body)
+		masked.Err = m.maskError(l.Err)
+		return &masked
+	case *LogInfoConsume:
+		masked := *l
+		masked.Message.Body = m.maskPayload(l.Message.Body)
+		masked.Out = m.maskPayload(l.Out)
+		masked.Err = m.maskError(l.Err)
+		return &masked
+	case *LogInfoSchedule:
+		masked := *l
+		masked.Input = m.maskPayload(l.Input)
+		masked.Out = m.maskPayload(l.Out)
+		masked.Err = m.maskError(l.Err)
+		return &masked
+	case *LogInfoCDC:
+		masked := *l
+		masked.Change.Before, _ = m.maskInterface(l.Change.Before).(map[string]interface{})
+		masked.Change.After, _ = m.maskInterface(l.Change.After).(map[string]interface{})
+		masked.Err = m.maskError(l.Err)
+		return &masked
+	case *LogInfoHTTPError:
+		masked := *l
+		masked.Err = m.maskError(l.Err)
+		return &masked
+	}
+	return logInfo
+}
+
+func (m *logMasker) maskError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(m.maskText(err.Error()))
+}
+
+// logContainer 获取不在单次执行中产生的日志所属的容器
+func logContainer(logInfo logchan.LogInforInterface) (c *Container) {
+	switch l := logInfo.(type) {
+	case *LogInfoConsume:
+		return l.container
+	case *LogInfoSchedule:
+		return l.container
+	case *LogInfoCDC:
+		return l.container
+	case *LogInfoAfterEvent:
+		return l.container
+	}
+	return nil
+}
+
+// logContext 获取日志中记录的上下文
+func logContext(logInfo logchan.LogInforInterface) (ctx context.Context) {
+	switch l := logInfo.(type) {
+	case *LogInfoEXECSQL:
+		return l.Context
+	case *tengodb.LogInfoEXECSQL:
+		return l.Context
+	case *tengotemplate.LogInfoTemplateSQL:
+		return l.Context
+	case *LogInfoAfterEvent:
+		return l.Context
+	case *LogInfoHTTPError:
+		return l.Context
+	case *LogInfoIdempotency:
+		return l.Context
+	}
+	return nil
+}
+
+// SetLogMaskRules 设置全局日志脱敏规则,与行 schema 中的 sensitive 字段一起作用于所有日志
+func (c *Container) SetLogMaskRules(rules ...LogMaskRule) (err error) {
+	masker, err := newLogMasker(rules)
+	if err != nil {
+		err = errors.WithMessage(err, "Container.SetLogMaskRules")
+		return err
+	}
+	c.lockLogMask.Lock()
+	defer c.lockLogMask.Unlock()
+	c.logMasker = masker
+	return nil
+}
+
+func (c *Container) getLogMasker() (masker *logMasker) {
+	if c == nil {
+		return nil
+	}
+	c.lockLogMask.Lock()
+	defer c.lockLogMask.Unlock()
+	return c.logMasker
+}
+
+// MaskLogInfo 返回脱敏后的日志副本,执行中产生的日志使用该次执行的脱敏器(含敏感字段原值),
+// 消费、定时任务、CDC 等记录了所属容器的日志使用该容器的规则,其余使用 c 的规则
+func (c *Container) MaskLogInfo(logInfo logchan.LogInforInterface) logchan.LogInforInterface {
+	masker := c.getLogMasker()
+	if owner := logContainer(logInfo); owner != nil {
+		masker = owner.getLogMasker()
+	}
+	if l, ok := logInfo.(*RunLogInfo); ok && l.masker != nil {
+		masker = l.masker
+	} else if ctx := logContext(logInfo); ctx != nil {
+		if state := getRunState(ctx); state != nil && state.logMasker != nil {
+			masker = state.logMasker
+		}
+	}
+	if masker == nil || masker.empty() {
+		return logInfo
+	}
+	return masker.maskLogInfo(logInfo)
+}
+
+// sensitiveField 行 schema 中的敏感字段
+type sensitiveField struct {
+	Fullname string
+	Path     string // 格式化后的路径(输入为 dst,输出为 src)
+	masker   Masker
+}
+
+// parseSensitiveFields 解析行 schema 中的 sensitive 属性
+func parseSensitiveFields(l *jsonschemaline.Jsonschemaline, direction string) (fields []sensitiveField, err error) {
+	for _, item := range l.Items {
+		for _, kv := range item.TagLineKVpair {
+			if kv.Key != LINE_SCHEMA_KEY_SENSITIVE {
+				continue
+			}
+			strategy := kv.Value
+			if strategy == "" || strategy == "true" {
+				strategy = LOG_MASK_STRATEGY_DEFAULT
+			}
+			masker, ok := GetMasker(strategy)
+			if !ok {
+				err = errors.Errorf("line schema sensitive strategy not found:%s,fullname:%s", strategy, item.Fullname)
+				return nil, err
+			}
+			field := sensitiveField{Fullname: item.Fullname, Path: item.Fullname, masker: masker}
+			switch direction {
+			case jsonschemaline.LINE_SCHEMA_DIRECTION_IN:
+				if item.Dst != "" {
+					field.Path = item.Dst
+				}
+			case jsonschemaline.LINE_SCHEMA_DIRECTION_OUT:
+				if item.Src != "" {
+					field.Path = item.Src
+				}
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// lastPathKey 路径的最后一级字段名
+func lastPathKey(path string) string {
+	path = strings.ReplaceAll(path, "[]", "")
+	segments := strings.Split(path, ".")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i] != "" && segments[i] != "#" {
+			return segments[i]
+		}
+	}
+	return ""
+}
+
+// newRunLogMasker 单次执行的脱敏器:全局规则及敏感字段名
+func (capi *apiCompiled) newRunLogMasker() (masker *logMasker) {
+	masker = capi._container.getLogMasker().fork()
+	for _, fields := range [][]sensitiveField{capi.sensitiveInput, capi.sensitiveOutput} {
+		for _, field := range fields {
+			masker.addKey(lastPathKey(field.Fullname), field.masker)
+			masker.addKey(lastPathKey(field.Path), field.masker)
+		}
+	}
+	return masker
+}
+
+// collectSensitiveValues 记录 json 中敏感字段的原值,使 sql 等文本日志中的原值同样被脱敏
+func collectSensitiveValues(masker *logMasker, json string, fields []sensitiveField, byPath bool) {
+	if json == "" || len(fields) == 0 {
+		return
+	}
+	for _, field := range fields {
+		fullname := field.Fullname
+		if byPath {
+			fullname = field.Path
+		}
+		for _, path := range expandPath(json, fullname) {
+			if value := gjson.Get(json, path); !value.IsObject() && !value.IsArray() && value.Type != gjson.Null {
+				masker.addValue(value.String(), field.masker)
+			}
+		}
+	}
+}
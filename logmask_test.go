@@ -0,0 +1,190 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+func TestLogMask(t *testing.T) {
+	var lock sync.Mutex
+	logs := make([]logchan.LogInforInterface, 0)
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		logs = append(logs, logInfo)
+	})
+	if err := container.SetLogMaskRules(dataexchanger.LogMaskRule{Strategy: "unknown", Key: "token"}); err == nil {
+		t.Error("unknown strategy want error")
+	}
+	err := container.SetLogMaskRules(
+		dataexchanger.LogMaskRule{Key: "token", Strategy: dataexchanger.MASK_ALL},
+		dataexchanger.LogMaskRule{Pattern: `sk_live_[0-9a-z]+`},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "logmask.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = provider.ExecOrQueryContext(ctx, `create table account (id integer primary key autoincrement, password text, id_card text, note text)`); err != nil {
+		t.Fatal(err)
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/account/create",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=password,dst=pwd,sensitive,required
+		fullname=idCard,dst=idCard,sensitive=partial,required
+		fullname=token,dst=token
+		fullname=note,dst=note`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=idCard,src=idCard,sensitive=partial,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		input:=storage.GetMemory()
+		execSQLTPL(ctx,"Create",input)
+		storage.Set("idCard",execSQLTPL(ctx,"Get",input))
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Create"}}insert into account (password,id_card,note) values (:pwd,:idCard,:note){{end}}
+	{{define "Get"}}select id_card from account where id_card=:idCard{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	password, idCard, token, apiKey := "p@ssw0rd-secret", "110101199001011234", "tok-123456", "sk_live_abc123"
+	input := fmt.Sprintf(`{"password":"%s","idCard":"%s","token":"%s","note":"key %s"}`, password, idCard, token, apiKey)
+	out, err := capi.Run(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, idCard) {
+		t.Errorf("output want unmasked,got:%s", out)
+	}
+
+	var runLog *dataexchanger.RunLogInfo
+	sqlLogs := 0
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && (runLog == nil || sqlLogs < 2) {
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		sqlLogs = 0
+		for _, logInfo := range logs {
+			if l, ok := dataexchanger.TryConvert2LogInfoRunLogInfo(logInfo); ok && l.Name == dataexchanger.LOG_INFO_RUN {
+				runLog = l
+			}
+			if _, ok := dataexchanger.TryConvert2LogInfoExecSQLWithArgs(logInfo); ok {
+				sqlLogs++
+			}
+		}
+		lock.Unlock()
+	}
+	if runLog == nil || sqlLogs < 2 {
+		t.Fatalf("want run log and 2 sql logs,got run:%v,sql:%d", runLog != nil, sqlLogs)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	sum := sha256.Sum256([]byte(password))
+	passwordHash := dataexchanger.MASK_HASH_PREFIX + hex.EncodeToString(sum[:])[:dataexchanger.MASK_HASH_LEN]
+	idCardPartial := "1101" + strings.Repeat("*", 10) + "1234"
+	for _, logInfo := range logs {
+		b, _ := json.Marshal(logInfo)
+		payload := string(b)
+		for _, raw := range []string{password, idCard, token, apiKey} {
+			if strings.Contains(payload, raw) {
+				t.Errorf("%s log leaks %s:%s", logInfo.GetName(), raw, payload)
+			}
+		}
+	}
+	for _, payload := range []string{runLog.OriginalInput, runLog.PreInput} {
+		if !strings.Contains(payload, passwordHash) || !strings.Contains(payload, idCardPartial) || !strings.Contains(payload, `"token":"****"`) {
+			t.Errorf("run log input want masked,got:%s", payload)
+		}
+	}
+	if !strings.Contains(runLog.Out, idCardPartial) {
+		t.Errorf("run log out want masked,got:%s", runLog.Out)
+	}
+}
+
+func TestLogMaskOwnerContainer(t *testing.T) {
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := dataexchanger.NewMemoryBroker()
+	brokerSource.SetProvider(broker)
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/token/sync",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,required`,
+		MainScript: `return`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.SetLogMaskRules(dataexchanger.LogMaskRule{Key: "token", Strategy: dataexchanger.MASK_ALL}); err != nil {
+		t.Fatal(err)
+	}
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	// 后创建的容器接管日志处理函数,未设置脱敏规则
+	consumed := make(chan *dataexchanger.LogInfoConsume, 10)
+	dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {
+		if l, ok := logInfo.(*dataexchanger.LogInfoConsume); ok {
+			consumed <- l
+		}
+	})
+	stop, err := container.StartConsumer(dataexchanger.DtoConsumer{Source: "mq", Queue: "tokens", Route: api.Route, Method: "post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	token := "tok-123456"
+	if err = broker.PublishMessage(context.Background(), dataexchanger.Message{ID: "1", Queue: "tokens", Body: `{"id":"1","token":"` + token + `"}`}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-consumed:
+		if strings.Contains(l.Message.Body, token) || !strings.Contains(l.Message.Body, `"token":"****"`) {
+			t.Errorf("consume log want masked by owner container rules,got:%s", l.Message.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("consume log not received")
+	}
+}
@@ -0,0 +1,185 @@
+package dataexchanger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/jsonschemaline"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	LINE_SCHEMA_KEY_MASK   = "mask"   // 输出行 schema 字段脱敏策略
+	LINE_SCHEMA_KEY_UNMASK = "unmask" // 拥有该权限的调用方可见原值,为空时所有调用方均脱敏
+
+	MASK_PHONE   = "phone"   // 保留前 3 位、后 4 位
+	MASK_EMAIL   = "email"   // 保留首字符和域名
+	MASK_NAME    = "name"    // 保留首字符
+	MASK_IDCARD  = "idcard"  // 保留前 6 位、后 4 位
+	MASK_ALL     = "all"     // 全部替换
+	MASK_HASH    = "hash"    // 替换为摘要,相同原值的摘要相同,便于关联排查
+	MASK_PARTIAL = "partial" // 保留前、后各四分之一
+
+	MASK_CHAR        = "*"
+	MASK_ALL_REPLACE = "****"
+	MASK_HASH_PREFIX = "sha256:"
+	MASK_HASH_LEN    = 16 // 摘要保留的十六进制字符数
+)
+
+// Masker 脱敏函数
+type Masker func(value string) (masked string)
+
+var (
+	maskers    = map[string]Masker{}
+	lockMasker sync.RWMutex
+)
+
+func init() {
+	RegisterMasker(MASK_PHONE, func(value string) string { return maskMiddle(value, 3, 4) })
+	RegisterMasker(MASK_IDCARD, func(value string) string { return maskMiddle(value, 6, 4) })
+	RegisterMasker(MASK_NAME, func(value string) string { return maskMiddle(value, 1, 0) })
+	RegisterMasker(MASK_EMAIL, maskEmail)
+	RegisterMasker(MASK_ALL, func(value string) string { return MASK_ALL_REPLACE })
+	RegisterMasker(MASK_HASH, maskHash)
+	RegisterMasker(MASK_PARTIAL, func(value string) string {
+		keep := len([]rune(value)) / 4
+		return maskMiddle(value, keep, keep)
+	})
+}
+
+// RegisterMasker 注册脱敏策略,同名覆盖
+func RegisterMasker(name string, masker Masker) {
+	lockMasker.Lock()
+	defer lockMasker.Unlock()
+	maskers[name] = masker
+}
+
+// GetMasker 获取脱敏策略
+func GetMasker(name string) (masker Masker, ok bool) {
+	lockMasker.RLock()
+	defer lockMasker.RUnlock()
+	masker, ok = maskers[name]
+	return masker, ok
+}
+
+// maskMiddle 保留前 prefix 个、后 suffix 个字符,其余替换为 *,长度不足时全部替换
+func maskMiddle(value string, prefix int, suffix int) string {
+	runes := []rune(value)
+	if len(runes) <= prefix+suffix {
+		return strings.Repeat(MASK_CHAR, len(runes))
+	}
+	return string(runes[:prefix]) + strings.Repeat(MASK_CHAR, len(runes)-prefix-suffix) + string(runes[len(runes)-suffix:])
+}
+
+func maskEmail(value string) string {
+	index := strings.LastIndex(value, "@")
+	if index < 0 {
+		return maskMiddle(value, 1, 0)
+	}
+	return maskMiddle(value[:index], 1, 0) + value[index:]
+}
+
+func maskHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return MASK_HASH_PREFIX + hex.EncodeToString(sum[:])[:MASK_HASH_LEN]
+}
+
+// fieldMask 输出字段脱敏声明
+type fieldMask struct {
+	Fullname   string
+	Strategy   string
+	Permission string // 可见原值需要的权限
+	masker     Masker
+}
+
+// parseFieldMasks 解析输出行 schema 中的 mask、unmask 属性
+func parseFieldMasks(l *jsonschemaline.Jsonschemaline) (masks []fieldMask, err error) {
+	for _, item := range l.Items {
+		mask := fieldMask{Fullname: item.Fullname}
+		for _, kv := range item.TagLineKVpair {
+			switch kv.Key {
+			case LINE_SCHEMA_KEY_MASK:
+				mask.Strategy = kv.Value
+			case LINE_SCHEMA_KEY_UNMASK:
+				mask.Permission = kv.Value
+			}
+		}
+		if mask.Strategy == "" {
+			if mask.Permission != "" {
+				err = errors.Errorf("output line schema unmask required mask,fullname:%s", item.Fullname)
+				return nil, err
+			}
+			continue
+		}
+		masker, ok := GetMasker(mask.Strategy)
+		if !ok {
+			err = errors.Errorf("output line schema mask strategy not found:%s,fullname:%s", mask.Strategy, item.Fullname)
+			return nil, err
+		}
+		mask.masker = masker
+		masks = append(masks, mask)
+	}
+	return masks, nil
+}
+
+// expandPath 将含 [] 的字段全称展开为 json 中实际存在的路径
+func expandPath(json string, fullname string) (paths []string) {
+	index := strings.Index(fullname, "[]")
+	if index < 0 {
+		if gjson.Get(json, fullname).Exists() {
+			paths = append(paths, fullname)
+		}
+		return paths
+	}
+	prefix := strings.TrimSuffix(fullname[:index], ".")
+	rest := strings.TrimPrefix(fullname[index+2:], ".")
+	arrayPath := prefix
+	if arrayPath == "" {
+		arrayPath = "@this"
+	}
+	for i, element := range gjson.Get(json, arrayPath).Array() {
+		elementPath := strconv.Itoa(i)
+		if prefix != "" {
+			elementPath = prefix + "." + elementPath
+		}
+		if rest == "" {
+			paths = append(paths, elementPath)
+			continue
+		}
+		for _, sub := range expandPath(element.Raw, rest) {
+			paths = append(paths, elementPath+"."+sub)
+		}
+	}
+	return paths
+}
+
+// maskOutput 按输出行 schema 的声明对输出脱敏,调用方拥有 unmask 权限的字段保留原值
+func (capi *apiCompiled) maskOutput(ctx context.Context, out string) (masked string, err error) {
+	if len(capi.masks) == 0 || out == "" {
+		return out, nil
+	}
+	principal := GetPrincipal(ctx)
+	masked = out
+	for _, mask := range capi.masks {
+		if mask.Permission != "" && principal.HasPermission(mask.Permission) {
+			continue
+		}
+		for _, path := range expandPath(masked, mask.Fullname) {
+			value := gjson.Get(masked, path)
+			if value.Type == gjson.Null || value.IsObject() || value.IsArray() {
+				continue
+			}
+			if masked, err = sjson.Set(masked, path, mask.masker(value.String())); err != nil {
+				err = errors.WithMessagef(err, "apiCompiled.maskOutput,route:%s,fullname:%s", capi.Route, mask.Fullname)
+				return "", err
+			}
+		}
+	}
+	return masked, nil
+}
@@ -0,0 +1,274 @@
+package dataexchanger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+const (
+	OUTBOX_TABLE_DEFAULT = "dataexchanger_outbox"
+	OUTBOX_TIME_LAYOUT   = "2006-01-02 15:04:05.000" // 时间以 UTC 字符串保存,兼容各方言且可按字符串比较
+
+	OUTBOX_STATUS_PENDING = 0 // 待发布
+	OUTBOX_STATUS_SENT    = 1 // 已发布
+	OUTBOX_STATUS_DEAD    = 2 // 超过重试次数,不再发布
+
+	OUTBOX_INFLIGHT_DELAY = 10 * time.Second // 写入后由执行方立即发布,中继延迟接管,避免重复发布
+
+	OUTBOX_RELAY_INTERVAL_DEFAULT     = time.Second
+	OUTBOX_RELAY_BATCH_SIZE_DEFAULT   = 100
+	OUTBOX_RELAY_MAX_ATTEMPTS_DEFAULT = 10
+	OUTBOX_RELAY_BACKOFF_DEFAULT      = time.Second
+	OUTBOX_RELAY_MAX_BACKOFF_DEFAULT  = 5 * time.Minute
+	OUTBOX_RELAY_LEASE_DEFAULT        = 30 * time.Second
+)
+
+// OutboxRelayConfig outbox 中继配置,零值使用默认值
+type OutboxRelayConfig struct {
+	Table       string        `json:"table"`       // outbox 表名
+	Interval    time.Duration `json:"interval"`    // 轮询间隔
+	BatchSize   int           `json:"batchSize"`   // 单次读取条数
+	MaxAttempts int           `json:"maxAttempts"` // 最大发布次数,超过后标记为 dead
+	Backoff     time.Duration `json:"backoff"`     // 首次重试延迟,之后翻倍
+	MaxBackoff  time.Duration `json:"maxBackoff"`  // 重试延迟上限
+	Lease       time.Duration `json:"lease"`       // 认领消息的租期,中继在租期内未标记结果时消息可被重新认领
+}
+
+func (cfg OutboxRelayConfig) withDefaults() OutboxRelayConfig {
+	if cfg.Table == "" {
+		cfg.Table = OUTBOX_TABLE_DEFAULT
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = OUTBOX_RELAY_INTERVAL_DEFAULT
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = OUTBOX_RELAY_BATCH_SIZE_DEFAULT
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = OUTBOX_RELAY_MAX_ATTEMPTS_DEFAULT
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = OUTBOX_RELAY_BACKOFF_DEFAULT
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = OUTBOX_RELAY_MAX_BACKOFF_DEFAULT
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = OUTBOX_RELAY_LEASE_DEFAULT
+	}
+	return cfg
+}
+
+// backoff 第 attempts 次失败后的重试延迟
+func (cfg OutboxRelayConfig) backoff(attempts int) (delay time.Duration) {
+	delay = cfg.Backoff
+	for i := 1; i < attempts && delay < cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > cfg.MaxBackoff {
+		delay = cfg.MaxBackoff
+	}
+	return delay
+}
+
+// OutboxDDL outbox 表建表语句,table 为空时使用默认表名
+func OutboxDDL(d Dialect, table string) string {
+	if table == "" {
+		table = OUTBOX_TABLE_DEFAULT
+	}
+	return fmt.Sprintf(`create table if not exists %s (
+	id varchar(64) not null primary key,
+	source varchar(128) not null,
+	queue varchar(255) not null,
+	body text not null,
+	headers text not null,
+	status int not null default 0,
+	attempts int not null default 0,
+	last_error text,
+	next_at varchar(32) not null,
+	created_at varchar(32) not null,
+	sent_at varchar(32)
+)`, d.Quote(table))
+}
+
+// outboxTime 统一使用 UTC,避免夏令时切换时重复或跳变,不同时区的实例比较结果一致
+func outboxTime(t time.Time) string {
+	return t.UTC().Format(OUTBOX_TIME_LAYOUT)
+}
+
+// markOutboxMessage 记录发布结果:成功标记为已发布;失败累计次数、记录错误并按退避设置下次发布时间,超过次数标记为 dead
+func markOutboxMessage(ctx context.Context, outbox *DBProvider, cfg OutboxRelayConfig, id string, attempts int, publishErr error) (err error) {
+	d := outbox.Dialect()
+	attempts++
+	now := time.Now()
+	data := map[string]interface{}{
+		"id":       id,
+		"attempts": attempts,
+		"now":      outboxTime(now),
+	}
+	named := fmt.Sprintf(`update %s set status=%d,attempts=:attempts,sent_at=:now where id=:id`, d.Quote(cfg.Table), OUTBOX_STATUS_SENT)
+	if publishErr != nil {
+		status := OUTBOX_STATUS_PENDING
+		if attempts >= cfg.MaxAttempts {
+			status = OUTBOX_STATUS_DEAD
+		}
+		data["lastError"] = publishErr.Error()
+		data["nextAt"] = outboxTime(now.Add(cfg.backoff(attempts)))
+		named = fmt.Sprintf(`update %s set status=%d,attempts=:attempts,last_error=:lastError,next_at=:nextAt where id=:id`, d.Quote(cfg.Table), status)
+	}
+	statement, args, err := toStatement(d, named, data)
+	if err != nil {
+		return err
+	}
+	_, err = execOrQueryContext(ctx, outbox.GetDB(), statement, args...)
+	return err
+}
+
+// outboxRow outbox 表中待发布的消息
+type outboxRow struct {
+	outboxMessage
+	attempts int
+	nextAt   string
+}
+
+// claimOutboxRows 读取到期的待发布消息并逐条认领:将 next_at 推迟一个租期,条件更新成功的才由本中继发布,
+// 多个中继实例同时运行时同一消息不会被重复发布;不依赖 for update skip locked,各方言通用
+func claimOutboxRows(ctx context.Context, outbox *DBProvider, cfg OutboxRelayConfig) (claimed []outboxRow, err error) {
+	rows, err := pendingOutboxRows(ctx, outbox, cfg)
+	if err != nil {
+		return nil, err
+	}
+	d := outbox.Dialect()
+	named := fmt.Sprintf(`update %s set next_at=:leaseUntil where id=:id and status=%d and next_at=:nextAt`, d.Quote(cfg.Table), OUTBOX_STATUS_PENDING)
+	leaseUntil := outboxTime(time.Now().Add(cfg.Lease))
+	for _, row := range rows {
+		data := map[string]interface{}{
+			"id":         row.ID,
+			"nextAt":     row.nextAt,
+			"leaseUntil": leaseUntil,
+		}
+		statement, args, err := toStatement(d, named, data)
+		if err != nil {
+			return nil, err
+		}
+		res, err := outbox.GetDB().ExecContext(ctx, statement, args...)
+		if err != nil {
+			return nil, err
+		}
+		if affected, _ := res.RowsAffected(); affected == 1 {
+			claimed = append(claimed, row)
+		}
+	}
+	return claimed, nil
+}
+
+func pendingOutboxRows(ctx context.Context, outbox *DBProvider, cfg OutboxRelayConfig) (rows []outboxRow, err error) {
+	d := outbox.Dialect()
+	named := fmt.Sprintf(`select id,source,queue,body,headers,attempts,next_at from %s where status=%d and next_at<=:now order by next_at %s`, d.Quote(cfg.Table), OUTBOX_STATUS_PENDING, d.Limit("offset", "limit"))
+	data := map[string]interface{}{
+		"now":    outboxTime(time.Now()),
+		"offset": 0,
+		"limit":  cfg.BatchSize,
+	}
+	statement, args, err := toStatement(d, named, data)
+	if err != nil {
+		return nil, err
+	}
+	sqlRows, err := outbox.GetDB().QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlRows.Close()
+	for sqlRows.Next() {
+		var row outboxRow
+		var headers sql.NullString
+		if err = sqlRows.Scan(&row.ID, &row.Source, &row.Queue, &row.Body, &headers, &row.attempts, &row.nextAt); err != nil {
+			return nil, err
+		}
+		if headers.String != "" {
+			if err = json.Unmarshal([]byte(headers.String), &row.Headers); err != nil {
+				return nil, err
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, sqlRows.Err()
+}
+
+// getPublisher 在已注册 api 的资源中查找消息资源
+func (c *Container) getPublisher(ctx context.Context, sourceIdentifer string) (publisher MessagePublisher, err error) {
+	c.lockCApi.Lock()
+	apis := make([]*apiCompiled, 0, len(c.apis))
+	for _, capi := range c.apis {
+		apis = append(apis, capi)
+	}
+	c.lockCApi.Unlock()
+	for _, capi := range apis {
+		if publisher, err = capi.getPublisher(ctx, sourceIdentifer); err == nil {
+			return publisher, nil
+		}
+	}
+	err = errors.Errorf("message source not found:%s", sourceIdentifer)
+	return nil, err
+}
+
+// RelayOutbox 认领一批到期的待发布消息并发布,返回成功发布的条数
+func (c *Container) RelayOutbox(ctx context.Context, outbox *DBProvider, cfg OutboxRelayConfig) (sent int, err error) {
+	cfg = cfg.withDefaults()
+	rows, err := claimOutboxRows(ctx, outbox, cfg)
+	if err != nil {
+		err = errors.WithMessage(err, "Container.RelayOutbox")
+		return 0, err
+	}
+	for _, row := range rows {
+		publisher, publishErr := c.getPublisher(ctx, row.Source)
+		if publishErr == nil {
+			publishErr = publisher.PublishMessage(ctx, row.Message)
+		}
+		logchan.SendLogInfo(&LogInfoAfterEvent{Context: ctx, Source: row.Source, Message: row.Message, Err: publishErr, container: c})
+		if err = markOutboxMessage(ctx, outbox, cfg, row.ID, row.attempts, publishErr); err != nil {
+			err = errors.WithMessage(err, "Container.RelayOutbox")
+			return sent, err
+		}
+		if publishErr == nil {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// StartOutboxRelay 按间隔轮询 outbox 表发布消息,返回停止函数(等待当前批次结束)
+func (c *Container) StartOutboxRelay(outbox *DBProvider, cfg OutboxRelayConfig) (stop func()) {
+	cfg = cfg.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if _, err := c.RelayOutbox(ctx, outbox, cfg); err != nil && !errors.Is(err, context.Canceled) {
+				logchan.SendLogInfo(&LogInfoAfterEvent{Context: ctx, Err: err, container: c})
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
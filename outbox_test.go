@@ -0,0 +1,169 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestOutboxRelay(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "relay.db"))
+	outbox, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = outbox.ExecOrQueryContext(ctx, dataexchanger.OutboxDDL(outbox.Dialect(), "")); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(id string, source string) {
+		sql := fmt.Sprintf(`insert into dataexchanger_outbox (id,source,queue,body,headers,next_at,created_at) values ('%s','%s','order.paid','{"id":"%s"}','{}','2000-01-01 00:00:00.000','2000-01-01 00:00:00.000')`, id, source, id)
+		if _, err := outbox.ExecOrQueryContext(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func(id string) string {
+		out, err := outbox.ExecOrQueryContext(ctx, fmt.Sprintf(`select status,attempts from dataexchanger_outbox where id='%s'`, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gjson.Get(out, "#.[status,attempts]").Raw
+	}
+
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := dataexchanger.NewMemoryBroker()
+	brokerSource.SetProvider(broker)
+	capi, err := dataexchanger.NewApiCompiled(&dataexchanger.DtoAPI{Methods: "post", Route: "/api/order/pay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := dataexchanger.OutboxRelayConfig{MaxAttempts: 2, Backoff: time.Millisecond, Interval: 10 * time.Millisecond}
+	insert("1", "mq")
+	insert("2", "unknown")
+	broker.SetFailTimes(1)
+	sent, err := container.RelayOutbox(ctx, outbox, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 || status("1") != `[["0","1"]]` || status("2") != `[["0","1"]]` {
+		t.Fatalf("first relay sent:%d,status:%s %s", sent, status("1"), status("2"))
+	}
+	time.Sleep(20 * time.Millisecond) // 等待退避
+	if sent, err = container.RelayOutbox(ctx, outbox, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || status("1") != `[["1","2"]]` {
+		t.Errorf("retry relay sent:%d,status:%s", sent, status("1"))
+	}
+	if got := status("2"); got != fmt.Sprintf(`[["%d","2"]]`, dataexchanger.OUTBOX_STATUS_DEAD) {
+		t.Errorf("unknown source want dead,got:%s", got)
+	}
+
+	stop := container.StartOutboxRelay(outbox, cfg)
+	defer stop()
+	insert("3", "mq")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(broker.Messages("order.paid")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	messages := broker.Messages("order.paid")
+	if len(messages) != 2 || messages[1].ID != "3" || status("3") != `[["1","1"]]` {
+		t.Errorf("background relay got:%+v,status:%s", messages, status("3"))
+	}
+}
+
+func TestOutboxRelayClaim(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"file:%s?_pragma=busy_timeout(5000)"}`, filepath.Join(t.TempDir(), "claim.db"))
+	outbox, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = outbox.ExecOrQueryContext(ctx, dataexchanger.OutboxDDL(outbox.Dialect(), "")); err != nil {
+		t.Fatal(err)
+	}
+	total := 50
+	for i := 0; i < total; i++ {
+		sql := fmt.Sprintf(`insert into dataexchanger_outbox (id,source,queue,body,headers,next_at,created_at) values ('%d','mq','order.paid','{}','{}','2000-01-01 00:00:00.000','2000-01-01 00:00:00.000')`, i)
+		if _, err := outbox.ExecOrQueryContext(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &slowBroker{MemoryBroker: dataexchanger.NewMemoryBroker()}
+	brokerSource.SetProvider(broker)
+	capi, err := dataexchanger.NewApiCompiled(&dataexchanger.DtoAPI{Methods: "post", Route: "/api/order/pay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := dataexchanger.OutboxRelayConfig{BatchSize: 10}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ { // 多个中继同时运行
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				sent, err := container.RelayOutbox(ctx, outbox, cfg)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if sent == 0 {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	messages := broker.Messages("order.paid")
+	ids := make(map[string]bool)
+	for _, message := range messages {
+		if ids[message.ID] {
+			t.Errorf("message published more than once:%s", message.ID)
+		}
+		ids[message.ID] = true
+	}
+	if len(ids) != total {
+		t.Errorf("want %d messages published,got:%d", total, len(ids))
+	}
+}
+
+// slowBroker 发布耗时的消息资源,使多个中继的批次相互重叠
+type slowBroker struct {
+	*dataexchanger.MemoryBroker
+}
+
+func (b *slowBroker) PublishMessage(ctx context.Context, message dataexchanger.Message) (err error) {
+	time.Sleep(time.Millisecond)
+	return b.MemoryBroker.PublishMessage(ctx, message)
+}
@@ -0,0 +1,214 @@
+package dataexchanger
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengotemplate"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	PAGINATE_MODE_OFFSET = "offset" // 页码分页
+	PAGINATE_MODE_CURSOR = "cursor" // 游标(keyset)分页
+
+	PAGINATE_DST_DEFAULT       = "paginate"
+	PAGINATE_PAGE_SIZE_DEFAULT = 20
+
+	// 分页输入字段
+	PAGINATE_INPUT_PAGE_INDEX = "pageIndex"
+	PAGINATE_INPUT_PAGE_SIZE  = "pageSize"
+	PAGINATE_INPUT_CURSOR     = "cursor"
+
+	// 分页模板变量,模板中可直接使用
+	PAGINATE_VAR_LIMIT  = "Limit"
+	PAGINATE_VAR_OFFSET = "Offset"
+	PAGINATE_VAR_CURSOR = "Cursor"
+)
+
+var identiferRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// DtoPaginate 分页声明,基于一个基础查询模板自动生成总数查询和分页查询
+type DtoPaginate struct {
+	Template        string `json:"template"`        // 基础查询模板名称,模板中不包含 limit
+	Mode            string `json:"mode"`            // offset(默认)、cursor
+	DefaultPageSize int    `json:"defaultPageSize"` // 未传 pageSize 时使用,默认 20
+	MaxPageSize     int    `json:"maxPageSize"`     // pageSize 上限,0 表示不限制
+	CursorColumn    string `json:"cursorColumn"`    // 游标分页的排序字段,值需唯一且递增
+	Dst             string `json:"dst"`             // 结果写入 storage 的路径,默认 paginate
+}
+
+func (p DtoPaginate) validate() (err error) {
+	if p.Template == "" {
+		err = errors.New("paginate template required")
+		return err
+	}
+	switch p.Mode {
+	case "", PAGINATE_MODE_OFFSET:
+	case PAGINATE_MODE_CURSOR:
+		if !identiferRegexp.MatchString(p.CursorColumn) { // 字段名直接拼接到sql中,必须是合法标识符
+			err = errors.Errorf("paginate mode %s required cursorColumn as identifier,got:%s", PAGINATE_MODE_CURSOR, p.CursorColumn)
+			return err
+		}
+	default:
+		err = errors.Errorf("paginate mode want offset/cursor,got:%s", p.Mode)
+		return err
+	}
+	return nil
+}
+
+func (p DtoPaginate) pageSize(input map[string]interface{}) (pageSize int) {
+	pageSize = toInt(input[PAGINATE_INPUT_PAGE_SIZE])
+	if pageSize <= 0 {
+		pageSize = p.DefaultPageSize
+	}
+	if pageSize <= 0 {
+		pageSize = PAGINATE_PAGE_SIZE_DEFAULT
+	}
+	if p.MaxPageSize > 0 && pageSize > p.MaxPageSize {
+		pageSize = p.MaxPageSize
+	}
+	return pageSize
+}
+
+// paginate 执行分页查询,结果格式 {"items":[],"pageInfo":{}}
+func (capi *apiCompiled) paginate(ctx context.Context, input map[string]interface{}) (out string, err error) {
+	p := capi.pagination
+	volume := newVolume(input)
+	dialect := capi.templateDialect(ctx, p.Template)
+	volume.SetValue(VOLUME_KEY_DIALECT, dialect.Name())
+	named, volumeI, err := capi.template.Exec(p.Template, volume)
+	if err != nil {
+		return "", err
+	}
+	data := volumeI.ToMap()
+	named = strings.TrimRight(strings.TrimSpace(named), ";")
+	pageSize := p.pageSize(input)
+	if p.Mode == PAGINATE_MODE_CURSOR {
+		return capi.paginateByCursor(ctx, named, data, pageSize, input)
+	}
+
+	pageIndex := toInt(input[PAGINATE_INPUT_PAGE_INDEX])
+	if pageIndex < 0 {
+		pageIndex = 0
+	}
+	countSQL := fmt.Sprintf("select count(*) as count from (%s) as _paginate", named)
+	totalStr, err := capi.execNamedSQL(ctx, p.Template, countSQL, data)
+	if err != nil {
+		err = errors.WithMessage(err, "paginate count")
+		return "", err
+	}
+	total := toInt(totalStr)
+	items := "[]"
+	if total > 0 {
+		data[PAGINATE_VAR_LIMIT] = pageSize
+		data[PAGINATE_VAR_OFFSET] = pageIndex * pageSize
+		pageSQL := fmt.Sprintf("%s %s", named, dialect.Limit(PAGINATE_VAR_OFFSET, PAGINATE_VAR_LIMIT))
+		rows, err := capi.execNamedSQL(ctx, p.Template, pageSQL, data)
+		if err != nil {
+			err = errors.WithMessage(err, "paginate page")
+			return "", err
+		}
+		items = rowsToArray(rows)
+	}
+	out, _ = sjson.SetRaw("", "items", items)
+	out, _ = sjson.Set(out, "pageInfo.pageIndex", pageIndex)
+	out, _ = sjson.Set(out, "pageInfo.pageSize", pageSize)
+	out, _ = sjson.Set(out, "pageInfo.total", total)
+	return out, nil
+}
+
+// paginateByCursor 游标分页,多取一条用于判断是否还有下一页
+func (capi *apiCompiled) paginateByCursor(ctx context.Context, named string, data map[string]interface{}, pageSize int, input map[string]interface{}) (out string, err error) {
+	p := capi.pagination
+	cursor := ""
+	if v, ok := input[PAGINATE_INPUT_CURSOR]; ok && v != nil {
+		cursor = fmt.Sprint(v)
+	}
+	where := ""
+	if cursor != "" {
+		where = fmt.Sprintf(" where _paginate.%s > :%s", p.CursorColumn, PAGINATE_VAR_CURSOR)
+		data[PAGINATE_VAR_CURSOR] = cursor
+	}
+	data[PAGINATE_VAR_LIMIT] = pageSize + 1
+	pageSQL := fmt.Sprintf("select * from (%s) as _paginate%s order by _paginate.%s limit :%s", named, where, p.CursorColumn, PAGINATE_VAR_LIMIT)
+	rows, err := capi.execNamedSQL(ctx, p.Template, pageSQL, data)
+	if err != nil {
+		err = errors.WithMessage(err, "paginate cursor")
+		return "", err
+	}
+	all := jsonRows(rowsToArray(rows))
+	hasMore := len(all) > pageSize
+	if hasMore {
+		all = all[:pageSize]
+	}
+	raws := make([]string, 0, len(all))
+	nextCursor := ""
+	for _, row := range all {
+		raws = append(raws, row.Raw)
+		nextCursor = row.Get(escapePathKey(p.CursorColumn)).String()
+	}
+	if !hasMore {
+		nextCursor = ""
+	}
+	out, _ = sjson.SetRaw("", "items", "["+strings.Join(raws, ",")+"]")
+	out, _ = sjson.Set(out, "pageInfo.pageSize", pageSize)
+	out, _ = sjson.Set(out, "pageInfo.cursor", cursor)
+	out, _ = sjson.Set(out, "pageInfo.nextCursor", nextCursor)
+	out, _ = sjson.Set(out, "pageInfo.hasMore", hasMore)
+	return out, nil
+}
+
+// rowsToArray 查询结果统一为数组(单行单列的结果会被 ExecOrQueryContext 简化为值,此处忽略)
+func rowsToArray(rows string) (arr string) {
+	result := gjson.Parse(rows)
+	if result.IsArray() {
+		return result.Raw
+	}
+	if result.IsObject() {
+		return "[" + result.Raw + "]"
+	}
+	return "[]"
+}
+
+// tengoMapToInterface storage.Memory 转为模板数据
+func tengoMapToInterface(obj tengo.Object) (m map[string]interface{}) {
+	m = make(map[string]interface{})
+	tengoMap, ok := obj.(*tengo.Map)
+	if !ok {
+		return m
+	}
+	for k, v := range tengoMap.Value {
+		m[k] = tengo.ToInterface(v)
+	}
+	return m
+}
+
+func newVolume(data map[string]interface{}) (volume *tengotemplate.VolumeMap) {
+	volume = &tengotemplate.VolumeMap{}
+	for k, v := range data {
+		volume.SetValue(k, v)
+	}
+	return volume
+}
+
+func toInt(v interface{}) (i int) {
+	switch val := v.(type) {
+	case int:
+		return val
+	case int64:
+		return int(val)
+	case float64:
+		return int(val)
+	case string:
+		i, _ = strconv.Atoi(strings.TrimSpace(val))
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/tidwall/gjson"
+)
+
+func newPaginateAPI(t *testing.T, paginate *dataexchanger.DtoPaginate, inOut map[string]string) (out func(input string) string) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/components",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=pageIndex,dst=pageIndex,format=number
+		fullname=pageSize,dst=pageSize,format=number
+		fullname=cursor,dst=cursor`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=items[].id,src=paginate.items.#.id,required
+		fullname=pageInfo,src=paginate.pageInfo,type=object,required`,
+		Paginate: paginate,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.SetProvider(&tengodb.TengoMemoryDB{InOutMap: inOut})
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "List"}}select id from component where deleted_at is null;{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	return func(input string) string {
+		out, err := capi.Run(context.Background(), input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gjson.Get(out, "[items,pageInfo]").Raw // 固定字段顺序
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	run := newPaginateAPI(t, &dataexchanger.DtoPaginate{Template: "List", MaxPageSize: 2}, map[string]string{
+		"select count(*) as count from (select id from component where deleted_at is null) as _paginate": "3",
+		"select id from component where deleted_at is null limit 2,2":                                    `[{"id":"3"}]`,
+	})
+	out := run(`{"pageIndex":"1","pageSize":"10"}`)
+	want := `[[{"id":"3"}],{"pageIndex":1,"pageSize":2,"total":3}]`
+	if out != want {
+		t.Errorf("want:%s\ngot: %s", want, out)
+	}
+}
+
+func TestPaginateCursor(t *testing.T) {
+	run := newPaginateAPI(t, &dataexchanger.DtoPaginate{Template: "List", Mode: dataexchanger.PAGINATE_MODE_CURSOR, CursorColumn: "id", DefaultPageSize: 2}, map[string]string{
+		"select * from (select id from component where deleted_at is null) as _paginate order by _paginate.id limit 3":                          `[{"id":"1"},{"id":"2"},{"id":"3"}]`,
+		"select * from (select id from component where deleted_at is null) as _paginate where _paginate.id > '2' order by _paginate.id limit 3": `[{"id":"3"}]`,
+	})
+	out := run(`{}`)
+	want := `[[{"id":"1"},{"id":"2"}],{"pageSize":2,"cursor":"","nextCursor":"2","hasMore":true}]`
+	if out != want {
+		t.Errorf("want:%s\ngot: %s", want, out)
+	}
+	out = run(`{"cursor":"2"}`)
+	want = `[[{"id":"3"}],{"pageSize":2,"cursor":"2","nextCursor":"","hasMore":false}]`
+	if out != want {
+		t.Errorf("want:%s\ngot: %s", want, out)
+	}
+}
@@ -0,0 +1,260 @@
+package dataexchanger
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+	"github.com/suifengpiao14/tengolib/tengodb"
+)
+
+const (
+	REPLICA_STRATEGY_ROUND_ROBIN  = "roundRobin"  // 轮询
+	REPLICA_STRATEGY_LEAST_LOADED = "leastLoaded" // 执行中请求最少
+
+	DB_ROUTE_PRIMARY = "primary" // 模板强制走主库
+	DB_ROUTE_REPLICA = "replica" // 模板读操作强制走从库(即使本次执行已写入主库)
+
+	CONTEXT_KEY_DB_ROUTE = ContextKeyType("dbRoute")
+)
+
+// ReplicaDBConfig 读写分离资源配置
+type ReplicaDBConfig struct {
+	Dialect       string     `json:"dialect"`
+	Driver        string     `json:"driver"`
+	StmtCacheSize int        `json:"stmtCacheSize"`
+	Strategy      string     `json:"strategy"` // roundRobin(默认)、leastLoaded
+	Primary       DBConfig   `json:"primary"`
+	Replicas      []DBConfig `json:"replicas"`
+}
+
+type replicaNode struct {
+	provider *DBProvider
+	inflight int64
+}
+
+// ReplicaDBProvider 一主多从的 sql 资源,读操作路由到从库,写操作、事务路由到主库,
+// 单次 Run 内发生写操作后,后续读操作固定到主库
+type ReplicaDBProvider struct {
+	tengo.ImmutableMap
+	config   string
+	primary  *DBProvider
+	replicas []*replicaNode
+	strategy string
+	next     uint64
+	shares   int // NewReplicaDBProvider 返回的次数,全部 release 后释放各节点
+}
+
+var (
+	replicaDBProviderMap  = make(map[string]*ReplicaDBProvider)
+	replicaDBProviderLock sync.Mutex
+)
+
+// NewReplicaDBProvider 相同配置共用一组连接池
+func NewReplicaDBProvider(config string) (p *ReplicaDBProvider, err error) {
+	replicaDBProviderLock.Lock()
+	defer replicaDBProviderLock.Unlock()
+	p, ok := replicaDBProviderMap[config]
+	if ok {
+		p.shares++
+		return p, nil
+	}
+	cfg := &ReplicaDBConfig{}
+	err = json.Unmarshal([]byte(config), cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Strategy {
+	case "", REPLICA_STRATEGY_ROUND_ROBIN, REPLICA_STRATEGY_LEAST_LOADED:
+	default:
+		err = errors.Errorf("replica strategy want roundRobin/leastLoaded,got:%s", cfg.Strategy)
+		return nil, err
+	}
+	newNode := func(nodeCfg DBConfig) (provider *DBProvider, err error) {
+		if nodeCfg.Dialect == "" {
+			nodeCfg.Dialect = cfg.Dialect
+		}
+		if nodeCfg.Driver == "" {
+			nodeCfg.Driver = cfg.Driver
+		}
+		if nodeCfg.StmtCacheSize == 0 {
+			nodeCfg.StmtCacheSize = cfg.StmtCacheSize
+		}
+		nodeConfig, err := json.Marshal(nodeCfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewDBProvider(string(nodeConfig))
+	}
+	p = &ReplicaDBProvider{
+		ImmutableMap: tengo.ImmutableMap{
+			Value: make(map[string]tengo.Object),
+		},
+		config:   config,
+		strategy: cfg.Strategy,
+		shares:   1,
+	}
+	if p.primary, err = newNode(cfg.Primary); err != nil {
+		err = errors.WithMessage(err, "NewReplicaDBProvider.primary")
+		return nil, err
+	}
+	for _, replicaCfg := range cfg.Replicas {
+		provider, err := newNode(replicaCfg)
+		if err != nil { // 释放已创建的节点,避免连接池泄漏
+			p.primary.release()
+			for _, node := range p.replicas {
+				node.provider.release()
+			}
+			err = errors.WithMessage(err, "NewReplicaDBProvider.replica")
+			return nil, err
+		}
+		p.replicas = append(p.replicas, &replicaNode{provider: provider})
+	}
+	//注入tengo 脚本方法
+	methods := map[string]tengo.CallableFunc{
+		"execOrQueryContext": p.TengoExecOrQueryContext,
+		"beginTx":            p.BeginTx,
+	}
+	for key, method := range methods {
+		p.Value[key] = &tengo.UserFunction{
+			Name:  key,
+			Value: method,
+		}
+	}
+	replicaDBProviderMap[config] = p
+	return p, nil
+}
+
+func (p *ReplicaDBProvider) TypeName() string {
+	return "db-replica"
+}
+func (p *ReplicaDBProvider) String() string {
+	return ""
+}
+
+func (p *ReplicaDBProvider) Primary() *DBProvider {
+	return p.primary
+}
+
+func (p *ReplicaDBProvider) Replicas() (providers []*DBProvider) {
+	for _, node := range p.replicas {
+		providers = append(providers, node.provider)
+	}
+	return providers
+}
+
+// Close 释放一次 NewReplicaDBProvider 获得的主从连接池,与其他资源共用的节点在全部使用方关闭后才关闭
+func (p *ReplicaDBProvider) Close() (err error) {
+	return p.release()
+}
+
+// release 释放一次 NewReplicaDBProvider 获得的引用,全部释放后释放各节点(节点可能与其他资源共用)
+func (p *ReplicaDBProvider) release() (err error) {
+	replicaDBProviderLock.Lock()
+	p.shares--
+	closing := p.shares <= 0
+	if closing && replicaDBProviderMap[p.config] == p {
+		delete(replicaDBProviderMap, p.config)
+	}
+	replicaDBProviderLock.Unlock()
+	if !closing {
+		return nil
+	}
+	err = p.primary.release()
+	for _, node := range p.replicas {
+		if releaseErr := node.provider.release(); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+func (p *ReplicaDBProvider) Dialect() Dialect {
+	return p.primary.Dialect()
+}
+
+// route 选择执行节点,返回从库节点时需在执行后减少计数
+func (p *ReplicaDBProvider) route(ctx context.Context, statement string) (provider *DBProvider, node *replicaNode) {
+	state := getRunState(ctx)
+	isRead := tengodb.SQLType(statement) == tengodb.SQL_TYPE_SELECT
+	route, _ := ctx.Value(CONTEXT_KEY_DB_ROUTE).(string)
+	if !isRead {
+		if state != nil {
+			state.pinPrimary(p) // 写操作后本次执行固定主库,避免主从延迟读到旧数据
+		}
+		return p.primary, nil
+	}
+	if route == DB_ROUTE_PRIMARY || len(p.replicas) == 0 {
+		return p.primary, nil
+	}
+	if route != DB_ROUTE_REPLICA && state != nil && state.isPinnedPrimary(p) {
+		return p.primary, nil
+	}
+	node = p.pickReplica()
+	atomic.AddInt64(&node.inflight, 1)
+	return node.provider, node
+}
+
+func (p *ReplicaDBProvider) pickReplica() (node *replicaNode) {
+	if p.strategy == REPLICA_STRATEGY_LEAST_LOADED {
+		node = p.replicas[0]
+		for _, candidate := range p.replicas[1:] {
+			if atomic.LoadInt64(&candidate.inflight) < atomic.LoadInt64(&node.inflight) {
+				node = candidate
+			}
+		}
+		return node
+	}
+	index := atomic.AddUint64(&p.next, 1) - 1
+	return p.replicas[index%uint64(len(p.replicas))]
+}
+
+func (p *ReplicaDBProvider) done(node *replicaNode) {
+	if node != nil {
+		atomic.AddInt64(&node.inflight, -1)
+	}
+}
+
+// ExecOrQueryContext 实现 tengodb.TengoDBInterface
+func (p *ReplicaDBProvider) ExecOrQueryContext(ctx context.Context, sqls string) (out string, err error) {
+	provider, node := p.route(ctx, sqls)
+	defer p.done(node)
+	return provider.ExecOrQueryContext(ctx, sqls)
+}
+
+// ExecOrQueryArgsContext 实现 SQLArgsExecutor
+func (p *ReplicaDBProvider) ExecOrQueryArgsContext(ctx context.Context, statement string, args ...interface{}) (out string, err error) {
+	provider, node := p.route(ctx, statement)
+	defer p.done(node)
+	return provider.ExecOrQueryArgsContext(ctx, statement, args...)
+}
+
+func (p *ReplicaDBProvider) TengoExecOrQueryContext(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	ctx := context.Background()
+	if ctxObj, ok := args[0].(*tengocontext.TengoContext); ok {
+		ctx = ctxObj.Context
+	}
+	sqls, _ := tengo.ToString(args[1])
+	provider, node := p.route(ctx, sqls)
+	defer p.done(node)
+	return provider.TengoExecOrQueryContext(args...)
+}
+
+// BeginTx 事务始终在主库,并固定本次执行后续读操作到主库
+func (p *ReplicaDBProvider) BeginTx(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) == 1 {
+		if ctxObj, ok := args[0].(*tengocontext.TengoContext); ok {
+			if state := getRunState(ctxObj.Context); state != nil {
+				state.pinPrimary(p)
+			}
+		}
+	}
+	return p.primary.BeginTx(args...)
+}
@@ -0,0 +1,151 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/tidwall/gjson"
+)
+
+func TestReplicaRoute(t *testing.T) {
+	dir := t.TempDir()
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","primary":{"dsn":"%s"},"replicas":[{"dsn":"%s"}]}`, filepath.Join(dir, "primary.db"), filepath.Join(dir, "replica.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_REPLICA, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewReplicaDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, node := range map[string]*dataexchanger.DBProvider{"primary": provider.Primary(), "replica": provider.Replicas()[0]} {
+		if _, err = node.ExecOrQueryContext(ctx, `create table node (id integer primary key, name text)`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = node.ExecOrQueryContext(ctx, fmt.Sprintf(`insert into node (id,name) values (1,'%s')`, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/node",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number,required`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=beforeWrite,src=beforeWrite,required
+		fullname=forcePrimary,src=forcePrimary,required
+		fullname=afterWrite,src=afterWrite,required
+		fullname=forceReplica,src=forceReplica,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		input:=storage.GetMemory()
+		storage.Set("beforeWrite",execSQLTPL(ctx,"Get",input))
+		storage.Set("forcePrimary",execSQLTPL(ctx,"GetPrimary",input))
+		execSQLTPL(ctx,"Touch",input)
+		storage.Set("afterWrite",execSQLTPL(ctx,"Get",input))
+		storage.Set("forceReplica",execSQLTPL(ctx,"GetReplica",input))
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `
+	{{define "Get"}}select name from node where id=:id{{end}}
+	{{define "GetPrimary"}}select name from node where id=:id{{end}}
+	{{define "GetReplica"}}select name from node where id=:id{{end}}
+	{{define "Touch"}}update node set id=id where id=:id{{end}}
+	`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateDBRoute([]string{"GetPrimary"}, dataexchanger.DB_ROUTE_PRIMARY); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateDBRoute([]string{"GetReplica"}, dataexchanger.DB_ROUTE_REPLICA); err != nil {
+		t.Fatal(err)
+	}
+	out, err := capi.Run(ctx, `{"id":"1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["replica","primary","primary","replica"]`
+	if got := gjson.Get(out, "[beforeWrite,forcePrimary,afterWrite,forceReplica]").Raw; got != want {
+		t.Errorf("want:%s\ngot: %s", want, got)
+	}
+}
+
+func TestDBProviderSharedClose(t *testing.T) {
+	dir := t.TempDir()
+	nodeConfig, err := json.Marshal(dataexchanger.DBConfig{DSN: filepath.Join(dir, "primary.db"), Dialect: "sqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := dataexchanger.NewDBProvider(string(nodeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dataexchanger.NewDBProvider(string(nodeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicaConfig := fmt.Sprintf(`{"primary":%s,"replicas":[{"dsn":"%s","dialect":"sqlite"}]}`, nodeConfig, filepath.Join(dir, "replica.db"))
+	replica, err := dataexchanger.NewReplicaDBProvider(replicaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Primary() != second {
+		t.Fatal("replica primary want shared with same config")
+	}
+	ctx := context.Background()
+	query := func(provider *dataexchanger.DBProvider) error {
+		_, err := provider.ExecOrQueryContext(ctx, `select 1`)
+		return err
+	}
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = query(second); err != nil {
+		t.Errorf("shared pool closed by another source:%v", err)
+	}
+	if err = replica.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = query(second); err != nil {
+		t.Errorf("shared pool closed by replica source:%v", err)
+	}
+	if err = second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = query(second); err == nil {
+		t.Error("pool want closed after every source closed")
+	}
+}
+
+func TestReplicaDBProviderReleaseOnError(t *testing.T) {
+	nodeConfig, err := json.Marshal(dataexchanger.DBConfig{DSN: filepath.Join(t.TempDir(), "primary.db"), Dialect: "sqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := dataexchanger.NewDBProvider(string(nodeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dataexchanger.NewReplicaDBProvider(fmt.Sprintf(`{"primary":%s,"replicas":[{"dsn":"x","dialect":"unknown"}]}`, nodeConfig)); err == nil {
+		t.Fatal("unknown replica dialect want error")
+	}
+	if err = primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = primary.ExecOrQueryContext(context.Background(), `select 1`); err == nil {
+		t.Error("failed replica provider want primary share released")
+	}
+}
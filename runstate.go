@@ -0,0 +1,190 @@
+package dataexchanger
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// runState 单次 Run 内共享的状态,通过上下文在脚本注入函数间传递
+type runState struct {
+	lock      sync.Mutex
+	loaders   map[string]*batchLoader
+	cache     map[string]string // 资源标识+sql => 查询结果
+	cacheHit  int
+	cacheMiss int
+	pinned    map[interface{}]bool   // 已固定到主库的读写分离资源
+	events    []Event                // 执行成功后发布的事件
+	released  bool                   // 事件已发布,之后的事件(如后置脚本)直接发布
+	tx        *runTx                 // 事务接口在事务资源上开启的事务
+	locks     []func() error         // 脚本中获取的锁,执行结束时释放
+	sources   map[interface{}]func() // 运行时解析的资源 => 释放函数,执行结束时释放
+	logMasker *logMasker             // 本次执行的日志脱敏器
+	input     string                 // 格式化后的输入,审计记录使用
+}
+
+func newRunState() *runState {
+	return &runState{
+		loaders: make(map[string]*batchLoader),
+		cache:   make(map[string]string),
+		pinned:  make(map[interface{}]bool),
+	}
+}
+
+// cacheKey 缓存键包含读写分离路由,强制主库的查询不复用从库的结果
+func cacheKey(sourceIdentifer string, route string, statement string, args []interface{}) string {
+	key := sourceIdentifer + "\x00" + route + "\x00" + statement
+	if len(args) > 0 {
+		argsByte, _ := json.Marshal(args)
+		key = key + "\x00" + string(argsByte)
+	}
+	return key
+}
+
+// getCache 获取单次执行内相同资源、相同语句的查询结果
+func (s *runState) getCache(sourceIdentifer string, route string, statement string, args []interface{}) (out string, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out, ok = s.cache[cacheKey(sourceIdentifer, route, statement, args)]
+	if ok {
+		s.cacheHit++
+	} else {
+		s.cacheMiss++
+	}
+	return out, ok
+}
+
+func (s *runState) setCache(sourceIdentifer string, route string, statement string, args []interface{}, out string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cache[cacheKey(sourceIdentifer, route, statement, args)] = out
+}
+
+// flushCache 写操作后清空缓存及批量加载结果,避免读到旧数据
+func (s *runState) flushCache() {
+	s.lock.Lock()
+	s.cache = make(map[string]string)
+	loaders := make([]*batchLoader, 0, len(s.loaders))
+	for _, loader := range s.loaders {
+		loaders = append(loaders, loader)
+	}
+	s.lock.Unlock()
+	for _, loader := range loaders { // 加载器加载时会读取缓存,释放 state 锁后再重置,避免死锁
+		loader.reset()
+	}
+}
+
+func (s *runState) cacheStats() (hit int, miss int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cacheHit, s.cacheMiss
+}
+
+// pinPrimary 固定资源后续操作到主库
+func (s *runState) pinPrimary(source interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pinned[source] = true
+}
+
+func (s *runState) isPinnedPrimary(source interface{}) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pinned[source]
+}
+
+// addEvent 暂存事件,已发布过时返回 true 由调用方直接发布
+func (s *runState) addEvent(topic string, data string) (publishNow bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.released {
+		return true
+	}
+	s.events = append(s.events, Event{Topic: topic, Data: data})
+	return false
+}
+
+func (s *runState) releaseEvents() (events []Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.released = true
+	events, s.events = s.events, nil
+	return events
+}
+
+func (s *runState) setTx(tx *runTx) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tx = tx
+}
+
+// getTx 获取未提交的事务,state 为空时返回 nil
+func (s *runState) getTx() (tx *runTx) {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tx
+}
+
+// rollbackTx 回滚未提交的事务
+func (s *runState) rollbackTx() (err error) {
+	tx := s.getTx()
+	if tx == nil {
+		return nil
+	}
+	s.setTx(nil)
+	return tx.tx.Rollback()
+}
+
+func (s *runState) addLock(unlock func() error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.locks = append(s.locks, unlock)
+}
+
+// releaseLocks 释放执行中获取的锁
+func (s *runState) releaseLocks() {
+	s.lock.Lock()
+	locks := s.locks
+	s.locks = nil
+	s.lock.Unlock()
+	for _, unlock := range locks {
+		unlock()
+	}
+}
+
+// holdSource 记录本次执行使用的运行时资源,首次使用时返回 true
+func (s *runState) holdSource(source interface{}, release func()) (first bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.sources[source]; ok {
+		return false
+	}
+	if s.sources == nil {
+		s.sources = make(map[interface{}]func())
+	}
+	s.sources[source] = release
+	return true
+}
+
+// releaseSources 释放执行中使用的运行时资源
+func (s *runState) releaseSources() {
+	s.lock.Lock()
+	sources := s.sources
+	s.sources = nil
+	s.lock.Unlock()
+	for _, release := range sources {
+		release()
+	}
+}
+
+// getRunState 从上下文中获取单次执行状态,不在 Run 内调用时返回 nil
+func getRunState(ctx context.Context) (state *runState) {
+	if ctx == nil {
+		return nil
+	}
+	state, _ = ctx.Value(CONTEXT_KEY_RUN_STATE).(*runState)
+	return state
+}
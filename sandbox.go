@@ -0,0 +1,228 @@
+package dataexchanger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib"
+	"github.com/suifengpiao14/tengolib/tengocontext"
+	"github.com/suifengpiao14/tengolib/tengogsjson"
+)
+
+const (
+	SANDBOX_VIOLATION_MODULE      = "module"     // 导入未允许的内置模块
+	SANDBOX_VIOLATION_FILE_IMPORT = "fileImport" // 禁止文件导入或导入文件超出根目录
+	SANDBOX_VIOLATION_ALLOCS      = "maxAllocs"  // 对象分配次数超限
+	SANDBOX_VIOLATION_TIMEOUT     = "timeout"    // 执行超时
+	SANDBOX_VIOLATION_CALLS       = "maxCalls"   // 原生函数调用次数超限
+
+	SANDBOX_SCRIPT_EXT = ".tengo"
+)
+
+// SandboxPolicy 脚本沙箱策略,可在 api 上声明,也可通过 Container.SetSandboxPolicy 设置容器默认策略.
+// tengo 虚拟机不提供执行指令计数,以原生函数(execSQLTPL、publish 等)调用次数代替指令上限,
+// 纯脚本计算由 MaxAllocs 与 Timeout 限制
+type SandboxPolicy struct {
+	Modules    []string `json:"modules"`    // 允许导入的内置模块(stdlib、tengolib),为空时不允许导入
+	ImportRoot string   `json:"importRoot"` // 允许导入脚本文件的根目录,为空时禁止文件导入
+	MaxAllocs  int64    `json:"maxAllocs"`  // 单次执行对象分配次数上限,0 不限制
+	MaxCalls   int64    `json:"maxCalls"`   // 单次执行原生函数调用次数上限,0 不限制
+	Timeout    int      `json:"timeout"`    // 单次执行时长上限(毫秒),包含原生函数调用,0 不限制
+}
+
+// SandboxError 脚本违反沙箱策略
+type SandboxError struct {
+	Violation string // 违规类型
+	Detail    string // 模块名、文件名或限制值
+	Err       error
+}
+
+func (e *SandboxError) Error() string {
+	return fmt.Sprintf("sandbox violation:%s,%s:%v", e.Violation, e.Detail, e.Err)
+}
+
+func (e *SandboxError) Unwrap() error {
+	return e.Err
+}
+
+// builtinModules 可导入的全部内置模块
+func builtinModules() (mods *tengo.ModuleMap) {
+	mods = stdlib.GetModuleMap(stdlib.AllModuleNames()...)
+	mods.AddMap(tengolib.GetModuleMap(tengolib.AllModuleNames()...))
+	return mods
+}
+
+func (p *SandboxPolicy) validate() (err error) {
+	all := builtinModules()
+	for _, name := range p.Modules {
+		if all.Get(name) == nil {
+			err = errors.Errorf("sandbox module not found:%s", name)
+			return err
+		}
+	}
+	if p.MaxAllocs < 0 || p.MaxCalls < 0 || p.Timeout < 0 {
+		err = errors.Errorf("sandbox maxAllocs,maxCalls,timeout must not be negative,got:%d,%d,%d", p.MaxAllocs, p.MaxCalls, p.Timeout)
+		return err
+	}
+	if p.ImportRoot != "" {
+		if p.ImportRoot, err = filepath.Abs(p.ImportRoot); err != nil {
+			err = errors.WithMessagef(err, "sandbox importRoot:%s", p.ImportRoot)
+			return err
+		}
+	}
+	return nil
+}
+
+// importPath 解析导入文件路径,超出根目录时返回 false
+func (p *SandboxPolicy) importPath(name string) (path string, ok bool) {
+	if filepath.IsAbs(name) {
+		return "", false
+	}
+	if filepath.Ext(name) == "" {
+		name += SANDBOX_SCRIPT_EXT
+	}
+	path = filepath.Join(p.ImportRoot, name)
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	root := p.ImportRoot
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		root = real
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
+
+// sandboxModules 按沙箱策略提供导入模块,拒绝的导入记录为违规,编译失败时返回
+type sandboxModules struct {
+	policy    *SandboxPolicy
+	builtin   *tengo.ModuleMap
+	violation *SandboxError
+}
+
+func newSandboxModules(policy *SandboxPolicy) (m *sandboxModules) {
+	return &sandboxModules{policy: policy, builtin: builtinModules()}
+}
+
+// Get 实现 tengo.ModuleGetter,导入文件时路径相对根目录
+func (m *sandboxModules) Get(name string) tengo.Importable {
+	if m.isAllowed(name) {
+		return m.builtin.Get(name)
+	}
+	if m.builtin.Get(name) != nil {
+		m.violation = &SandboxError{Violation: SANDBOX_VIOLATION_MODULE, Detail: name}
+		return nil
+	}
+	if m.policy.ImportRoot == "" {
+		m.violation = &SandboxError{Violation: SANDBOX_VIOLATION_FILE_IMPORT, Detail: name}
+		return nil
+	}
+	path, ok := m.policy.importPath(name)
+	if !ok {
+		m.violation = &SandboxError{Violation: SANDBOX_VIOLATION_FILE_IMPORT, Detail: name}
+		return nil
+	}
+	src, err := os.ReadFile(path)
+	if err != nil { // 文件不存在时由编译器报告模块未找到
+		return nil
+	}
+	return &tengo.SourceModule{Src: src}
+}
+
+func (m *sandboxModules) isAllowed(name string) bool {
+	for _, module := range m.policy.Modules {
+		if module == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSandboxPolicy 设置容器默认沙箱策略,未声明沙箱的 api 使用该策略重新编译脚本
+func (c *Container) SetSandboxPolicy(policy *SandboxPolicy) (err error) {
+	if policy != nil {
+		if err = policy.validate(); err != nil {
+			return err
+		}
+	}
+	c.lockCApi.Lock()
+	defer c.lockCApi.Unlock()
+	c.sandbox = policy
+	for _, capi := range c.apis {
+		scripts, err := capi.containerScripts(policy)
+		if err != nil {
+			return err
+		}
+		if scripts != nil { // 与执行中的 api 并发安全,执行中的请求继续使用原脚本
+			capi.setScripts(scripts)
+		}
+	}
+	return nil
+}
+
+// containerScripts 未声明沙箱的 api 按容器策略编译脚本,无需重新编译时返回 nil
+func (capi *apiCompiled) containerScripts(policy *SandboxPolicy) (scripts *apiScripts, err error) {
+	if capi.ownSandbox || capi.getScripts().sandbox == policy {
+		return nil, nil
+	}
+	return capi.compileScripts(policy)
+}
+
+// runScript 执行脚本,沙箱策略设置了时长上限时超时中止(脚本通过 storage.GetCtx 传给原生函数的上下文同样超时),
+// 设置了调用次数上限时计数原生函数调用
+func (capi *apiCompiled) runScript(c *tengo.Compiled, storage *tengogsjson.Storage, policy *SandboxPolicy) (err error) {
+	if policy != nil && policy.MaxCalls > 0 {
+		if err = limitCalls(c, capi.scriptFuncs(), policy.MaxCalls); err != nil {
+			return err
+		}
+	}
+	if policy == nil || policy.Timeout <= 0 {
+		err = c.Run()
+	} else {
+		previous := storage.Ctx
+		ctx := previous.Context
+		timeout := time.Duration(policy.Timeout) * time.Millisecond
+		runCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		storage.Ctx = &tengocontext.TengoContext{Context: runCtx}
+		defer func() {
+			storage.Ctx = previous
+		}()
+		err = c.RunContext(runCtx)
+		if err != nil && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			return &SandboxError{Violation: SANDBOX_VIOLATION_TIMEOUT, Detail: timeout.String(), Err: err}
+		}
+	}
+	if policy != nil && errors.Is(err, tengo.ErrObjectAllocLimit) {
+		return &SandboxError{Violation: SANDBOX_VIOLATION_ALLOCS, Detail: fmt.Sprint(policy.MaxAllocs), Err: err}
+	}
+	return err
+}
+
+// limitCalls 以计数的原生函数替换脚本副本中的原生函数,单次执行调用超过 max 次时返回沙箱违规
+func limitCalls(c *tengo.Compiled, funcs map[string]tengo.CallableFunc, max int64) (err error) {
+	var calls int64
+	for name, fn := range funcs {
+		name, fn := name, fn
+		limited := &tengo.UserFunction{Name: name, Value: func(args ...tengo.Object) (tengo.Object, error) {
+			if calls++; calls > max {
+				return nil, &SandboxError{Violation: SANDBOX_VIOLATION_CALLS, Detail: fmt.Sprint(max), Err: errors.Errorf("call %s", name)}
+			}
+			return fn(args...)
+		}}
+		if err = c.Set(name, limited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
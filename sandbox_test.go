@@ -0,0 +1,195 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+func sandboxAPI(script string, policy *dataexchanger.SandboxPolicy) *dataexchanger.DtoAPI {
+	return &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/sandbox",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=name,dst=name`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=out,src=out`,
+		MainScript: script,
+		Sandbox:    policy,
+	}
+}
+
+func assertViolation(t *testing.T, name string, err error, violation string) {
+	t.Helper()
+	var sandboxErr *dataexchanger.SandboxError
+	if !errors.As(err, &sandboxErr) || sandboxErr.Violation != violation {
+		t.Errorf("%s want sandbox violation %s,got:%v", name, violation, err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "scripts")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "greet.tengo"), []byte(`export func(name){return "hello "+name}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.tengo"), []byte(`export "secret"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy := &dataexchanger.SandboxPolicy{Modules: []string{"text"}, ImportRoot: root}
+	if _, err := dataexchanger.NewApiCompiled(sandboxAPI("", &dataexchanger.SandboxPolicy{Modules: []string{"unknown"}})); err == nil {
+		t.Error("unknown module want error")
+	}
+
+	violations := map[string]struct {
+		script    string
+		policy    *dataexchanger.SandboxPolicy
+		violation string
+	}{
+		"module not allowed":  {`os:=import("os")`, policy, dataexchanger.SANDBOX_VIOLATION_MODULE},
+		"file import off":     {`g:=import("greet")`, &dataexchanger.SandboxPolicy{}, dataexchanger.SANDBOX_VIOLATION_FILE_IMPORT},
+		"file outside root":   {`s:=import("../secret")`, policy, dataexchanger.SANDBOX_VIOLATION_FILE_IMPORT},
+		"absolute path":       {`s:=import("/etc/passwd")`, policy, dataexchanger.SANDBOX_VIOLATION_FILE_IMPORT},
+		"file import off ext": {`s:=import("os.tengo")`, &dataexchanger.SandboxPolicy{}, dataexchanger.SANDBOX_VIOLATION_FILE_IMPORT},
+	}
+	for name, c := range violations {
+		_, err := dataexchanger.NewApiCompiled(sandboxAPI(c.script, c.policy))
+		assertViolation(t, name, err, c.violation)
+	}
+
+	ctx := context.Background()
+	capi, err := dataexchanger.NewApiCompiled(sandboxAPI(`
+	text:=import("text")
+	greet:=import("greet")
+	input:=storage.GetMemory()
+	storage.Set("out",text.to_upper(greet(input.name)))
+	`, policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := capi.Run(ctx, `{"name":"bob"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `{"out":"HELLO BOB"}` {
+		t.Errorf("got:%s", out)
+	}
+
+	capi, err = dataexchanger.NewApiCompiled(sandboxAPI(`
+	a:=[]
+	for i:=0;i<1000;i++ { a=append(a,{i:i}) }
+	storage.Set("out","done")
+	`, &dataexchanger.SandboxPolicy{MaxAllocs: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = capi.Run(ctx, `{"name":"bob"}`)
+	assertViolation(t, "max allocs", err, dataexchanger.SANDBOX_VIOLATION_ALLOCS)
+
+	capi, err = dataexchanger.NewApiCompiled(sandboxAPI(`for {}`, &dataexchanger.SandboxPolicy{Timeout: 50}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = capi.Run(ctx, `{"name":"bob"}`)
+	assertViolation(t, "timeout", err, dataexchanger.SANDBOX_VIOLATION_TIMEOUT)
+
+	// 容器策略作用于未声明沙箱的 api
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	unrestricted, err := dataexchanger.NewApiCompiled(sandboxAPI(`os:=import("os")`, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = container.RegisterAPI(unrestricted); err != nil {
+		t.Fatal(err)
+	}
+	err = container.SetSandboxPolicy(&dataexchanger.SandboxPolicy{Modules: []string{"text"}})
+	assertViolation(t, "container policy", err, dataexchanger.SANDBOX_VIOLATION_MODULE)
+	restricted, err := dataexchanger.NewApiCompiled(sandboxAPI(`os:=import("os")`, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = container.RegisterAPI(restricted)
+	assertViolation(t, "container policy on register", err, dataexchanger.SANDBOX_VIOLATION_MODULE)
+	own, err := dataexchanger.NewApiCompiled(sandboxAPI(`os:=import("os")`, &dataexchanger.SandboxPolicy{Modules: []string{"os"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = container.RegisterAPI(own); err != nil {
+		t.Errorf("api policy want precedence over container policy,got:%v", err)
+	}
+}
+
+func TestSandboxNativeCalls(t *testing.T) {
+	ctx := context.Background()
+	capi, err := dataexchanger.NewApiCompiled(sandboxAPI(`
+	for i:=0;i<3;i++ { principal(storage.GetCtx()) }
+	storage.Set("out","done")
+	`, &dataexchanger.SandboxPolicy{MaxCalls: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = capi.Run(ctx, `{"name":"bob"}`)
+	assertViolation(t, "max calls", err, dataexchanger.SANDBOX_VIOLATION_CALLS)
+	if _, err = capi.Run(ctx, `{"name":"bob"}`); err == nil { // 每次执行重新计数
+		t.Error("max calls want error on every run")
+	}
+
+	// 超时同样中止阻塞中的原生函数
+	capi, err = dataexchanger.NewApiCompiled(sandboxAPI(`lock(storage.GetCtx(),"gate","10s")`, &dataexchanger.SandboxPolicy{Timeout: 50}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := capi.Lock(ctx, "gate", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := capi.Run(ctx, `{"name":"bob"}`)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		assertViolation(t, "native call timeout", err, dataexchanger.SANDBOX_VIOLATION_TIMEOUT)
+	case <-time.After(3 * time.Second):
+		t.Fatal("native call want aborted by sandbox timeout")
+	}
+}
+
+func TestSandboxPolicyConcurrent(t *testing.T) {
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	capi, err := dataexchanger.NewApiCompiled(sandboxAPI(`storage.Set("out","done")`, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := container.SetSandboxPolicy(&dataexchanger.SandboxPolicy{MaxAllocs: int64(1000 + i)}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if out, err := capi.Run(context.Background(), `{"name":"bob"}`); err != nil || out != `{"out":"done"}` {
+			t.Errorf("run during policy change got:%s,%v", out, err)
+		}
+	}
+	wg.Wait()
+}
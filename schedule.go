@@ -0,0 +1,259 @@
+package dataexchanger
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+	"github.com/suifengpiao14/logchan/v2"
+)
+
+const (
+	MISSED_RUN_SKIP = "skip" // 错过的执行直接跳过(默认)
+	MISSED_RUN_ONCE = "once" // 错过多次时补偿执行一次
+	MISSED_RUN_ALL  = "all"  // 错过的每次都按顺序补偿执行
+
+	SCHEDULE_MISSED_TOLERANCE = 5 * time.Second // 晚于计划时间超过此值视为错过
+	SCHEDULE_MISSED_MAX       = 1000            // 单次最多补偿的执行次数,超出时保留最近的
+)
+
+// DtoSchedule 定时执行 api
+type DtoSchedule struct {
+	Name         string     `json:"name"`         // 名称,默认为路由
+	Cron         string     `json:"cron"`         // cron 表达式,5 段(分 时 日 月 周)、6 段(含秒)或 @every 1h、@daily 等
+	Route        string     `json:"route"`        // 执行的 api 路由
+	Method       string     `json:"method"`       // 执行的 api 方法
+	Input        string     `json:"input"`        // 输入 json,可使用模板语法,数据包含 name、scheduledAt(RFC3339)、timestamp
+	AllowOverlap bool       `json:"allowOverlap"` // 允许上一次未结束时开始新的执行,默认跳过
+	Jitter       int        `json:"jitter"`       // 执行前随机延迟的上限(秒),避免多实例同时执行
+	MissedRun    string     `json:"missedRun"`    // 错过执行的处理策略:skip(默认)、once、all
+	LastRun      time.Time  `json:"lastRun"`      // 上次执行的计划时间,重启时传入以补偿停止期间错过的执行
+	Principal    *Principal `json:"principal"`    // 执行 api 的服务身份,api 声明了角色、权限时需配置
+}
+
+func (dto DtoSchedule) validate() (err error) {
+	if dto.Cron == "" || dto.Route == "" || dto.Method == "" {
+		err = errors.Errorf("schedule cron,route,method required,got:%+v", dto)
+		return err
+	}
+	switch dto.MissedRun {
+	case "", MISSED_RUN_SKIP, MISSED_RUN_ONCE, MISSED_RUN_ALL:
+	default:
+		err = errors.Errorf("schedule missedRun want skip/once/all,got:%s", dto.MissedRun)
+		return err
+	}
+	return nil
+}
+
+// parseCron 6 段时包含秒,否则按标准 5 段解析
+func parseCron(spec string) (schedule cron.Schedule, err error) {
+	if !strings.HasPrefix(spec, "@") && len(strings.Fields(spec)) == 6 {
+		return cron.Parse(spec)
+	}
+	return cron.ParseStandard(spec)
+}
+
+// LogInfoSchedule 定时执行日志
+type LogInfoSchedule struct {
+	Name        string    `json:"name"`
+	Route       string    `json:"route"`
+	ScheduledAt time.Time `json:"scheduledAt"`
+	StartedAt   time.Time `json:"startedAt"`
+	Missed      bool      `json:"missed"`  // 补偿执行
+	Skipped     string    `json:"skipped"` // 跳过原因,为空时已执行
+	Input       string    `json:"input"`
+	Out         string    `json:"out"`
+	Err         error
+	logchan.EmptyLogInfo
+	container *Container // 产生日志的容器,按其脱敏规则脱敏
+}
+
+func (l LogInfoSchedule) GetName() logchan.LogName {
+	return LogName(LOG_INFO_SCHEDULE)
+}
+
+func (l LogInfoSchedule) Error() error {
+	return l.Err
+}
+
+// scheduler 单个定时任务
+type scheduler struct {
+	dto      DtoSchedule
+	capi     *apiCompiled
+	schedule cron.Schedule
+	input    *template.Template
+	running  bool
+	lock     sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// scheduledRun 一次计划执行
+type scheduledRun struct {
+	at     time.Time
+	missed bool
+}
+
+// due 计算 now 之前到期的执行,按策略处理错过的执行,返回下一次计划时间
+func (s *scheduler) due(next time.Time, now time.Time) (runs []scheduledRun, after time.Time) {
+	missed := make([]time.Time, 0)
+	overflow := 0 // 超出上限的次数,missed 作为环形缓冲区覆盖最早的
+	for !next.After(now) {
+		if now.Sub(next) <= SCHEDULE_MISSED_TOLERANCE {
+			runs = append(runs, scheduledRun{at: next})
+		} else if len(missed) < SCHEDULE_MISSED_MAX {
+			missed = append(missed, next)
+		} else {
+			missed[overflow%SCHEDULE_MISSED_MAX] = next
+			overflow++
+		}
+		next = s.schedule.Next(next)
+	}
+	if start := overflow % SCHEDULE_MISSED_MAX; start > 0 { // 恢复时间顺序
+		missed = append(missed[start:], missed[:start]...)
+	}
+	skipped := missed
+	switch s.dto.MissedRun {
+	case MISSED_RUN_ONCE:
+		if len(missed) > 0 {
+			skipped = missed[:len(missed)-1]
+			runs = append([]scheduledRun{{at: missed[len(missed)-1], missed: true}}, runs...)
+		}
+	case MISSED_RUN_ALL:
+		skipped = nil
+		missedRuns := make([]scheduledRun, 0, len(missed)+len(runs))
+		for _, at := range missed {
+			missedRuns = append(missedRuns, scheduledRun{at: at, missed: true})
+		}
+		runs = append(missedRuns, runs...)
+	}
+	for _, at := range skipped {
+		logchan.SendLogInfo(&LogInfoSchedule{Name: s.dto.Name, Route: s.dto.Route, ScheduledAt: at, Missed: true, Skipped: "missed", container: s.capi._container})
+	}
+	return runs, next
+}
+
+// dispatch 异步顺序执行到期的计划,不允许重叠时上一批未结束则跳过
+func (s *scheduler) dispatch(ctx context.Context, runs []scheduledRun) {
+	s.lock.Lock()
+	if s.running && !s.dto.AllowOverlap {
+		s.lock.Unlock()
+		for _, run := range runs {
+			logchan.SendLogInfo(&LogInfoSchedule{Name: s.dto.Name, Route: s.dto.Route, ScheduledAt: run.at, Missed: run.missed, Skipped: "overlap", container: s.capi._container})
+		}
+		return
+	}
+	s.running = true
+	s.lock.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			s.lock.Lock()
+			s.running = false
+			s.lock.Unlock()
+			s.wg.Done()
+		}()
+		if s.dto.Jitter > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rand.Int63n(int64(time.Duration(s.dto.Jitter) * time.Second)))):
+			}
+		}
+		for _, run := range runs {
+			s.run(run)
+		}
+	}()
+}
+
+func (s *scheduler) run(run scheduledRun) {
+	logInfo := &LogInfoSchedule{Name: s.dto.Name, Route: s.dto.Route, ScheduledAt: run.at, Missed: run.missed, StartedAt: time.Now().Local(), container: s.capi._container}
+	defer func() {
+		if panicInfo := recover(); panicInfo != nil {
+			logInfo.Err = errors.Errorf("%v", panicInfo)
+		}
+		logchan.SendLogInfo(logInfo)
+	}()
+	var b bytes.Buffer
+	data := map[string]interface{}{
+		"name":        s.dto.Name,
+		"scheduledAt": run.at.Format(time.RFC3339),
+		"timestamp":   run.at.Unix(),
+	}
+	if logInfo.Err = s.input.Execute(&b, data); logInfo.Err != nil {
+		return
+	}
+	logInfo.Input = b.String()
+	ctx := context.Background()
+	if s.dto.Principal != nil {
+		ctx = WithPrincipal(ctx, s.dto.Principal)
+	}
+	logInfo.Out, logInfo.Err = s.capi.Run(ctx, logInfo.Input)
+}
+
+// StartSchedule 按 cron 表达式定时执行 api,返回停止函数(等待执行中的任务结束)
+func (c *Container) StartSchedule(dto DtoSchedule) (stop func(), err error) {
+	if err = dto.validate(); err != nil {
+		return nil, err
+	}
+	if dto.Name == "" {
+		dto.Name = dto.Route
+	}
+	if dto.MissedRun == "" {
+		dto.MissedRun = MISSED_RUN_SKIP
+	}
+	capi, ok := c.GetCApi(dto.Route, dto.Method)
+	if !ok {
+		err = errors.Errorf("Container.StartSchedule api not found,route:%s,method:%s", dto.Route, dto.Method)
+		return nil, err
+	}
+	schedule, err := parseCron(dto.Cron)
+	if err != nil {
+		err = errors.WithMessagef(err, "Container.StartSchedule,name:%s", dto.Name)
+		return nil, err
+	}
+	input, err := template.New(dto.Name).Funcs(sprig.TxtFuncMap()).Parse(dto.Input)
+	if err != nil {
+		err = errors.WithMessagef(err, "Container.StartSchedule.Input,name:%s", dto.Name)
+		return nil, err
+	}
+	s := &scheduler{dto: dto, capi: capi, schedule: schedule, input: input}
+	from := dto.LastRun
+	if from.IsZero() {
+		from = time.Now()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		next := schedule.Next(from)
+		for {
+			var runs []scheduledRun
+			runs, next = s.due(next, time.Now())
+			if len(runs) > 0 {
+				s.dispatch(ctx, runs)
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			s.wg.Wait()
+		})
+	}, nil
+}
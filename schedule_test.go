@@ -0,0 +1,131 @@
+package dataexchanger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestSchedule(t *testing.T) {
+	brokerSource, err := dataexchanger.MakeSource("mq", dataexchanger.PROVIDER_MEMORY_BROKER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := dataexchanger.NewMemoryBroker()
+	brokerSource.SetProvider(broker)
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/report/aggregate",
+		Roles:   []string{"scheduler"},
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=name,dst=name,required
+		fullname=scheduledAt,dst=scheduledAt,required`,
+		AfterEvents: []dataexchanger.DtoAfterEvent{{Source: "mq", Queue: "report", Template: "Report"}},
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(brokerSource); err != nil {
+		t.Fatal(err)
+	}
+	capi.RegisterTemplate("", `{{define "Report"}}{"name":"{{.input.name}}","scheduledAt":"{{.input.scheduledAt}}"}{{end}}`)
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	principal := &dataexchanger.Principal{Subject: "scheduler", Roles: []string{"scheduler"}}
+
+	runs := func(name string) (scheduledAts []string) {
+		for _, message := range broker.Messages("report") {
+			if gjson.Get(message.Body, "name").String() == name {
+				scheduledAts = append(scheduledAts, gjson.Get(message.Body, "scheduledAt").String())
+			}
+		}
+		return scheduledAts
+	}
+	waitRuns := func(name string, n int) []string {
+		deadline := time.Now().Add(3 * time.Second)
+		for len(runs(name)) < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return runs(name)
+	}
+
+	lastRun := time.Now().Add(-3*time.Hour - time.Minute)
+	for _, c := range []struct {
+		missedRun string
+		want      int
+	}{
+		{dataexchanger.MISSED_RUN_ALL, 3},
+		{dataexchanger.MISSED_RUN_ONCE, 1},
+		{dataexchanger.MISSED_RUN_SKIP, 0},
+	} {
+		stop, err := container.StartSchedule(dataexchanger.DtoSchedule{
+			Name:      c.missedRun,
+			Cron:      "@every 1h",
+			Route:     api.Route,
+			Method:    "post",
+			Input:     `{"name":"{{.name}}","scheduledAt":"{{.scheduledAt}}"}`,
+			MissedRun: c.missedRun,
+			LastRun:   lastRun,
+			Principal: principal,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := waitRuns(c.missedRun, c.want)
+		stop()
+		if len(got) != c.want {
+			t.Errorf("missedRun %s want %d runs,got:%v", c.missedRun, c.want, got)
+		}
+		if c.missedRun == dataexchanger.MISSED_RUN_ONCE && len(got) == 1 && got[0] != lastRun.Add(3*time.Hour).Format(time.RFC3339) {
+			t.Errorf("missedRun once want latest missed run,got:%s", got[0])
+		}
+	}
+
+	// 错过次数超出上限时补偿最近的一次
+	lastRun = time.Now().Add(-(dataexchanger.SCHEDULE_MISSED_MAX+200)*time.Minute - 30*time.Second)
+	stop, err := container.StartSchedule(dataexchanger.DtoSchedule{
+		Name:      "overflow",
+		Cron:      "@every 1m",
+		Route:     api.Route,
+		Method:    "post",
+		Input:     `{"name":"{{.name}}","scheduledAt":"{{.scheduledAt}}"}`,
+		MissedRun: dataexchanger.MISSED_RUN_ONCE,
+		LastRun:   lastRun,
+		Principal: principal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := waitRuns("overflow", 1)
+	stop()
+	if want := lastRun.Add((dataexchanger.SCHEDULE_MISSED_MAX + 200) * time.Minute).Format(time.RFC3339); len(got) != 1 || got[0] != want {
+		t.Errorf("missed over max want latest run %s,got:%v", want, got)
+	}
+
+	stop, err = container.StartSchedule(dataexchanger.DtoSchedule{
+		Name:      "everySecond",
+		Cron:      "* * * * * *",
+		Route:     api.Route,
+		Method:    "post",
+		Input:     `{"name":"{{.name}}","scheduledAt":"{{.scheduledAt}}"}`,
+		Principal: principal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = waitRuns("everySecond", 2)
+	stop()
+	if len(got) < 2 || got[0] == got[1] {
+		t.Errorf("every second want 2 distinct runs,got:%v", got)
+	}
+
+	if _, err = container.StartSchedule(dataexchanger.DtoSchedule{Cron: "bad", Route: api.Route, Method: "post"}); err == nil {
+		t.Error("invalid cron want error")
+	}
+}
@@ -0,0 +1,152 @@
+package dataexchanger
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	STMT_CACHE_SIZE_DEFAULT = 256
+)
+
+// StmtCacheStats 预处理语句缓存统计
+type StmtCacheStats struct {
+	Size      int   `json:"size"`
+	Capacity  int   `json:"capacity"`
+	Hits      int64 `json:"hits"`      // 复用次数
+	Misses    int64 `json:"misses"`    // 新建(prepare)次数
+	Evictions int64 `json:"evictions"` // 淘汰、失效次数
+}
+
+type stmtCacheEntry struct {
+	statement string
+	stmt      *sql.Stmt
+	refs      int  // 正在使用的数量,归零后才能关闭
+	evicted   bool // 已从缓存移除,待关闭
+	element   *list.Element
+}
+
+// stmtCache 按语句文本缓存预处理语句的 LRU
+type stmtCache struct {
+	db       *sql.DB
+	capacity int
+	entries  map[string]*stmtCacheEntry
+	lru      *list.List
+	stats    StmtCacheStats
+	lock     sync.Mutex
+}
+
+func newStmtCache(db *sql.DB, capacity int) (c *stmtCache) {
+	return &stmtCache{
+		db:       db,
+		capacity: capacity,
+		entries:  make(map[string]*stmtCacheEntry),
+		lru:      list.New(),
+	}
+}
+
+// acquire 获取预处理语句,使用完毕后必须调用 release
+func (c *stmtCache) acquire(ctx context.Context, statement string) (entry *stmtCacheEntry, err error) {
+	c.lock.Lock()
+	entry, ok := c.entries[statement]
+	if ok {
+		c.stats.Hits++
+		entry.refs++
+		c.lru.MoveToFront(entry.element)
+		c.lock.Unlock()
+		return entry, nil
+	}
+	c.stats.Misses++
+	c.lock.Unlock()
+
+	stmt, err := c.db.PrepareContext(ctx, statement)
+	if err != nil {
+		err = errors.WithMessage(err, "stmtCache.prepare")
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if exists, ok := c.entries[statement]; ok { // 并发 prepare,保留已缓存的
+		stmt.Close()
+		exists.refs++
+		c.lru.MoveToFront(exists.element)
+		return exists, nil
+	}
+	entry = &stmtCacheEntry{statement: statement, stmt: stmt, refs: 1}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[statement] = entry
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back().Value.(*stmtCacheEntry))
+	}
+	return entry, nil
+}
+
+// release 归还预处理语句,连接失效类错误会使语句失效
+func (c *stmtCache) release(entry *stmtCacheEntry, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry.refs--
+	if isConnReset(err) && !entry.evicted {
+		c.evict(entry)
+	}
+	if entry.evicted && entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// evict 移出缓存,无人使用时立即关闭,调用方需持有锁
+func (c *stmtCache) evict(entry *stmtCacheEntry) {
+	if entry.evicted {
+		return
+	}
+	entry.evicted = true
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.statement)
+	c.stats.Evictions++
+	if entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// reset 清空缓存,连接重置、表结构变更后调用
+func (c *stmtCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, entry := range c.entries {
+		c.evict(entry)
+	}
+}
+
+func (c *stmtCache) getStats() (stats StmtCacheStats) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats = c.stats
+	stats.Size = c.lru.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+func isConnReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone)
+}
+
+// stmtExecutor 将预处理语句适配为 tengodb.ExectorInterface
+type stmtExecutor struct {
+	stmt *sql.Stmt
+}
+
+func (e stmtExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	return e.stmt.ExecContext(ctx, args...)
+}
+
+func (e stmtExecutor) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	return e.stmt.QueryContext(ctx, args...)
+}
@@ -0,0 +1,165 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+)
+
+// stmtDriver 记录预处理语句关闭次数的驱动,语句含 slow 时阻塞到 unblock 关闭,含 bad 时返回连接失效
+type stmtDriver struct {
+	lock    sync.Mutex
+	closed  map[string]int
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (d *stmtDriver) Open(name string) (driver.Conn, error) {
+	return &stmtDriverConn{driver: d}, nil
+}
+
+func (d *stmtDriver) closedTimes(query string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.closed[query]
+}
+
+type stmtDriverConn struct {
+	driver *stmtDriver
+}
+
+func (c *stmtDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return &stmtDriverStmt{driver: c.driver, query: query}, nil
+}
+
+func (c *stmtDriverConn) Close() error {
+	return nil
+}
+
+func (c *stmtDriverConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+type stmtDriverStmt struct {
+	driver *stmtDriver
+	query  string
+}
+
+func (s *stmtDriverStmt) Close() error {
+	s.driver.lock.Lock()
+	defer s.driver.lock.Unlock()
+	s.driver.closed[s.query]++
+	return nil
+}
+
+func (s *stmtDriverStmt) NumInput() int {
+	return -1
+}
+
+func (s *stmtDriverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	switch {
+	case strings.Contains(s.query, "slow"):
+		s.driver.entered <- struct{}{}
+		<-s.driver.unblock
+	case strings.Contains(s.query, "bad"):
+		return nil, driver.ErrBadConn
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stmtDriverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+var testStmtDriver = &stmtDriver{closed: map[string]int{}, entered: make(chan struct{}, 1), unblock: make(chan struct{})}
+
+func init() {
+	sql.Register("stmtcachetest", testStmtDriver)
+}
+
+func TestStmtCache(t *testing.T) {
+	newProvider := func(capacity int) *dataexchanger.DBProvider {
+		provider, err := dataexchanger.NewDBProvider(fmt.Sprintf(`{"dialect":"sqlite","driver":"stmtcachetest","dsn":"%s","stmtCacheSize":%d}`, t.Name(), capacity))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return provider
+	}
+	provider := newProvider(1)
+	defer provider.Close()
+	exec := func(statement string) {
+		if _, err := provider.ExecOrQueryArgsContext(context.Background(), statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec("update a set x=1")
+	exec("update a set x=1")
+	exec("update b set x=1") // 容量 1,淘汰 a
+	if got := testStmtDriver.closedTimes("update a set x=1"); got != 1 {
+		t.Errorf("evicted statement want closed once,got:%d", got)
+	}
+	want := dataexchanger.StmtCacheStats{Size: 1, Capacity: 1, Hits: 1, Misses: 2, Evictions: 1}
+	if stats := provider.StmtCacheStats(); stats != want {
+		t.Errorf("stats want:%#v,got:%#v", want, stats)
+	}
+
+	// 使用中被淘汰的语句在归还后才关闭,淘汰不等待执行结束
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := provider.ExecOrQueryArgsContext(context.Background(), "update slow set x=1")
+		slowDone <- err
+	}()
+	<-testStmtDriver.entered
+	evicted := make(chan struct{})
+	go func() {
+		exec("update c set x=1")
+		close(evicted)
+	}()
+	select {
+	case <-evicted:
+	case <-time.After(time.Second):
+		close(testStmtDriver.unblock) // 结束阻塞的执行,避免关闭资源时等待
+		t.Fatal("evicting statement in use blocked")
+	}
+	if got := testStmtDriver.closedTimes("update slow set x=1"); got != 0 {
+		t.Errorf("statement in use want open,closed:%d", got)
+	}
+	close(testStmtDriver.unblock)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+	if got := testStmtDriver.closedTimes("update slow set x=1"); got != 1 {
+		t.Errorf("evicted statement want closed after release,got:%d", got)
+	}
+	if stats := provider.StmtCacheStats(); stats.Evictions != 3 || stats.Size != 1 {
+		t.Errorf("stats after evicting in use statement got:%#v", stats)
+	}
+
+	// 连接失效时语句从缓存移除
+	if _, err := provider.ExecOrQueryArgsContext(context.Background(), "update bad set x=1"); !errors.Is(err, driver.ErrBadConn) {
+		t.Fatalf("want bad conn error,got:%v", err)
+	}
+	if stats := provider.StmtCacheStats(); stats.Evictions != 5 || stats.Size != 0 {
+		t.Errorf("stats after conn reset got:%#v", stats)
+	}
+
+	// LRU:命中的语句移到最前,淘汰最久未使用的
+	lru := newProvider(2)
+	defer lru.Close()
+	for _, statement := range []string{"update d set x=1", "update e set x=1", "update d set x=1", "update f set x=1"} {
+		if _, err := lru.ExecOrQueryArgsContext(context.Background(), statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if testStmtDriver.closedTimes("update e set x=1") != 1 || testStmtDriver.closedTimes("update d set x=1") != 0 {
+		t.Errorf("lru want evict e keep d,closed e:%d d:%d", testStmtDriver.closedTimes("update e set x=1"), testStmtDriver.closedTimes("update d set x=1"))
+	}
+}
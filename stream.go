@@ -0,0 +1,340 @@
+package dataexchanger
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/suifengpiao14/tengolib/util"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	STREAM_FORMAT_JSON   = "json"   // json 数组
+	STREAM_FORMAT_NDJSON = "ndjson" // 每行一个 json 对象
+	STREAM_FORMAT_CSV    = "csv"
+
+	MEDIA_TYPE_NDJSON = "application/x-ndjson"
+
+	STREAM_FLUSH_ROWS = 100 // 每输出多少行刷新一次
+)
+
+// DtoStream 流式输出声明,查询结果从数据库游标逐行读取,按输出行 schema 转换后写出,内存占用不随行数增长;
+// 流式输出时输出行 schema 描述单行数据,src 为查询列名
+type DtoStream struct {
+	Template string `json:"template"` // 查询模板,入参为格式化后的输入
+	Format   string `json:"format"`   // json(默认)、ndjson、csv
+}
+
+func (s DtoStream) validate() (err error) {
+	if s.Template == "" {
+		err = errors.New("stream template required")
+		return err
+	}
+	if s.Format == "" {
+		return nil
+	}
+	return validateStreamFormat(s.Format)
+}
+
+func validateStreamFormat(format string) (err error) {
+	switch format {
+	case STREAM_FORMAT_JSON, STREAM_FORMAT_NDJSON, STREAM_FORMAT_CSV:
+	default:
+		err = errors.Errorf("stream format want json/ndjson/csv,got:%s", format)
+		return err
+	}
+	return nil
+}
+
+// SQLRowsQuerier 支持游标逐行读取的资源,流式输出使用
+type SQLRowsQuerier interface {
+	QueryRowsContext(ctx context.Context, statement string, args ...interface{}) (rows *sql.Rows, err error)
+}
+
+// IsStream 是否为流式输出api
+func (capi *apiCompiled) IsStream() bool {
+	return capi.stream != nil
+}
+
+// StreamMediaType 流式输出格式对应的媒体类型
+func StreamMediaType(format string) string {
+	switch format {
+	case STREAM_FORMAT_NDJSON:
+		return MEDIA_TYPE_NDJSON
+	case STREAM_FORMAT_CSV:
+		return MEDIA_TYPE_CSV
+	}
+	return MEDIA_TYPE_JSON
+}
+
+// streamFormatByAccept 按 Accept 选择流式输出格式,未匹配时使用声明的格式
+func (capi *apiCompiled) streamFormatByAccept(accept string) (format string) {
+	accept = strings.ToLower(accept)
+	switch {
+	case strings.Contains(accept, MEDIA_TYPE_NDJSON):
+		return STREAM_FORMAT_NDJSON
+	case strings.Contains(accept, MEDIA_TYPE_CSV):
+		return STREAM_FORMAT_CSV
+	case strings.Contains(accept, MEDIA_TYPE_JSON):
+		return STREAM_FORMAT_JSON
+	}
+	return capi.stream.Format
+}
+
+// RunStream 流式执行API,format 为空时使用声明的格式
+func (capi *apiCompiled) RunStream(ctx context.Context, inputJson string, w io.Writer, format string) (err error) {
+	logInfo := RunLogInfo{
+		Name:          LOG_INFO_RUN,
+		Context:       ctx,
+		OriginalInput: inputJson,
+		DefaultJson:   capi.defaultJson,
+		masker:        capi.newRunLogMasker(),
+	}
+	collectSensitiveValues(logInfo.masker, inputJson, capi.sensitiveInput, false)
+	state := newRunState()
+	defer state.releaseSources()
+	ctx = context.WithValue(ctx, CONTEXT_KEY_RUN_STATE, state)
+	defer func() {
+		logInfo.Err = err
+		logchan.SendLogInfo(&logInfo)
+	}()
+	if capi.stream == nil {
+		err = errors.Errorf("apiCompiled.RunStream stream not declared,route:%s", capi.Route)
+		return err
+	}
+	if format == "" {
+		format = capi.stream.Format
+	}
+	if err = validateStreamFormat(format); err != nil {
+		err = errors.WithMessagef(err, "apiCompiled.RunStream,route:%s", capi.Route)
+		return err
+	}
+	if err = capi.authorize(ctx); err != nil {
+		return err
+	}
+	inputJson, err = capi.formatInput(inputJson)
+	if err != nil {
+		return err
+	}
+	logInfo.PreInput = inputJson
+	collectSensitiveValues(logInfo.masker, inputJson, capi.sensitiveInput, true)
+	input, _ := gjson.Parse(inputJson).Value().(map[string]interface{})
+	tplName := capi.stream.Template
+	volume := newVolume(input)
+	_, provider, err := capi.getProviderByTemplate(ctx, tplName)
+	if err != nil {
+		return err
+	}
+	dialect := capi.providerDialect(tplName, provider)
+	volume.SetValue(VOLUME_KEY_DIALECT, dialect.Name())
+	named, volumeI, err := capi.template.Exec(tplName, volume)
+	if err != nil {
+		err = errors.WithMessagef(err, "apiCompiled.RunStream.Template,route:%s", capi.Route)
+		return err
+	}
+	statement, args, err := toStatement(dialect, named, volumeI.ToMap())
+	if err != nil {
+		return err
+	}
+	querier, ok := provider.(SQLRowsQuerier)
+	if !ok {
+		err = errors.Errorf("apiCompiled.RunStream required SQLRowsQuerier source,got:%s,route:%s", provider.TypeName(), capi.Route)
+		return err
+	}
+	if route, ok := capi.dbRoutes[tplName]; ok {
+		ctx = context.WithValue(ctx, CONTEXT_KEY_DB_ROUTE, route)
+	}
+	rows, err := querier.QueryRowsContext(ctx, statement, args...)
+	if err != nil {
+		err = errors.WithMessagef(err, "apiCompiled.RunStream.Query,route:%s", capi.Route)
+		return err
+	}
+	defer rows.Close()
+	count, err := capi.writeStream(ctx, rows, w, format)
+	logInfo.Out = fmt.Sprintf("stream %s rows:%d", format, count)
+	if err != nil {
+		err = errors.WithMessagef(err, "apiCompiled.RunStream.Write,route:%s", capi.Route)
+		return err
+	}
+	return nil
+}
+
+// streamRow 将当前行转换为输出并脱敏
+func (capi *apiCompiled) streamRow(ctx context.Context, row string) (out string, err error) {
+	if capi.outputGjsonPath == "" {
+		return row, nil
+	}
+	out = gjson.Get(row, capi.outputGjsonPath).String()
+	out = gjson.Get(out, string(capi.outputLineSchema.Meta.ID)).Raw
+	return capi.maskOutput(ctx, out)
+}
+
+// writeStream 逐行读取、转换并写出,每 STREAM_FLUSH_ROWS 行刷新一次
+func (capi *apiCompiled) writeStream(ctx context.Context, rows *sql.Rows, w io.Writer, format string) (count int, err error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	buf := bufio.NewWriter(w)
+	var csvWriter *csv.Writer
+	var csvFields []string
+	flush := func() error {
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		if flusher, ok := w.(interface{ Flush() }); ok { // http.Flusher
+			flusher.Flush()
+		}
+		return nil
+	}
+	switch format {
+	case STREAM_FORMAT_JSON:
+		buf.WriteString("[")
+	case STREAM_FORMAT_CSV:
+		csvWriter = csv.NewWriter(buf)
+		_, csvFields = csvColumns(capi.outputLineSchema)
+		if csvFields == nil {
+			for _, column := range columns {
+				csvFields = append(csvFields, escapePathKey(column))
+			}
+		}
+		if err = csvWriter.Write(csvFields); err != nil {
+			return 0, err
+		}
+	}
+	record := make([]string, 0, len(csvFields))
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		row := "{}"
+		for i, column := range columns {
+			if row, err = sjson.Set(row, escapePathKey(column), dbValueToString(values[i])); err != nil {
+				return count, err
+			}
+		}
+		var out string
+		if out, err = capi.streamRow(ctx, row); err != nil {
+			return count, err
+		}
+		switch format {
+		case STREAM_FORMAT_JSON:
+			if count > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(out)
+		case STREAM_FORMAT_NDJSON:
+			buf.WriteString(out)
+			buf.WriteString("\n")
+		case STREAM_FORMAT_CSV:
+			result := gjson.Parse(out)
+			record = record[:0]
+			for _, field := range csvFields {
+				record = append(record, result.Get(field).String())
+			}
+			if err = csvWriter.Write(record); err != nil {
+				return count, err
+			}
+		}
+		count++
+		if count%STREAM_FLUSH_ROWS == 0 {
+			if err = flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	if format == STREAM_FORMAT_JSON {
+		buf.WriteString("]")
+	}
+	return count, flush()
+}
+
+// QueryRowsContext 实现 SQLRowsQuerier,调用方负责关闭 rows
+func (p *DBProvider) QueryRowsContext(ctx context.Context, statement string, args ...interface{}) (rows *sql.Rows, err error) {
+	return queryRowsContext(ctx, p.sqlDB, statement, args...)
+}
+
+// QueryRowsContext 实现 SQLRowsQuerier,按读操作路由(游标读取期间不计入从库负载)
+func (p *ReplicaDBProvider) QueryRowsContext(ctx context.Context, statement string, args ...interface{}) (rows *sql.Rows, err error) {
+	provider, node := p.route(ctx, statement)
+	defer p.done(node)
+	return provider.QueryRowsContext(ctx, statement, args...)
+}
+
+func queryRowsContext(ctx context.Context, db *sql.DB, statement string, args ...interface{}) (rows *sql.Rows, err error) {
+	sqlLogInfo := &LogInfoEXECSQL{Args: args}
+	sqlLogInfo.Context = ctx
+	defer func() {
+		sqlLogInfo.Err = err
+		duration := float64(sqlLogInfo.EndAt.Sub(sqlLogInfo.BeginAt).Nanoseconds()) / 1e6
+		sqlLogInfo.Duration = fmt.Sprintf("%.3fms", duration)
+		logchan.SendLogInfo(sqlLogInfo)
+	}()
+	statement = util.StandardizeSpaces(util.TrimSpaces(statement))
+	sqlLogInfo.SQL = statement
+	if tengodb.SQLType(statement) != tengodb.SQL_TYPE_SELECT {
+		err = errors.Errorf("stream query required select statement,got:%s", statement)
+		return nil, err
+	}
+	sqlLogInfo.BeginAt = time.Now().Local()
+	rows, err = db.QueryContext(ctx, statement, args...)
+	sqlLogInfo.EndAt = time.Now().Local()
+	return rows, err
+}
+
+// streamResponseWriter 首次写入时才输出响应头,写入前出错仍可返回错误状态码
+type streamResponseWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	wrote       bool
+}
+
+func (sw *streamResponseWriter) Write(p []byte) (n int, err error) {
+	if !sw.wrote {
+		sw.wrote = true
+		sw.w.Header().Set("Content-Type", sw.contentType)
+		sw.w.WriteHeader(http.StatusOK)
+	}
+	return sw.w.Write(p)
+}
+
+func (sw *streamResponseWriter) Flush() {
+	if flusher, ok := sw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveStream 流式输出api的http处理
+func (capi *apiCompiled) serveStream(w http.ResponseWriter, r *http.Request, inputJson string) {
+	format := capi.streamFormatByAccept(r.Header.Get("Accept"))
+	sw := &streamResponseWriter{w: w, contentType: StreamMediaType(format)}
+	err := capi.RunStream(r.Context(), inputJson, sw, format)
+	if err != nil && !sw.wrote {
+		writeHTTPError(w, r, err)
+	}
+}
@@ -0,0 +1,105 @@
+package dataexchanger_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/tidwall/gjson"
+)
+
+func TestRunStream(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "stream.db"))
+	source, err := dataexchanger.MakeSource("sqlite", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = provider.ExecOrQueryContext(ctx, `create table item (id integer primary key, name text)`); err != nil {
+		t.Fatal(err)
+	}
+	insertSQL := `insert into item (id,name) with recursive seq(x) as (select 1 union all select x+1 from seq where x<1000) select x,'item'||x from seq`
+	if _, err = provider.ExecOrQueryContext(ctx, insertSQL); err != nil {
+		t.Fatal(err)
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/item/export",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=minId,dst=minId,format=number,in=query,required`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=label,src=name,required
+		fullname=itemId,src=id,required`,
+		Stream: &dataexchanger.DtoStream{Template: "Export"},
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Export"}}select id,name from item where id>=:minId order by id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = capi.RunStream(ctx, `{"minId":"1"}`, &buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	rows := gjson.Parse(buf.String()).Array()
+	if len(rows) != 1000 {
+		t.Fatalf("json want 1000 rows,got:%d", len(rows))
+	}
+	if got := rows[999].Get("[label,itemId]").Raw; got != `["item1000","1000"]` {
+		t.Errorf("json last row got:%s", got)
+	}
+
+	buf.Reset()
+	if err = capi.RunStream(ctx, `{"minId":"999"}`, &buf, dataexchanger.STREAM_FORMAT_NDJSON); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 || gjson.Get(lines[1], "[label,itemId]").Raw != `["item1000","1000"]` {
+		t.Errorf("ndjson got:%q", buf.String())
+	}
+
+	buf.Reset()
+	if err = capi.RunStream(ctx, `{"minId":"999"}`, &buf, "xml"); err == nil || buf.Len() != 0 {
+		t.Errorf("unknown format want error before output,got err:%v,body:%q", err, buf.String())
+	}
+
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/item/export?minId=998", nil)
+	req.Header.Set("Accept", dataexchanger.MEDIA_TYPE_CSV)
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if want := "label,itemId\nitem998,998\nitem999,999\nitem1000,1000\n"; rec.Body.String() != want {
+		t.Errorf("csv want:%q,got:%q", want, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != dataexchanger.MEDIA_TYPE_CSV {
+		t.Errorf("csv Content-Type got:%s", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/item/export", nil)
+	rec = httptest.NewRecorder()
+	container.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "error") {
+		t.Errorf("missing input want 400,got:%d,body:%s", rec.Code, rec.Body.String())
+	}
+}
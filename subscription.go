@@ -0,0 +1,290 @@
+package dataexchanger
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/jsonschemaline"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	SUBSCRIPTION_POLL_TIMEOUT_DEFAULT = 30 // 长轮询默认等待秒数
+	SUBSCRIPTION_HEARTBEAT_DEFAULT    = 15 // SSE 心跳秒数
+
+	MEDIA_TYPE_EVENT_STREAM = "text/event-stream"
+
+	SUBSCRIPTION_QUERY_LAST_EVENT_ID = "lastEventId" // 长轮询、无法设置请求头时使用
+	SUBSCRIPTION_QUERY_TIMEOUT       = "timeout"     // 长轮询等待秒数
+)
+
+// DtoSubscription 订阅路由声明,客户端通过 SSE(或长轮询)接收主题事件
+type DtoSubscription struct {
+	Route string `json:"route"`
+	Topic string `json:"topic"`
+	// FilterLineSchema 过滤条件,与输入行 schema 语法相同:fullname 为请求中的字段(in 指定来源,默认 query),
+	// dst 为事件数据中的路径,客户端提供值时只接收相等的事件;enum 限定事件值范围;required 要求客户端提供
+	FilterLineSchema string   `json:"filterLineSchema"`
+	PollTimeout      int      `json:"pollTimeout"` // 长轮询最长等待秒数
+	Heartbeat        int      `json:"heartbeat"`   // SSE 心跳秒数
+	Roles            []string `json:"roles"`       // 订阅方需拥有其中任一角色
+	Permissions      []string `json:"permissions"` // 订阅方需拥有全部权限
+}
+
+type eventFilter struct {
+	location inputLocation
+	path     string // 事件数据中的路径
+	required bool
+	enum     []string
+}
+
+type subscription struct {
+	DtoSubscription
+	filters []eventFilter
+}
+
+// RegisterSubscription 注册订阅路由(GET)
+func (c *Container) RegisterSubscription(dto DtoSubscription) (err error) {
+	if dto.Route == "" || dto.Topic == "" {
+		err = errors.Errorf("subscription route and topic required,got route:%s,topic:%s", dto.Route, dto.Topic)
+		return err
+	}
+	if dto.PollTimeout <= 0 {
+		dto.PollTimeout = SUBSCRIPTION_POLL_TIMEOUT_DEFAULT
+	}
+	if dto.Heartbeat <= 0 {
+		dto.Heartbeat = SUBSCRIPTION_HEARTBEAT_DEFAULT
+	}
+	sub := &subscription{DtoSubscription: dto}
+	if dto.FilterLineSchema != "" {
+		lineSchema, err := jsonschemaline.ParseJsonschemaline(dto.FilterLineSchema)
+		if err != nil {
+			err = errors.WithMessagef(err, "Container.RegisterSubscription.ParseJsonschemaline,route:%s", dto.Route)
+			return err
+		}
+		locations, err := parseInputLocations(lineSchema)
+		if err != nil {
+			err = errors.WithMessagef(err, "Container.RegisterSubscription.parseInputLocations,route:%s", dto.Route)
+			return err
+		}
+		for i, item := range lineSchema.Items {
+			filter := eventFilter{location: locations[i], path: item.Dst, required: item.Required}
+			if filter.location.In == INPUT_IN_BODY {
+				filter.location.In = INPUT_IN_QUERY
+			}
+			if filter.path == "" {
+				filter.path = item.Fullname
+			}
+			for _, kv := range item.TagLineKVpair {
+				if kv.Key == "enum" {
+					filter.enum = append(filter.enum, kv.Value)
+				}
+			}
+			sub.filters = append(sub.filters, filter)
+		}
+	}
+	c.lockSub.Lock()
+	defer c.lockSub.Unlock()
+	c.subscriptions[dto.Route] = sub
+	c.subPatterns = c.subPatterns.add(dto.Route, dto.Route)
+	return nil
+}
+
+// matchSubscription 匹配订阅路由,精确匹配优先,其次按具体程度、注册顺序匹配带路径参数的路由
+func (c *Container) matchSubscription(path string) (sub *subscription, pathParams map[string]string, ok bool) {
+	c.lockSub.Lock()
+	defer c.lockSub.Unlock()
+	if sub, ok = c.subscriptions[path]; ok {
+		return sub, map[string]string{}, true
+	}
+	for _, p := range c.subPatterns {
+		if pathParams, ok = matchRoute(p.route, path); ok {
+			return c.subscriptions[p.key], pathParams, true
+		}
+	}
+	return nil, nil, false
+}
+
+// matcher 按请求生成事件过滤函数
+func (sub *subscription) matcher(r *http.Request, pathParams map[string]string) (match func(event Event) bool, err error) {
+	query := r.URL.Query()
+	values := make(map[string]string)
+	for _, filter := range sub.filters {
+		value, ok := httpInputValue(r, query, filter.location, pathParams)
+		if !ok {
+			if filter.required {
+				err = errors.Errorf("subscription filter %s is required", filter.location.Name)
+				return nil, NewStatusError(http.StatusBadRequest, err)
+			}
+			continue
+		}
+		if len(filter.enum) > 0 && !containsString(filter.enum, value) {
+			err = errors.Errorf("subscription filter %s want one of %v,got:%s", filter.location.Name, filter.enum, value)
+			return nil, NewStatusError(http.StatusBadRequest, err)
+		}
+		values[filter.path] = value
+	}
+	match = func(event Event) bool {
+		for _, filter := range sub.filters {
+			got := gjson.Get(event.Data, filter.path)
+			if len(filter.enum) > 0 && !containsString(filter.enum, got.String()) {
+				return false
+			}
+			if want, ok := values[filter.path]; ok && (!got.Exists() || got.String() != want) {
+				return false
+			}
+		}
+		return true
+	}
+	return match, nil
+}
+
+// lastEventID 断线重连时的最后事件ID,SSE 使用 Last-Event-ID 请求头
+func lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get(SUBSCRIPTION_QUERY_LAST_EVENT_ID)
+}
+
+// serveSubscription 请求接受 text/event-stream 时使用 SSE,否则使用长轮询
+func (c *Container) serveSubscription(w http.ResponseWriter, r *http.Request, sub *subscription, pathParams map[string]string) {
+	if err := authorizePrincipal(r.Context(), sub.Roles, sub.Permissions); err != nil {
+		writeHTTPError(w, r, err)
+		return
+	}
+	match, err := sub.matcher(r, pathParams)
+	if err != nil {
+		writeHTTPError(w, r, err)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), MEDIA_TYPE_EVENT_STREAM) {
+		c.serveSSE(w, r, sub, match)
+		return
+	}
+	c.serveLongPoll(w, r, sub, match)
+}
+
+func (c *Container) serveSSE(w http.ResponseWriter, r *http.Request, sub *subscription, match func(event Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, r, errors.New("streaming unsupported"))
+		return
+	}
+	subscriber, missed, _ := c.eventBus.subscribe(sub.Topic, lastEventID(r))
+	defer c.eventBus.unsubscribe(subscriber)
+	w.Header().Set("Content-Type", MEDIA_TYPE_EVENT_STREAM)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		if match(event) {
+			writeSSEEvent(w, event)
+		}
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(time.Duration(sub.Heartbeat) * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case event, ok := <-subscriber.events:
+			if !ok { // 订阅被断开,客户端凭最后事件ID重连
+				return
+			}
+			if match(event) {
+				writeSSEEvent(w, event)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeSSEEvent(w http.ResponseWriter, event Event) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\n", event.ID, event.Topic)
+	for _, line := range strings.Split(event.Data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// serveLongPoll 有未读事件时立即返回,否则等待新事件或超时,响应 {"events":[],"lastEventId":""},
+// lastEventId 为已处理到的最新序号(超时、只收到不匹配的事件时同样前进),客户端下次凭此续传
+func (c *Container) serveLongPoll(w http.ResponseWriter, r *http.Request, sub *subscription, match func(event Event) bool) {
+	subscriber, missed, seq := c.eventBus.subscribe(sub.Topic, lastEventID(r))
+	defer c.eventBus.unsubscribe(subscriber)
+	events := make([]Event, 0)
+	for _, event := range missed {
+		if match(event) {
+			events = append(events, event)
+		}
+	}
+	timeout := sub.PollTimeout
+	if seconds, err := strconv.Atoi(r.URL.Query().Get(SUBSCRIPTION_QUERY_TIMEOUT)); err == nil && seconds >= 0 && seconds < timeout {
+		timeout = seconds
+	}
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+	for len(events) == 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			writeLongPollEvents(w, events, seq)
+			return
+		case event, ok := <-subscriber.events:
+			if !ok {
+				writeLongPollEvents(w, events, seq)
+				return
+			}
+			seq = event.seq
+			if match(event) {
+				events = append(events, event)
+			}
+		}
+	}
+	for drained := false; !drained; { // 一并返回已到达的事件
+		select {
+		case event, ok := <-subscriber.events:
+			if !ok {
+				drained = true
+				break
+			}
+			seq = event.seq
+			if match(event) {
+				events = append(events, event)
+			}
+		default:
+			drained = true
+		}
+	}
+	writeLongPollEvents(w, events, seq)
+}
+
+func writeLongPollEvents(w http.ResponseWriter, events []Event, seq uint64) {
+	out := `{"events":[]}`
+	for i, event := range events {
+		item, _ := sjson.Set("", "id", event.ID)
+		item, _ = sjson.Set(item, "topic", event.Topic)
+		if gjson.Valid(event.Data) {
+			item, _ = sjson.SetRaw(item, "data", event.Data)
+		} else {
+			item, _ = sjson.Set(item, "data", event.Data)
+		}
+		out, _ = sjson.SetRaw(out, fmt.Sprintf("events.%d", i), item)
+	}
+	out, _ = sjson.Set(out, "lastEventId", strconv.FormatUint(seq, 10))
+	w.Header().Set("Content-Type", MEDIA_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(out))
+}
@@ -0,0 +1,224 @@
+package dataexchanger_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/tidwall/gjson"
+)
+
+func TestSubscription(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/order/pay",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number,required
+		fullname=userId,dst=userId,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		input:=storage.GetMemory()
+		execSQLTPL(ctx,"Pay",input)
+		publish(ctx,"audit",{orderId:input.id})
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inOutMap := map[string]string{}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		inOutMap["update orders set status='paid' where id="+id] = "1"
+	}
+	source.SetProvider(&tengodb.TengoMemoryDB{InOutMap: inOutMap})
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Pay"}}update orders set status='paid' where id=:id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	capi.SetTemplateTopic(tplNames, "order", "id", "userId")
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	err = container.RegisterSubscription(dataexchanger.DtoSubscription{
+		Route: "/sub/order",
+		Topic: "order",
+		FilterLineSchema: `version=http://json-schema.org/draft-07/schema,id=filter,direction=in
+		fullname=userId,dst=userId,required`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay := func(input string) {
+		if _, err := capi.Run(context.Background(), input); err != nil {
+			t.Error(err)
+		}
+	}
+	poll := func(url string) (rec *httptest.ResponseRecorder) {
+		rec = httptest.NewRecorder()
+		container.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	pay(`{"id":"1","userId":"7"}`)
+	pay(`{"id":"2","userId":"8"}`)
+	rec := poll("/sub/order?userId=7&lastEventId=0&timeout=0")
+	if got := gjson.Get(rec.Body.String(), "events.#.data.id").Raw; got != `[1]` {
+		t.Errorf("long poll replay got:%s", rec.Body.String())
+	}
+	lastID := gjson.Get(rec.Body.String(), "lastEventId").String()
+	firstID := gjson.Get(rec.Body.String(), "events.0.id").String()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pay(`{"id":"3","userId":"8"}`)
+		pay(`{"id":"4","userId":"7"}`)
+	}()
+	rec = poll("/sub/order?userId=7&timeout=5&lastEventId=" + lastID)
+	if got := gjson.Get(rec.Body.String(), "events.#.data.id").Raw; got != `[4]` {
+		t.Errorf("long poll wait got:%s", rec.Body.String())
+	}
+
+	// 超时未收到事件时同样返回最新序号,两次轮询之间发布的事件不丢失
+	rec = poll("/sub/order?userId=7&timeout=0")
+	cursor := gjson.Get(rec.Body.String(), "lastEventId").String()
+	if cursor == "" || gjson.Get(rec.Body.String(), "events.#").Int() != 0 {
+		t.Fatalf("long poll timeout want cursor,got:%s", rec.Body.String())
+	}
+	pay(`{"id":"1","userId":"7"}`)
+	rec = poll("/sub/order?userId=7&timeout=0&lastEventId=" + cursor)
+	if got := gjson.Get(rec.Body.String(), "events.#.data.id").Raw; got != `[1]` {
+		t.Errorf("long poll resume after timeout got:%s", rec.Body.String())
+	}
+	rec = poll("/sub/order?userId=7&timeout=0&lastEventId=999999") // 序号重置后补发历史
+	if got := gjson.Get(rec.Body.String(), "events.#.data.id").Raw; got != `[1,4,1]` {
+		t.Errorf("long poll lastEventId ahead of bus want history,got:%s", rec.Body.String())
+	}
+
+	if rec = poll("/sub/order"); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing required filter want 400,got:%d", rec.Code)
+	}
+
+	err = container.RegisterSubscription(dataexchanger.DtoSubscription{Route: "/sub/order/all", Topic: "order", Roles: []string{"admin"}, Permissions: []string{"order:read"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.RegisterAuthenticator(dataexchanger.AuthenticatorFunc(func(r *http.Request) (*dataexchanger.Principal, error) {
+		switch r.Header.Get("X-Test-User") {
+		case "admin":
+			return &dataexchanger.Principal{Subject: "1", Roles: []string{"admin"}, Permissions: []string{"order:*"}}, nil
+		case "guest":
+			return &dataexchanger.Principal{Subject: "2", Roles: []string{"guest"}, Permissions: []string{"order:read"}}, nil
+		}
+		return nil, nil
+	}))
+	for user, status := range map[string]int{"": http.StatusUnauthorized, "guest": http.StatusForbidden, "admin": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/sub/order/all?lastEventId=0&timeout=0", nil)
+		req.Header.Set("X-Test-User", user)
+		rec = httptest.NewRecorder()
+		container.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("subscription user %q want status %d,got:%d,body:%s", user, status, rec.Code, rec.Body.String())
+		}
+	}
+
+	server := httptest.NewServer(container)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/sub/order?userId=8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", dataexchanger.MEDIA_TYPE_EVENT_STREAM)
+	req.Header.Set("Last-Event-ID", firstID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != dataexchanger.MEDIA_TYPE_EVENT_STREAM {
+		t.Fatalf("sse Content-Type got:%s", got)
+	}
+	go pay(`{"id":"5","userId":"8"}`)
+	reader := bufio.NewReader(resp.Body)
+	ids := make([]string, 0)
+	for len(ids) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			ids = append(ids, gjson.Get(strings.TrimPrefix(line, "data: "), "id").String())
+		}
+	}
+	if got := strings.Join(ids, ","); got != "2,3,5" {
+		t.Errorf("sse resume want 2,3,5,got:%s", got)
+	}
+}
+
+func TestTemplateEventData(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "post",
+		Route:   "/api/user/password",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number,required
+		fullname=password,dst=password,required,sensitive
+		fullname=token,dst=token`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		execSQLTPL(ctx,"SetPassword",storage.GetMemory())
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.SetProvider(&tengodb.TengoMemoryDB{InOutMap: map[string]string{"update users set password='secret-pass' where id=1": "1"}})
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "SetPassword"}}update users set password=:password where id=:id{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	capi.SetTemplateTopic(tplNames, "user", "id", "password")
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	err = container.RegisterSubscription(dataexchanger.DtoSubscription{Route: "/sub/user", Topic: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = capi.Run(context.Background(), `{"id":"1","password":"secret-pass","token":"secret-token"}`); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	container.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/user?lastEventId=0&timeout=0", nil))
+	data := gjson.Get(rec.Body.String(), "events.0.data")
+	if data.Get("id").String() != "1" {
+		t.Fatalf("event data want id,got:%s", rec.Body.String())
+	}
+	if data.Get("token").Exists() || strings.Contains(data.Raw, "secret") || data.Get("password").String() == "" {
+		t.Errorf("event data want declared fields with sensitive masked,got:%s", data.Raw)
+	}
+}
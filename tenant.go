@@ -0,0 +1,171 @@
+package dataexchanger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/pkg/errors"
+	"github.com/suifengpiao14/tengolib/tengosource"
+)
+
+// SourceResolver 运行时根据上下文(如中间件写入的租户ID)解析实际使用的资源
+type SourceResolver interface {
+	// Resolve 返回实际资源标识,ok 为 false 时使用模板绑定的资源
+	Resolve(ctx context.Context, sourceIdentifer string) (identifer string, ok bool)
+	// MakeSource 资源池中不存在时按需创建
+	MakeSource(identifer string) (s tengosource.Source, err error)
+}
+
+// TenantSourceResolver 按租户解析资源,实际资源标识为 "模板绑定资源标识@租户ID"
+type TenantSourceResolver struct {
+	ContextKey interface{} // 上下文中租户ID的key
+	// MakeTenantSource 创建租户资源,一般通过 MakeSource 按租户配置生成
+	MakeTenantSource func(tenantID string, sourceIdentifer string, identifer string) (s tengosource.Source, err error)
+}
+
+const TENANT_SOURCE_DELIMITER = "@"
+
+func (r *TenantSourceResolver) Resolve(ctx context.Context, sourceIdentifer string) (identifer string, ok bool) {
+	tenantID := ""
+	if v := ctx.Value(r.ContextKey); v != nil {
+		tenantID = fmt.Sprint(v)
+	}
+	if tenantID == "" {
+		return "", false
+	}
+	return sourceIdentifer + TENANT_SOURCE_DELIMITER + tenantID, true
+}
+
+func (r *TenantSourceResolver) MakeSource(identifer string) (s tengosource.Source, err error) {
+	index := strings.LastIndex(identifer, TENANT_SOURCE_DELIMITER)
+	if index < 0 {
+		err = errors.Errorf("invalid tenant source identifer:%s", identifer)
+		return s, err
+	}
+	sourceIdentifer, tenantID := identifer[:index], identifer[index+1:]
+	return r.MakeTenantSource(tenantID, sourceIdentifer, identifer)
+}
+
+type resolvedSource struct {
+	provider tengo.Object
+	lastUsed time.Time
+	refs     int  // 使用中的 Run 数
+	evicted  bool // 已淘汰,最后一个使用中的 Run 释放时关闭
+}
+
+// resolvedSourcePool 运行时解析出的资源池,按需创建,空闲超时后淘汰.
+// 未缓存在 tengosource.SourcePool 中:SourcePool 只支持注册,无法记录使用中的执行、淘汰空闲资源并延迟关闭
+type resolvedSourcePool struct {
+	resolver SourceResolver
+	sources  map[string]*resolvedSource
+	lock     sync.Mutex
+}
+
+func newResolvedSourcePool(resolver SourceResolver) *resolvedSourcePool {
+	return &resolvedSourcePool{
+		resolver: resolver,
+		sources:  make(map[string]*resolvedSource),
+	}
+}
+
+// getProvider 解析资源,ok 为 false 时使用模板绑定的资源
+func (p *resolvedSourcePool) getProvider(ctx context.Context, sourceIdentifer string) (identifer string, provider tengo.Object, ok bool, err error) {
+	identifer, ok = p.resolver.Resolve(ctx, sourceIdentifer)
+	if !ok {
+		return "", nil, false, nil
+	}
+	p.lock.Lock()
+	if source, ok := p.sources[identifer]; ok {
+		defer p.lock.Unlock()
+		return identifer, p.use(ctx, source), true, nil
+	}
+	p.lock.Unlock()
+	// 创建资源可能连接数据库,不持有锁,避免一个租户的资源阻塞其他租户
+	s, err := p.resolver.MakeSource(identifer)
+	if err != nil {
+		err = errors.WithMessagef(err, "resolvedSourcePool.MakeSource,source:%s", identifer)
+		return "", nil, false, err
+	}
+	provider, err = getSourceProvider(s)
+	if err != nil {
+		return "", nil, false, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	source, ok := p.sources[identifer]
+	if ok { // 并发创建时使用先缓存的资源
+		closeResolvedProvider(provider)
+	} else {
+		source = &resolvedSource{provider: provider}
+		p.sources[identifer] = source
+	}
+	return identifer, p.use(ctx, source), true, nil
+}
+
+// use 记录资源被本次执行使用,调用方需持有锁
+func (p *resolvedSourcePool) use(ctx context.Context, source *resolvedSource) (provider tengo.Object) {
+	source.lastUsed = time.Now()
+	if state := getRunState(ctx); state != nil && state.holdSource(source, func() { p.release(source) }) {
+		source.refs++ // Run 结束时释放,使用中的资源淘汰后延迟关闭
+	}
+	return source.provider
+}
+
+func (p *resolvedSourcePool) release(source *resolvedSource) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	source.refs--
+	if source.evicted && source.refs <= 0 {
+		closeResolvedProvider(source.provider)
+	}
+}
+
+// evictIdle 淘汰超过 idle 未使用的资源,仍有 Run 使用的资源在释放后关闭
+func (p *resolvedSourcePool) evictIdle(idle time.Duration) (evicted []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	deadline := time.Now().Add(-idle)
+	for identifer, source := range p.sources {
+		if source.lastUsed.After(deadline) {
+			continue
+		}
+		delete(p.sources, identifer)
+		source.evicted = true
+		if source.refs <= 0 {
+			closeResolvedProvider(source.provider)
+		}
+		evicted = append(evicted, identifer)
+	}
+	return evicted
+}
+
+// closeResolvedProvider 关闭解析器创建的资源,按配置共用的 sql 连接池只释放引用,其他使用方全部释放后才关闭
+func closeResolvedProvider(provider tengo.Object) {
+	switch p := provider.(type) {
+	case interface{ release() error }:
+		p.release()
+	case interface{ Close() error }:
+		p.Close()
+	}
+}
+
+// getSourceProvider 获取资源提供者(tengosource.Source 未导出 provider)
+func getSourceProvider(s tengosource.Source) (provider tengo.Object, err error) {
+	pool := tengosource.NewSourcePool()
+	if err = pool.RegisterSource(s); err != nil {
+		return nil, err
+	}
+	provider, err = pool.GetProviderBySourceIdentifer(s.Identifer)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		err = errors.Errorf("source(%s) provider is nil", s.Identifer)
+		return nil, err
+	}
+	return provider, nil
+}
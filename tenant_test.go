@@ -0,0 +1,316 @@
+package dataexchanger_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/suifengpiao14/dataexchanger"
+	"github.com/suifengpiao14/logchan/v2"
+	"github.com/suifengpiao14/tengolib/tengodb"
+	"github.com/suifengpiao14/tengolib/tengosource"
+	"github.com/tidwall/gjson"
+)
+
+type tenantKey struct{}
+
+func TestTenantSourceResolver(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/tenant/name",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=name,src=name,required`,
+		MainScript: `storage.Set("name",execSQLTPL(storage.GetCtx(),"Name",storage.GetMemory()))`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.SetProvider(&tengodb.TengoMemoryDB{InOutMap: map[string]string{"select name from site": "default"}})
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateDependSource(capi.RegisterTemplate("", `{{define "Name"}}select name from site{{end}}`), "db"); err != nil {
+		t.Fatal(err)
+	}
+	made := 0
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	container.SetSourceResolver(&dataexchanger.TenantSourceResolver{
+		ContextKey: tenantKey{},
+		MakeTenantSource: func(tenantID string, sourceIdentifer string, identifer string) (s tengosource.Source, err error) {
+			made++
+			s, err = dataexchanger.MakeSource(identifer, dataexchanger.PROVIDER_SQL_MEMORY, "")
+			if err != nil {
+				return s, err
+			}
+			s.SetProvider(&tengodb.TengoMemoryDB{InOutMap: map[string]string{"select name from site": sourceIdentifer + "-" + tenantID}})
+			return s, nil
+		},
+	})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(ctx context.Context) string {
+		out, err := capi.Run(ctx, `{}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gjson.Get(out, "name").String()
+	}
+	ctxA := context.WithValue(context.Background(), tenantKey{}, "a")
+	ctxB := context.WithValue(context.Background(), tenantKey{}, "b")
+	cases := []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), "default"},
+		{ctxA, "db-a"},
+		{ctxB, "db-b"},
+		{ctxA, "db-a"},
+	}
+	for _, c := range cases {
+		if got := run(c.ctx); got != c.want {
+			t.Errorf("want:%s,got:%s", c.want, got)
+		}
+	}
+	if made != 2 {
+		t.Errorf("tenant source want lazily made 2 times,got:%d", made)
+	}
+	if evicted := container.EvictIdleSources(0); len(evicted) != 2 {
+		t.Errorf("want evict 2 sources,got:%v", evicted)
+	}
+	run(ctxA)
+	if made != 3 {
+		t.Errorf("evicted tenant source want remade,got:%d", made)
+	}
+}
+
+// evictingResolver 第 evictAt 次解析时淘汰全部空闲资源,模拟执行中发生淘汰
+type evictingResolver struct {
+	*dataexchanger.TenantSourceResolver
+	container *dataexchanger.Container
+	resolved  int
+	evictAt   int
+}
+
+func (r *evictingResolver) Resolve(ctx context.Context, sourceIdentifer string) (identifer string, ok bool) {
+	if identifer, ok = r.TenantSourceResolver.Resolve(ctx, sourceIdentifer); ok {
+		r.resolved++
+		if r.resolved == r.evictAt {
+			r.container.EvictIdleSources(0)
+		}
+	}
+	return identifer, ok
+}
+
+func TestTenantEvictSharedProvider(t *testing.T) {
+	sourceConfig := fmt.Sprintf(`{"dialect":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "tenant.db"))
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL, sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dataexchanger.NewDBProvider(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, sql := range []string{`create table site (name text)`, `insert into site (name) values ('shared')`} {
+		if _, err = provider.ExecOrQueryContext(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/tenant/shared",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=first,src=first,required
+		fullname=second,src=second,required`,
+		MainScript: `
+		ctx:=storage.GetCtx()
+		storage.Set("first",execSQLTPL(ctx,"Name",{}))
+		storage.Set("second",execSQLTPL(ctx,"NameAgain",{}))
+		`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	tplNames := capi.RegisterTemplate("", `{{define "Name"}}select name from site{{end}}
+	{{define "NameAgain"}}select name from site where 1=1{{end}}`)
+	if err = capi.SetTemplateDependSource(tplNames, "db"); err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	container.SetSourceResolver(&evictingResolver{
+		TenantSourceResolver: &dataexchanger.TenantSourceResolver{
+			ContextKey: tenantKey{},
+			MakeTenantSource: func(tenantID string, sourceIdentifer string, identifer string) (s tengosource.Source, err error) {
+				return dataexchanger.MakeSource(identifer, dataexchanger.PROVIDER_SQL, sourceConfig) // 与静态资源共用连接池
+			},
+		},
+		container: container,
+		evictAt:   2,
+	})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	for _, tenantID := range []string{"a", "b"} {
+		out, err := capi.Run(context.WithValue(ctx, tenantKey{}, tenantID), `{}`)
+		if err != nil {
+			t.Fatalf("tenant %s run with source evicted in use:%v", tenantID, err)
+		}
+		if got := gjson.Get(out, "[first,second]").Raw; got != `["shared","shared"]` {
+			t.Errorf("tenant %s got:%s", tenantID, got)
+		}
+	}
+	container.EvictIdleSources(0)
+	out, err := capi.Run(ctx, `{}`)
+	if err != nil {
+		t.Fatalf("static source sharing evicted tenant pool:%v", err)
+	}
+	if got := gjson.Get(out, "first").String(); got != "shared" {
+		t.Errorf("static source got:%s", got)
+	}
+}
+
+func TestTenantSourceDialect(t *testing.T) {
+	tenantConfig := fmt.Sprintf(`{"dialect":"postgres","driver":"sqlite","dsn":"%s"}`, filepath.Join(t.TempDir(), "tenant.db"))
+	provider, err := dataexchanger.NewDBProvider(tenantConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	ctx := context.Background()
+	for _, sql := range []string{`create table site (id integer, name text)`, `insert into site (id,name) values (1,'tenant')`} {
+		if _, err = provider.ExecOrQueryContext(ctx, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/tenant/dialect",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id,format=number`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=name,src=name,required`,
+		MainScript: `storage.Set("name",execSQLTPL(storage.GetCtx(),"Name",storage.GetMemory()))`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.SetProvider(&tengodb.TengoMemoryDB{InOutMap: map[string]string{"select name||'-mysql' from site where id=1": "default"}})
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateDependSource(capi.RegisterTemplate("", `{{define "Name"}}select name||'-{{.__dialect}}' from site where id=:id{{end}}`), "db"); err != nil {
+		t.Fatal(err)
+	}
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	container.SetSourceResolver(&dataexchanger.TenantSourceResolver{
+		ContextKey: tenantKey{},
+		MakeTenantSource: func(tenantID string, sourceIdentifer string, identifer string) (s tengosource.Source, err error) {
+			return dataexchanger.MakeSource(identifer, dataexchanger.PROVIDER_SQL, tenantConfig)
+		},
+	})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	out, err := capi.Run(context.WithValue(ctx, tenantKey{}, "a"), `{"id":"1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.Get(out, "name").String(); got != "tenant-postgres" {
+		t.Errorf("tenant source want rendered and bound with its own dialect,got:%s", out)
+	}
+	container.EvictIdleSources(0)
+}
+
+func TestTenantSlowSource(t *testing.T) {
+	api := &dataexchanger.DtoAPI{
+		Methods: "get",
+		Route:   "/api/tenant/slow",
+		InputLineSchema: `version=http://json-schema.org/draft-07/schema,id=input,direction=in
+		fullname=id,dst=id`,
+		OutputLineSchema: `version=http://json-schema.org/draft-07/schema,id=output,direction=out
+		fullname=name,src=name,required`,
+		MainScript: `storage.Set("name",execSQLTPL(storage.GetCtx(),"Name",storage.GetMemory()))`,
+	}
+	capi, err := dataexchanger.NewApiCompiled(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := dataexchanger.MakeSource("db", dataexchanger.PROVIDER_SQL_MEMORY, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.SetProvider(&tengodb.TengoMemoryDB{InOutMap: map[string]string{"select name from site": "default"}})
+	if err = capi.RegisterSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if err = capi.SetTemplateDependSource(capi.RegisterTemplate("", `{{define "Name"}}select name from site{{end}}`), "db"); err != nil {
+		t.Fatal(err)
+	}
+	making, unblock := make(chan struct{}), make(chan struct{})
+	container := dataexchanger.NewContainer(func(logInfo logchan.LogInforInterface, typeName logchan.LogName, err error) {})
+	container.SetSourceResolver(&dataexchanger.TenantSourceResolver{
+		ContextKey: tenantKey{},
+		MakeTenantSource: func(tenantID string, sourceIdentifer string, identifer string) (s tengosource.Source, err error) {
+			if tenantID == "slow" { // 模拟无法连接的租户数据库
+				close(making)
+				<-unblock
+			}
+			s, err = dataexchanger.MakeSource(identifer, dataexchanger.PROVIDER_SQL_MEMORY, "")
+			if err != nil {
+				return s, err
+			}
+			s.SetProvider(&tengodb.TengoMemoryDB{InOutMap: map[string]string{"select name from site": tenantID}})
+			return s, nil
+		},
+	})
+	if err = container.RegisterAPI(capi); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	slow := make(chan error, 1)
+	go func() {
+		_, err := capi.Run(context.WithValue(ctx, tenantKey{}, "slow"), `{}`)
+		slow <- err
+	}()
+	<-making
+	done := make(chan string, 1)
+	go func() {
+		out, _ := capi.Run(context.WithValue(ctx, tenantKey{}, "a"), `{}`)
+		done <- gjson.Get(out, "name").String()
+	}()
+	select {
+	case got := <-done:
+		if got != "a" {
+			t.Errorf("tenant a got:%s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("tenant a blocked by slow tenant source")
+	}
+	close(unblock)
+	if err = <-slow; err != nil {
+		t.Fatal(err)
+	}
+}